@@ -0,0 +1,753 @@
+package scrna
+
+import (
+	"bufio"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/stats"
+	"github.com/antonybholmes/go-sys/db"
+)
+
+type (
+	AnnotationOptions struct {
+		// the clustering whose clusters are annotated
+		Clustering string `json:"clustering"`
+		// name of a local reference matrix
+		Reference string `json:"reference"`
+		// or the id of a dataset whose clusters are the reference
+		ReferenceDataset string `json:"referenceDataset"`
+		// and the clustering of the reference dataset to use
+		ReferenceClustering string `json:"referenceClustering"`
+		// number of the most variable reference genes to correlate
+		Genes int `json:"genes"`
+	}
+
+	AnnotationScore struct {
+		Label string  `json:"label"`
+		Score float64 `json:"score"`
+	}
+
+	ClusterAnnotation struct {
+		Name  string `json:"name"`
+		Label int    `json:"label"`
+		// best matching reference labels, best first
+		Suggestions []*AnnotationScore `json:"suggestions"`
+		// difference between the best and second best scores, a
+		// measure of how confident the suggestion is
+		Delta float64 `json:"delta"`
+	}
+
+	ClusterAnnotations struct {
+		Dataset    string               `json:"dataset"`
+		Clustering string               `json:"clustering"`
+		Reference  string               `json:"reference"`
+		Genes      int                  `json:"genes"`
+		Clusters   []*ClusterAnnotation `json:"clusters"`
+		// suggestions are only saved when run by an admin
+		Saved bool `json:"saved"`
+	}
+
+	// Mean expression of genes, keyed by upper case symbol, in each
+	// of a set of labelled groups such as cell types or clusters
+	referenceProfile struct {
+		genes  map[string][]float64
+		labels []string
+	}
+)
+
+const (
+	// subdirectory of the data dir holding reference matrices
+	ReferencesDir = "references"
+
+	DefaultAnnotationGenes = 1000
+
+	// number of suggestions saved per cluster
+	AnnotationSuggestions = 3
+
+	// name of the cluster metadata accepted annotations are stored as
+	CellTypeMetadata = "Cell type"
+
+	DeleteClusterAnnotationsSql = `DELETE FROM cluster_annotations
+		WHERE cluster_id IN (
+			SELECT c.id FROM clusters c
+			JOIN datasets d ON c.dataset_id = d.id
+			WHERE d.public_id = :id AND c.clustering_id = :clustering)`
+
+	InsertClusterAnnotationSql = `INSERT INTO cluster_annotations
+		(cluster_id, reference, rank, label, score)
+		SELECT c.id, :reference, :rank, :label, :score
+		FROM clusters c
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id AND c.clustering_id = :clustering AND c.label = :cluster`
+
+	ClusterAnnotationsSql = `SELECT
+		c.label,
+		c.name,
+		ca.reference,
+		ca.label,
+		ca.score
+		FROM cluster_annotations ca
+		JOIN clusters c ON ca.cluster_id = c.id
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id AND c.clustering_id = :clustering
+		ORDER BY c.label, ca.rank`
+
+	// wait up to 5s for other writers and use WAL so that readers
+	// are not blocked
+	SqliteWriteSuffix = "?_busy_timeout=5000&_journal_mode=WAL"
+
+	ClusterIdSql = `SELECT
+		c.id
+		FROM clusters c
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id AND c.clustering_id = :clustering AND c.label = :cluster`
+
+	ClusterNamesSql = `SELECT name FROM clusters WHERE clustering_id = :clustering AND id != :cluster`
+
+	UpdateClusterNameSql = `UPDATE clusters SET name = :name WHERE id = :cluster`
+
+	MetadataIdSql = `SELECT id FROM metadata WHERE name = :name`
+
+	InsertMetadataSql = `INSERT INTO metadata (public_id, name) VALUES (:public_id, :name)`
+
+	UpsertClusterMetadataSql = `INSERT INTO cluster_metadata (cluster_id, metadata_id, value)
+		VALUES (:cluster, :metadata, :value)
+		ON CONFLICT(cluster_id, metadata_id) DO UPDATE SET value = excluded.value`
+)
+
+// Suggest a cell type for each cluster of a clustering by correlating the
+// cluster's mean expression profile with each label of a reference,
+// either a local matrix or the clusters of another dataset, using the
+// Spearman correlation over the most variable reference genes. If run
+// by an admin the suggestions are saved so they can be reviewed and
+// accepted later.
+func (sdb *ScrnaDB) AnnotateClusters(datasetId string,
+	options *AnnotationOptions,
+	isAdmin bool,
+	permissions []string) (*ClusterAnnotations, error) {
+
+	var reference *referenceProfile
+	var referenceName string
+	var err error
+
+	switch {
+	case options.Reference != "":
+		referenceName = options.Reference
+		reference, err = sdb.loadReference(options.Reference)
+	case options.ReferenceDataset != "":
+		if options.ReferenceDataset == datasetId {
+			return nil, errors.New("a dataset cannot be its own reference")
+		}
+
+		referenceName = options.ReferenceDataset
+		reference, err = sdb.clusterProfile(options.ReferenceDataset, options.ReferenceClustering, true, isAdmin, permissions)
+	default:
+		return nil, errors.New("no reference")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reference.labels) < 2 {
+		return nil, errors.New("reference must have at least two labels")
+	}
+
+	query, err := sdb.clusterProfile(datasetId, options.Clustering, false, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	genes := annotationGenes(query, reference, options.Genes)
+
+	if len(genes) < 2 {
+		return nil, errors.New("dataset and reference have too few genes in common")
+	}
+
+	ret := ClusterAnnotations{
+		Dataset:    datasetId,
+		Clustering: options.Clustering,
+		Reference:  referenceName,
+		Genes:      len(genes),
+		Clusters:   make([]*ClusterAnnotation, 0, len(clusters)),
+	}
+
+	x := make([]float64, len(genes))
+	y := make([]float64, len(genes))
+
+	for _, cluster := range clusters {
+		column := slices.Index(query.labels, strconv.Itoa(cluster.Label))
+
+		if column == -1 {
+			continue
+		}
+
+		for i, gene := range genes {
+			x[i] = query.genes[gene][column]
+		}
+
+		scores := make([]*AnnotationScore, len(reference.labels))
+
+		for j, label := range reference.labels {
+			for i, gene := range genes {
+				y[i] = reference.genes[gene][j]
+			}
+
+			scores[j] = &AnnotationScore{Label: label, Score: stats.Spearman(x, y)}
+		}
+
+		slices.SortStableFunc(scores, func(a, b *AnnotationScore) int {
+			switch {
+			case a.Score > b.Score:
+				return -1
+			case a.Score < b.Score:
+				return 1
+			default:
+				return 0
+			}
+		})
+
+		ret.Clusters = append(ret.Clusters, &ClusterAnnotation{
+			Name:        cluster.Name,
+			Label:       cluster.Label,
+			Suggestions: scores[:min(AnnotationSuggestions, len(scores))],
+			Delta:       scores[0].Score - scores[1].Score,
+		})
+	}
+
+	// groups of cell metadata are not clusters so suggestions for
+	// them cannot be saved
+	_, isMetadata := cellMetadataGroup(options.Clustering)
+
+	if isAdmin && !isMetadata {
+		err = sdb.saveClusterAnnotations(&ret)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Saved = true
+	}
+
+	return &ret, nil
+}
+
+// Returns the saved annotation suggestions for the clusters of
+// a clustering of a dataset
+func (sdb *ScrnaDB) ClusterAnnotations(datasetId string, clustering string, isAdmin bool, permissions []string) (*ClusterAnnotations, error) {
+	// check the user can view the dataset
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusteringId, err := sdb.clusteringId(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sdb.db.Query(ClusterAnnotationsSql,
+		sql.Named("id", datasetId),
+		sql.Named("clustering", clusteringId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := ClusterAnnotations{
+		Dataset:    datasetId,
+		Clustering: clustering,
+		Clusters:   make([]*ClusterAnnotation, 0, 20),
+		Saved:      true,
+	}
+
+	var cluster *ClusterAnnotation
+
+	for rows.Next() {
+		var label int
+		var name string
+		var score AnnotationScore
+
+		err := rows.Scan(&label, &name, &ret.Reference, &score.Label, &score.Score)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if cluster == nil || cluster.Label != label {
+			cluster = &ClusterAnnotation{Name: name, Label: label}
+			ret.Clusters = append(ret.Clusters, cluster)
+		}
+
+		cluster.Suggestions = append(cluster.Suggestions, &score)
+	}
+
+	for _, cluster := range ret.Clusters {
+		if len(cluster.Suggestions) > 1 {
+			cluster.Delta = cluster.Suggestions[0].Score - cluster.Suggestions[1].Score
+		}
+	}
+
+	return &ret, nil
+}
+
+// Accept a cell type for a cluster of a clustering, renaming the cluster
+// and recording the cell type as cluster metadata. If name is empty the
+// best saved suggestion is used. Cluster names must be unique within a
+// clustering so a cell type already given to another cluster is
+// numbered, e.g. "B cell 2", and the cluster's new name is returned.
+// Only admins can change clusters.
+func (sdb *ScrnaDB) AcceptClusterAnnotation(datasetId string, clustering string, label int, name string, isAdmin bool) (string, error) {
+	if !isAdmin {
+		return "", errors.New("only admins can annotate clusters")
+	}
+
+	clusteringId, err := sdb.clusteringId(datasetId, clustering)
+
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		annotations, err := sdb.ClusterAnnotations(datasetId, clustering, isAdmin, nil)
+
+		if err != nil {
+			return "", err
+		}
+
+		i := slices.IndexFunc(annotations.Clusters, func(c *ClusterAnnotation) bool {
+			return c.Label == label
+		})
+
+		if i == -1 || len(annotations.Clusters[i].Suggestions) == 0 {
+			return "", fmt.Errorf("cluster %d has no suggestions", label)
+		}
+
+		name = annotations.Clusters[i].Suggestions[0].Label
+	}
+
+	wdb, err := sdb.writeDB()
+
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := wdb.Begin()
+
+	if err != nil {
+		return "", err
+	}
+
+	defer tx.Rollback()
+
+	var clusterId int
+
+	err = tx.QueryRow(ClusterIdSql,
+		sql.Named("id", datasetId),
+		sql.Named("clustering", clusteringId),
+		sql.Named("cluster", label)).Scan(&clusterId)
+
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("cluster %d not found", label)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	clusterName, err := uniqueClusterName(tx, clusteringId, clusterId, name)
+
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(UpdateClusterNameSql, sql.Named("name", clusterName), sql.Named("cluster", clusterId))
+
+	if err != nil {
+		return "", err
+	}
+
+	var metadataId int64
+
+	err = tx.QueryRow(MetadataIdSql, sql.Named("name", CellTypeMetadata)).Scan(&metadataId)
+
+	if err == sql.ErrNoRows {
+		result, err := tx.Exec(InsertMetadataSql,
+			sql.Named("public_id", newPublicId()),
+			sql.Named("name", CellTypeMetadata))
+
+		if err != nil {
+			return "", err
+		}
+
+		metadataId, err = result.LastInsertId()
+
+		if err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(UpsertClusterMetadataSql,
+		sql.Named("cluster", clusterId),
+		sql.Named("metadata", metadataId),
+		sql.Named("value", name))
+
+	if err != nil {
+		return "", err
+	}
+
+	err = tx.Commit()
+
+	if err != nil {
+		return "", err
+	}
+
+	return clusterName, nil
+}
+
+// uniqueClusterName returns name, or name followed by the first number
+// from 2 that makes it unique among the other clusters of a clustering
+func uniqueClusterName(tx *sql.Tx, clusteringId int, clusterId int, name string) (string, error) {
+	rows, err := tx.Query(ClusterNamesSql, sql.Named("clustering", clusteringId), sql.Named("cluster", clusterId))
+
+	if err != nil {
+		return "", err
+	}
+
+	defer rows.Close()
+
+	names := make(map[string]struct{})
+
+	for rows.Next() {
+		var n string
+
+		err := rows.Scan(&n)
+
+		if err != nil {
+			return "", err
+		}
+
+		names[n] = struct{}{}
+	}
+
+	ret := name
+
+	for i := 2; ; i++ {
+		if _, ok := names[ret]; !ok {
+			return ret, nil
+		}
+
+		ret = fmt.Sprintf("%s %d", name, i)
+	}
+}
+
+func (sdb *ScrnaDB) saveClusterAnnotations(annotations *ClusterAnnotations) error {
+	clusteringId, err := sdb.clusteringId(annotations.Dataset, annotations.Clustering)
+
+	if err != nil {
+		return err
+	}
+
+	wdb, err := sdb.writeDB()
+
+	if err != nil {
+		return err
+	}
+
+	tx, err := wdb.Begin()
+
+	if err != nil {
+		return err
+	}
+
+	defer tx.Rollback()
+
+	// only the latest suggestions are kept
+	_, err = tx.Exec(DeleteClusterAnnotationsSql,
+		sql.Named("id", annotations.Dataset),
+		sql.Named("clustering", clusteringId))
+
+	if err != nil {
+		return err
+	}
+
+	for _, cluster := range annotations.Clusters {
+		for rank, suggestion := range cluster.Suggestions {
+			_, err = tx.Exec(InsertClusterAnnotationSql,
+				sql.Named("id", annotations.Dataset),
+				sql.Named("clustering", clusteringId),
+				sql.Named("cluster", cluster.Label),
+				sql.Named("reference", annotations.Reference),
+				sql.Named("rank", rank+1),
+				sql.Named("label", suggestion.Label),
+				sql.Named("score", suggestion.Score))
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return tx.Commit()
+}
+
+// writeDB returns a writable connection to the database, which is
+// only needed for the few admin operations that change it. Writes use
+// WAL so that they do not block the read-only connection and wait for
+// each other rather than failing with SQLITE_BUSY. This means the data
+// dir must be writable, since sqlite keeps its WAL and shared memory
+// files next to the database.
+func (sdb *ScrnaDB) writeDB() (*sql.DB, error) {
+	sdb.wdbMu.Lock()
+	defer sdb.wdbMu.Unlock()
+
+	if sdb.wdb == nil {
+		wdb, err := sql.Open(db.Sqlite3DB, filepath.Join(sdb.dir, "scrna.db")+SqliteWriteSuffix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// sqlite only allows one writer at a time
+		wdb.SetMaxOpenConns(1)
+
+		sdb.wdb = wdb
+	}
+
+	return sdb.wdb, nil
+}
+
+// clusterProfile returns the mean expression of each gene in each
+// cluster of a clustering of a dataset. Clusters are labelled by name
+// if byName is true, otherwise by their numeric label.
+func (sdb *ScrnaDB) clusterProfile(datasetId string, clustering string, byName bool, isAdmin bool, permissions []string) (*referenceProfile, error) {
+	clusters, err := sdb.clusters(datasetId, clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := referenceProfile{
+		genes:  make(map[string][]float64, 30000),
+		labels: make([]string, len(clusters)),
+	}
+
+	columns := make(map[int]int, len(clusters))
+	sizes := make([]float64, len(clusters))
+
+	for i, cluster := range clusters {
+		columns[cluster.Label] = i
+
+		if byName {
+			ret.labels[i] = cluster.Name
+		} else {
+			ret.labels[i] = strconv.Itoa(cluster.Label)
+		}
+	}
+
+	// map cells straight to columns, -1 for cells in unknown clusters
+	cellColumns := make([]int, len(cellClusters))
+
+	for i, label := range cellClusters {
+		col, ok := columns[label]
+
+		if !ok {
+			col = -1
+		} else {
+			sizes[col]++
+		}
+
+		cellColumns[i] = col
+	}
+
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = sdb.scanGex(datasetId, gexType, isAdmin, permissions, func(gex *dat.GexGene) error {
+		means := make([]float64, len(clusters))
+
+		for i, index := range gex.Indexes {
+			if int(index) < len(cellColumns) && cellColumns[index] != -1 {
+				means[cellColumns[index]] += float64(gex.Gex[i])
+			}
+		}
+
+		for col := range means {
+			if sizes[col] > 0 {
+				means[col] /= sizes[col]
+			}
+		}
+
+		ret.genes[strings.ToUpper(gex.GeneSymbol)] = means
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// loadReference reads a local reference matrix, a tab separated file
+// with a header of cell type labels and a row per gene starting with
+// the gene symbol
+func (sdb *ScrnaDB) loadReference(name string) (*referenceProfile, error) {
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid reference %s", name)
+	}
+
+	f, err := os.Open(filepath.Join(sdb.dir, ReferencesDir, name+".tsv"))
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("reference %s not found", name)
+		}
+
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		return nil, fmt.Errorf("reference %s is empty", name)
+	}
+
+	header := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+
+	ret := referenceProfile{
+		genes:  make(map[string][]float64, 30000),
+		labels: header[1:],
+	}
+
+	for scanner.Scan() {
+		tokens := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+
+		if len(tokens) != len(header) {
+			return nil, fmt.Errorf("reference %s has a row of the wrong length", name)
+		}
+
+		values := make([]float64, len(ret.labels))
+
+		for i, token := range tokens[1:] {
+			values[i], err = strconv.ParseFloat(token, 64)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		ret.genes[strings.ToUpper(tokens[0])] = values
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// annotationGenes returns the n genes shared by a dataset and a
+// reference that vary most across the reference labels
+func annotationGenes(query *referenceProfile, reference *referenceProfile, n int) []string {
+	if n <= 0 {
+		n = DefaultAnnotationGenes
+	}
+
+	type geneVariance struct {
+		gene     string
+		variance float64
+	}
+
+	shared := make([]geneVariance, 0, len(reference.genes))
+
+	for gene, values := range reference.genes {
+		if _, ok := query.genes[gene]; !ok {
+			continue
+		}
+
+		var mean float64
+
+		for _, v := range values {
+			mean += v
+		}
+
+		mean /= float64(len(values))
+
+		var ss float64
+
+		for _, v := range values {
+			ss += (v - mean) * (v - mean)
+		}
+
+		if ss > 0 {
+			shared = append(shared, geneVariance{gene: gene, variance: ss / float64(len(values))})
+		}
+	}
+
+	slices.SortFunc(shared, func(a, b geneVariance) int {
+		switch {
+		case a.variance > b.variance:
+			return -1
+		case a.variance < b.variance:
+			return 1
+		default:
+			return strings.Compare(a.gene, b.gene)
+		}
+	})
+
+	ret := make([]string, 0, min(n, len(shared)))
+
+	for _, g := range shared[:min(n, len(shared))] {
+		ret = append(ret, g.gene)
+	}
+
+	return ret
+}
+
+// newPublicId returns a random version 4 uuid for new rows
+func newPublicId() string {
+	var b [16]byte
+
+	rand.Read(b[:])
+
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,410 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+type (
+	BinShape string
+
+	BinOptions struct {
+		// embedding to bin, the default umap if empty
+		Embedding string `json:"embedding"`
+		// clustering whose clusters are counted, the default if empty
+		Clustering string   `json:"clustering"`
+		Shape      BinShape `json:"shape"`
+		// number of bins along the longer side of the embedding
+		Size int `json:"size"`
+		// mean expression of these genes is returned for each bin
+		Genes []string `json:"genes"`
+		// cells failing these are not binned
+		Qc *QcThresholds `json:"qc"`
+	}
+
+	// A bin of cells. Values has the mean expression of each
+	// requested gene in the same order as the genes.
+	EmbeddingBin struct {
+		X     float64 `json:"x"`
+		Y     float64 `json:"y"`
+		Cells int     `json:"cells"`
+		// label of the cluster most cells in the bin belong to
+		// and the fraction of cells in it
+		Cluster  int       `json:"cluster"`
+		Purity   float64   `json:"purity"`
+		Values   []float64 `json:"values,omitempty"`
+		clusters map[int]int
+	}
+
+	// Cells of an embedding aggregated into square or hexagonal bins.
+	// Step is the width of the square bins or the distance between
+	// the centre and corners of the hexagons, which are pointy topped.
+	EmbeddingBins struct {
+		Dataset   string          `json:"dataset"`
+		Embedding string          `json:"embedding"`
+		Shape     BinShape        `json:"shape"`
+		Bounds    spatial.Rect    `json:"bounds"`
+		Step      float64         `json:"step"`
+		Clusters  []*Cluster      `json:"clusters"`
+		Genes     []*HeatmapGene  `json:"genes,omitempty"`
+		Bins      []*EmbeddingBin `json:"bins"`
+	}
+
+	RegionOptions struct {
+		Embedding  string       `json:"embedding"`
+		Clustering string       `json:"clustering"`
+		Region     spatial.Rect `json:"region"`
+		// maximum number of cells to return; if more are in the
+		// region an even sample of them is returned
+		Limit int           `json:"limit"`
+		Qc    *QcThresholds `json:"qc"`
+	}
+
+	RegionCell struct {
+		Index   uint32  `json:"index"`
+		X       float64 `json:"x"`
+		Y       float64 `json:"y"`
+		Cluster int     `json:"cluster"`
+	}
+
+	// The cells inside a rectangle of an embedding, typically the
+	// visible part of a zoomed in view
+	RegionCells struct {
+		Dataset   string        `json:"dataset"`
+		Embedding string        `json:"embedding"`
+		Region    spatial.Rect  `json:"region"`
+		Cells     []*RegionCell `json:"cells"`
+		// number of cells in the region, which is more than the
+		// number returned if they were sampled
+		Total int `json:"total"`
+	}
+)
+
+const (
+	BinSquare BinShape = "square"
+	BinHex    BinShape = "hex"
+
+	DefaultBinSize = 100
+	MaxBinSize     = 1000
+	MaxBinGenes    = 10
+
+	DefaultRegionCells = 50000
+	MaxRegionCells     = 200000
+)
+
+func ParseBinShape(shape string) (BinShape, error) {
+	switch strings.ToLower(shape) {
+	case "", "hex", "hexagon":
+		return BinHex, nil
+	case "square", "grid":
+		return BinSquare, nil
+	default:
+		return "", fmt.Errorf("unknown bin shape %s", shape)
+	}
+}
+
+// Aggregate the cells of an embedding into bins so that large datasets
+// can be drawn without sending every cell
+func (sdb *ScrnaDB) Bins(datasetId string,
+	options *BinOptions,
+	isAdmin bool,
+	permissions []string) (*EmbeddingBins, error) {
+
+	shape, err := ParseBinShape(string(options.Shape))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Genes) > MaxBinGenes {
+		return nil, fmt.Errorf("at most %d genes can be binned", MaxBinGenes)
+	}
+
+	size := options.Size
+
+	if size <= 0 {
+		size = DefaultBinSize
+	}
+
+	size = min(size, MaxBinSize)
+
+	// also checks the user can view the dataset
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := sdb.spatialIndex(datasetId, options.Embedding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cellClusters) != tree.Len() {
+		return nil, errors.New("embedding does not match the cells")
+	}
+
+	passed, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]spatial.Point, tree.Len())
+
+	for i := range points {
+		points[i] = tree.Point(i)
+	}
+
+	ret := EmbeddingBins{
+		Dataset:   datasetId,
+		Embedding: embeddingName(options.Embedding),
+		Shape:     shape,
+		Bounds:    spatial.Bounds(points),
+		Clusters:  clusters,
+		Bins:      make([]*EmbeddingBin, 0, min(size*size, len(points))),
+	}
+
+	ret.Step = max(ret.Bounds.Width(), ret.Bounds.Height()) / float64(size)
+
+	if ret.Step == 0 {
+		ret.Step = 1
+	}
+
+	// the index of the bin of each cell or -1 if it is excluded
+	cellBins := make([]int, len(points))
+	binIndexes := make(map[[2]int]int)
+
+	for i, p := range points {
+		if passed != nil && !passed.Has(i) {
+			cellBins[i] = -1
+			continue
+		}
+
+		var key [2]int
+		var centre spatial.Point
+
+		if shape == BinHex {
+			key, centre = hexBin(p, ret.Bounds.Min, ret.Step)
+		} else {
+			key, centre = squareBin(p, &ret.Bounds, ret.Step)
+		}
+
+		b, ok := binIndexes[key]
+
+		if !ok {
+			b = len(ret.Bins)
+			binIndexes[key] = b
+			ret.Bins = append(ret.Bins, &EmbeddingBin{X: centre.X, Y: centre.Y, clusters: make(map[int]int)})
+		}
+
+		bin := ret.Bins[b]
+		bin.Cells++
+		bin.clusters[cellClusters[i]]++
+		cellBins[i] = b
+	}
+
+	for _, bin := range ret.Bins {
+		n := 0
+
+		for label, count := range bin.clusters {
+			if count > n || (count == n && label < bin.Cluster) {
+				bin.Cluster = label
+				n = count
+			}
+		}
+
+		bin.Purity = float64(n) / float64(bin.Cells)
+	}
+
+	if len(options.Genes) > 0 {
+		genes, err := sdb.GetGenes(datasetId, options.Genes, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		gex, err := sdb.orderedGex(genes, options.Genes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Genes = make([]*HeatmapGene, len(gex))
+
+		for _, bin := range ret.Bins {
+			bin.Values = make([]float64, len(gex))
+		}
+
+		for g, gene := range gex {
+			ret.Genes[g] = &HeatmapGene{GeneId: gene.GeneId, GeneSymbol: gene.GeneSymbol}
+
+			for i, index := range gene.Indexes {
+				if int(index) < len(cellBins) && cellBins[index] != -1 {
+					ret.Bins[cellBins[index]].Values[g] += float64(gene.Gex[i])
+				}
+			}
+		}
+
+		for _, bin := range ret.Bins {
+			for g := range bin.Values {
+				bin.Values[g] /= float64(bin.Cells)
+			}
+		}
+	}
+
+	return &ret, nil
+}
+
+// Returns the cells of an embedding inside a rectangle so that zoomed
+// in views only fetch the cells they show
+func (sdb *ScrnaDB) Region(datasetId string,
+	options *RegionOptions,
+	isAdmin bool,
+	permissions []string) (*RegionCells, error) {
+
+	if options.Region.Max.X < options.Region.Min.X || options.Region.Max.Y < options.Region.Min.Y {
+		return nil, errors.New("region max must not be less than its min")
+	}
+
+	limit := options.Limit
+
+	if limit <= 0 {
+		limit = DefaultRegionCells
+	}
+
+	limit = min(limit, MaxRegionCells)
+
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := sdb.spatialIndex(datasetId, options.Embedding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cellClusters) != tree.Len() {
+		return nil, errors.New("embedding does not match the cells")
+	}
+
+	passed, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := tree.InRect(options.Region)
+
+	if passed != nil {
+		kept := indexes[:0]
+
+		for _, i := range indexes {
+			if passed.Has(i) {
+				kept = append(kept, i)
+			}
+		}
+
+		indexes = kept
+	}
+
+	ret := RegionCells{
+		Dataset:   datasetId,
+		Embedding: embeddingName(options.Embedding),
+		Region:    options.Region,
+		Total:     len(indexes),
+		Cells:     make([]*RegionCell, 0, min(len(indexes), limit)),
+	}
+
+	// take evenly spaced cells so the sample covers the region
+	// and is the same each time
+	step := max(float64(len(indexes))/float64(limit), 1)
+
+	for s := 0.0; int(s) < len(indexes) && len(ret.Cells) < limit; s += step {
+		i := indexes[int(s)]
+		p := tree.Point(i)
+
+		ret.Cells = append(ret.Cells, &RegionCell{
+			Index:   uint32(i),
+			X:       p.X,
+			Y:       p.Y,
+			Cluster: cellClusters[i],
+		})
+	}
+
+	return &ret, nil
+}
+
+func embeddingName(name string) string {
+	if isDefaultEmbedding(name) {
+		return DefaultEmbedding
+	}
+
+	return name
+}
+
+// squareBin finds the square of side step containing p. Points on the
+// max edge of the bounds are put in the last column or row rather than
+// one past it.
+func squareBin(p spatial.Point, bounds *spatial.Rect, step float64) ([2]int, spatial.Point) {
+	columns := max(int(math.Ceil(bounds.Width()/step)), 1)
+	rows := max(int(math.Ceil(bounds.Height()/step)), 1)
+
+	col := min(int(math.Floor((p.X-bounds.Min.X)/step)), columns-1)
+	row := min(int(math.Floor((p.Y-bounds.Min.Y)/step)), rows-1)
+
+	return [2]int{col, row}, spatial.Point{
+		X: bounds.Min.X + (float64(col)+0.5)*step,
+		Y: bounds.Min.Y + (float64(row)+0.5)*step,
+	}
+}
+
+// hexBin finds the pointy topped hexagon of radius size containing p
+// using axial coordinates and cube rounding
+func hexBin(p spatial.Point, origin spatial.Point, size float64) ([2]int, spatial.Point) {
+	x := (p.X - origin.X) / size
+	y := (p.Y - origin.Y) / size
+
+	q := math.Sqrt(3)/3*x - y/3
+	r := 2 * y / 3
+	s := -q - r
+
+	rq := math.Round(q)
+	rr := math.Round(r)
+	rs := math.Round(s)
+
+	dq := math.Abs(rq - q)
+	dr := math.Abs(rr - r)
+	ds := math.Abs(rs - s)
+
+	if dq > dr && dq > ds {
+		rq = -rr - rs
+	} else if dr > ds {
+		rr = -rq - rs
+	}
+
+	return [2]int{int(rq), int(rr)}, spatial.Point{
+		X: origin.X + size*math.Sqrt(3)*(rq+rr/2),
+		Y: origin.Y + size*1.5*rr,
+	}
+}
@@ -0,0 +1,116 @@
+package scrna
+
+import (
+	"container/list"
+	"sync"
+)
+
+type (
+	// lruCache holds values whose total cost is at most size, evicting
+	// the least recently used. Values are built outside the cache's
+	// lock so that a slow build only blocks requests for the same key,
+	// which wait for it rather than building the value again.
+	lruCache[V any] struct {
+		entries map[string]*cacheEntry[V]
+		// keys from least to most recently used
+		order *list.List
+		cost  func(V) int
+		size  int
+		used  int
+		mu    sync.Mutex
+	}
+
+	cacheEntry[V any] struct {
+		// closed once the value is built
+		ready chan struct{}
+		value V
+		err   error
+		cost  int
+		elem  *list.Element
+	}
+)
+
+// newLruCache creates a cache of values costing cost(value) each, e.g.
+// their size in bytes, or 1 each if cost is nil so that size is the
+// number of values. The most recent value is always kept even if it
+// costs more than size.
+func newLruCache[V any](size int, cost func(V) int) *lruCache[V] {
+	if cost == nil {
+		cost = func(V) int { return 1 }
+	}
+
+	return &lruCache[V]{
+		entries: make(map[string]*cacheEntry[V]),
+		order:   list.New(),
+		cost:    cost,
+		size:    max(size, 1),
+	}
+}
+
+// get returns the value of a key, calling build to make it if it is
+// not cached. Errors are not cached so a failed build is retried by
+// the next request.
+func (c *lruCache[V]) get(key string, build func() (V, error)) (V, error) {
+	c.mu.Lock()
+
+	entry, ok := c.entries[key]
+
+	if ok {
+		c.order.MoveToBack(entry.elem)
+		c.mu.Unlock()
+
+		<-entry.ready
+
+		return entry.value, entry.err
+	}
+
+	entry = &cacheEntry[V]{ready: make(chan struct{})}
+	entry.elem = c.order.PushBack(key)
+	c.entries[key] = entry
+
+	c.mu.Unlock()
+
+	func() {
+		// waiters must be released even if build panics
+		defer close(entry.ready)
+
+		entry.value, entry.err = build()
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry.err != nil {
+		if c.entries[key] == entry {
+			c.remove(key)
+		}
+
+		return entry.value, entry.err
+	}
+
+	// make room once the value exists so a failed build never
+	// evicts a good value
+	if c.entries[key] == entry {
+		entry.cost = c.cost(entry.value)
+		c.used += entry.cost
+	}
+
+	for c.used > c.size && c.order.Front() != entry.elem {
+		c.remove(c.order.Front().Value.(string))
+	}
+
+	return entry.value, entry.err
+}
+
+// remove drops a key from the cache. Callers must hold mu.
+func (c *lruCache[V]) remove(key string) {
+	entry, ok := c.entries[key]
+
+	if !ok {
+		return
+	}
+
+	c.order.Remove(entry.elem)
+	delete(c.entries, key)
+	c.used -= entry.cost
+}
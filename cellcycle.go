@@ -0,0 +1,385 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-web/auth/sqlite"
+)
+
+type (
+	CellCycleOptions struct {
+		// custom gene lists, otherwise the standard S and G2M lists
+		// of Tirosh et al. 2016 as updated by Seurat in 2019 are used
+		SGenes   []string `json:"sGenes"`
+		G2MGenes []string `json:"g2mGenes"`
+		// seed for picking control genes
+		Seed uint64 `json:"seed"`
+	}
+
+	// S and G2M scores and phase of each cell in the same order as
+	// the cells returned by Metadata
+	CellCycleResults struct {
+		Dataset  string         `json:"dataset"`
+		SGenes   []string       `json:"sGenes"`
+		G2MGenes []string       `json:"g2mGenes"`
+		S        []float32      `json:"s"`
+		G2M      []float32      `json:"g2m"`
+		Phases   []string       `json:"phases"`
+		Counts   map[string]int `json:"counts"`
+		// true if the scores were computed at import rather
+		// than on the fly
+		Stored bool `json:"stored"`
+	}
+)
+
+const (
+	PhaseG1  = "G1"
+	PhaseS   = "S"
+	PhaseG2M = "G2M"
+
+	// genes are binned by mean expression and each scored gene is
+	// matched with this many random genes from its bin, as in
+	// Seurat's AddModuleScore
+	CellCycleBins     = 24
+	CellCycleControls = 100
+
+	GenesByMeanSql = `SELECT
+		gx.id,
+		g.ensembl,
+		g.gene_symbol,
+		f.url,
+		gx.offset,
+		gx.size
+		FROM gex gx
+		JOIN genes g ON gx.gene_id = g.id
+		JOIN gene_stats gs ON gx.id = gs.gex_id
+		JOIN files f ON gx.file_id = f.id
+		JOIN datasets d ON gx.dataset_id = d.id
+		JOIN dataset_permissions dp ON d.id = dp.dataset_id
+		JOIN permissions p ON dp.permission_id = p.id
+		WHERE
+			<<PERMISSIONS>>
+			AND d.public_id = :id
+			AND gx.gex_type_id = :gex_type
+		ORDER BY gs.mean, g.gene_symbol`
+
+	CellCycleSql = `SELECT
+		cc.s_score,
+		cc.g2m_score,
+		cc.phase
+		FROM cells c
+		JOIN cell_cycle cc ON c.id = cc.cell_id
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+)
+
+var (
+	CellCycleSGenes = []string{"MCM5", "PCNA", "TYMS", "FEN1", "MCM7", "MCM4",
+		"RRM1", "UNG", "GINS2", "MCM6", "CDCA7", "DTL", "PRIM1", "UHRF1", "CENPU",
+		"HELLS", "RFC2", "POLR1B", "NASP", "RAD51AP1", "GMNN", "WDR76", "SLBP",
+		"CCNE2", "UBR7", "POLD3", "MSH2", "ATAD2", "RAD51", "RRM2", "CDC45", "CDC6",
+		"EXO1", "TIPIN", "DSCC1", "BLM", "CASP8AP2", "USP1", "CLSPN", "POLA1",
+		"CHAF1B", "MRPL36", "E2F8"}
+
+	CellCycleG2MGenes = []string{"HMGB2", "CDK1", "NUSAP1", "UBE2C", "BIRC5",
+		"TPX2", "TOP2A", "NDC80", "CKS2", "NUF2", "CKS1B", "MKI67", "TMPO", "CENPF",
+		"TACC3", "PIMREG", "SMC4", "CCNB2", "CKAP2L", "CKAP2", "AURKB", "BUB1",
+		"KIF11", "ANP32E", "TUBB4B", "GTSE1", "KIF20B", "HJURP", "CDCA3", "JPT1",
+		"CDC20", "TTK", "CDC25C", "KIF2C", "RANGAP1", "NCAPD2", "DLGAP5", "CDCA2",
+		"CDCA8", "ECT2", "KIF23", "HMMR", "AURKA", "PSRC1", "ANLN", "LBR", "CKAP5",
+		"CENPE", "CTCF", "NEK2", "G2E3", "GAS2L3", "CBX5", "CENPA"}
+)
+
+// Score each cell for S and G2M phase gene expression and assign it a
+// phase in the manner of Seurat's CellCycleScoring. Each score is the
+// mean expression of the phase genes minus that of control genes with
+// similar mean expression. Cells scoring below zero for both are G1.
+// Gene lists are matched to the dataset case insensitively so the
+// human lists also find most mouse genes. Scores stored at import are
+// returned if no custom lists are given.
+func (sdb *ScrnaDB) CellCycle(datasetId string,
+	options *CellCycleOptions,
+	isAdmin bool,
+	permissions []string) (*CellCycleResults, error) {
+
+	genes, err := sdb.genesByMean(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(genes) == 0 {
+		return nil, errors.New("dataset has no genes")
+	}
+
+	if len(options.SGenes) == 0 && len(options.G2MGenes) == 0 {
+		ret, err := sdb.storedCellCycle(datasetId)
+
+		if err != nil || ret != nil {
+			return ret, err
+		}
+	}
+
+	sGenes := options.SGenes
+
+	if len(sGenes) == 0 {
+		sGenes = CellCycleSGenes
+	}
+
+	g2mGenes := options.G2MGenes
+
+	if len(g2mGenes) == 0 {
+		g2mGenes = CellCycleG2MGenes
+	}
+
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rng := rand.New(rand.NewPCG(options.Seed, options.Seed))
+
+	ret := CellCycleResults{
+		Dataset: datasetId,
+		Phases:  make([]string, cellCount),
+		Counts:  map[string]int{PhaseG1: 0, PhaseS: 0, PhaseG2M: 0},
+	}
+
+	ret.SGenes, ret.S, err = sdb.moduleScore(genes, sGenes, cellCount, rng)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret.G2MGenes, ret.G2M, err = sdb.moduleScore(genes, g2mGenes, cellCount, rng)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range ret.Phases {
+		phase := PhaseS
+
+		switch {
+		case ret.S[i] < 0 && ret.G2M[i] < 0:
+			phase = PhaseG1
+		case ret.G2M[i] > ret.S[i]:
+			phase = PhaseG2M
+		}
+
+		ret.Phases[i] = phase
+		ret.Counts[phase]++
+	}
+
+	return &ret, nil
+}
+
+// moduleScore returns the genes of a list found in the dataset and the
+// per cell mean of their expression minus the mean of control genes
+// chosen from the same expression bins. genes must be sorted by mean.
+func (sdb *ScrnaDB) moduleScore(genes []*Gene,
+	list []string,
+	cellCount int,
+	rng *rand.Rand) ([]string, []float32, error) {
+
+	// genes are already sorted by mean so bins are equal sized runs
+	bin := func(i int) int {
+		return i * CellCycleBins / len(genes)
+	}
+
+	bins := make([][]int, CellCycleBins)
+
+	for i := range genes {
+		bins[bin(i)] = append(bins[bin(i)], i)
+	}
+
+	features := make([]int, 0, len(list))
+	found := make([]string, 0, len(list))
+
+	for _, id := range list {
+		index := slices.IndexFunc(genes, func(g *Gene) bool {
+			return strings.EqualFold(id, g.GeneSymbol) || strings.EqualFold(id, g.Ensembl)
+		})
+
+		if index != -1 && !slices.Contains(features, index) {
+			features = append(features, index)
+			found = append(found, genes[index].GeneSymbol)
+		}
+	}
+
+	if len(features) == 0 {
+		return nil, nil, errors.New("none of the genes are in the dataset")
+	}
+
+	controls := make(map[int]bool)
+
+	for _, feature := range features {
+		candidates := slices.Clone(bins[bin(feature)])
+
+		n := min(CellCycleControls, len(candidates))
+
+		// partial Fisher-Yates shuffle to pick n controls
+		for i := range n {
+			j := i + rng.IntN(len(candidates)-i)
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+			controls[candidates[i]] = true
+		}
+	}
+
+	featureSums, err := sdb.sumGex(genes, features, cellCount)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	controlIndexes := make([]int, 0, len(controls))
+
+	for index := range controls {
+		controlIndexes = append(controlIndexes, index)
+	}
+
+	slices.Sort(controlIndexes)
+
+	controlSums, err := sdb.sumGex(genes, controlIndexes, cellCount)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scores := make([]float32, cellCount)
+
+	for i := range scores {
+		scores[i] = float32(featureSums[i]/float64(len(features)) -
+			controlSums[i]/float64(len(controlIndexes)))
+	}
+
+	return found, scores, nil
+}
+
+// sumGex returns the per cell sum of the expression of a subset of genes
+func (sdb *ScrnaDB) sumGex(genes []*Gene, indexes []int, cellCount int) ([]float64, error) {
+	ret := make([]float64, cellCount)
+
+	for _, index := range indexes {
+		data, err := sdb.readGex(genes[index])
+
+		if err != nil {
+			return nil, err
+		}
+
+		for j, cell := range data.Indexes {
+			if int(cell) < cellCount {
+				ret[cell] += float64(data.Gex[j])
+			}
+		}
+	}
+
+	return ret, nil
+}
+
+// genesByMean returns the genes of a dataset sorted by the mean of
+// their normalized expression
+func (sdb *ScrnaDB) genesByMean(datasetId string, isAdmin bool, permissions []string) ([]*Gene, error) {
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	namedArgs := []any{sql.Named("id", datasetId), sql.Named("gex_type", gexType)}
+
+	query := sqlite.MakePermissionsSql(GenesByMeanSql, isAdmin, permissions, &namedArgs)
+
+	rows, err := sdb.db.Query(query, namedArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Gene, 0, 30000)
+
+	for rows.Next() {
+		var gene Gene
+
+		err := rows.Scan(&gene.Id,
+			&gene.Ensembl,
+			&gene.GeneSymbol,
+			&gene.Url,
+			&gene.Offset,
+			&gene.Size)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &gene)
+	}
+
+	return ret, nil
+}
+
+// storedCellCycle returns the scores computed at import, nil if the
+// dataset does not have them or an error if they do not cover every
+// cell
+func (sdb *ScrnaDB) storedCellCycle(datasetId string) (*CellCycleResults, error) {
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sdb.db.Query(CellCycleSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := CellCycleResults{
+		Dataset: datasetId,
+		S:       make([]float32, 0, cellCount),
+		G2M:     make([]float32, 0, cellCount),
+		Phases:  make([]string, 0, cellCount),
+		Counts:  map[string]int{PhaseG1: 0, PhaseS: 0, PhaseG2M: 0},
+		Stored:  true,
+	}
+
+	for rows.Next() {
+		var s float32
+		var g2m float32
+		var phase string
+
+		err := rows.Scan(&s, &g2m, &phase)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.S = append(ret.S, s)
+		ret.G2M = append(ret.G2M, g2m)
+		ret.Phases = append(ret.Phases, phase)
+		ret.Counts[phase]++
+	}
+
+	if len(ret.Phases) == 0 {
+		return nil, nil
+	}
+
+	// scores must cover every cell to line up with Metadata so a
+	// partial set means the import is broken
+	if len(ret.Phases) != cellCount {
+		return nil, fmt.Errorf("stored cell cycle scores cover %d of %d cells", len(ret.Phases), cellCount)
+	}
+
+	return &ret, nil
+}
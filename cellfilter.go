@@ -0,0 +1,679 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/antonybholmes/go-scrna/dat"
+)
+
+// A boolean language for gating cells on expression and metadata, e.g.
+//
+//	CD19 > 1 AND CD3E = 0 AND cluster IN (3,5) AND sample = RK01
+//
+// Comparisons are combined with AND, OR, NOT and parentheses. The fields
+// cluster and sample refer to the cell's cluster label, in the clustering
+// the filter is evaluated against, and sample name and any other field is
+// treated as a gene whose expression is compared to a number, cells
+// without a recorded value having an expression of 0.
+
+type (
+	CellFilterResults struct {
+		Dataset string   `json:"dataset"`
+		Filter  string   `json:"filter"`
+		Bitmap  string   `json:"bitmap,omitempty"`
+		Indexes []uint32 `json:"indexes,omitempty"`
+		// total number of cells in the dataset
+		Cells int `json:"cells"`
+		// number of cells passing the filter
+		Count int `json:"count"`
+	}
+
+	cellFilterNode interface {
+		eval(fc *cellFilterContext) (*CellSet, error)
+	}
+
+	cellFilterAnd struct {
+		left  cellFilterNode
+		right cellFilterNode
+	}
+
+	cellFilterOr struct {
+		left  cellFilterNode
+		right cellFilterNode
+	}
+
+	cellFilterNot struct {
+		node cellFilterNode
+	}
+
+	cellFilterCompare struct {
+		field  string
+		op     string
+		values []string
+	}
+
+	// the per cell data a filter is evaluated against
+	cellFilterContext struct {
+		clusters []int
+		samples  []string
+		genes    map[string]*dat.GexGene
+		size     int
+	}
+
+	cellFilterParser struct {
+		tokens []string
+		pos    int
+		genes  []string
+	}
+)
+
+const (
+	CellFilterCluster = "cluster"
+	CellFilterSample  = "sample"
+
+	MaxCellFilterGenes = 20
+)
+
+// Find the cells of a dataset matching a filter expression whose
+// cluster terms refer to the clusters of a clustering
+func (sdb *ScrnaDB) FilterCells(datasetId string,
+	clustering string,
+	filter string,
+	isAdmin bool,
+	permissions []string) (*CellSet, error) {
+
+	node, genes, err := parseCellFilter(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// check the user can see the dataset as the cell queries
+	// do not check permissions
+	_, err = sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var fc cellFilterContext
+
+	fc.clusters, err = sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fc.size = len(fc.clusters)
+
+	fc.samples, err = sdb.cellSamples(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fc.genes = make(map[string]*dat.GexGene, len(genes))
+
+	if len(genes) > 0 {
+		found, err := sdb.GetGenes(datasetId, genes, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		gex, err := sdb.orderedGex(found, genes)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, gene := range genes {
+			fc.genes[strings.ToLower(gene)] = gex[i]
+		}
+	}
+
+	return node.eval(&fc)
+}
+
+// Filter cells and return the result as either a list of indexes or,
+// if bitmap is true, as a base64 encoded bitmap
+func (sdb *ScrnaDB) FilterCellsResults(datasetId string,
+	clustering string,
+	filter string,
+	bitmap bool,
+	isAdmin bool,
+	permissions []string) (*CellFilterResults, error) {
+
+	set, err := sdb.FilterCells(datasetId, clustering, filter, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := CellFilterResults{
+		Dataset: datasetId,
+		Filter:  filter,
+		Cells:   set.Size(),
+		Count:   set.Count(),
+	}
+
+	if bitmap {
+		ret.Bitmap = set.Bitmap()
+	} else {
+		ret.Indexes = set.Indexes()
+	}
+
+	return &ret, nil
+}
+
+// cellFilter returns the cells matching a filter and passing the QC
+// thresholds or nil if there is neither so that callers can skip
+// filtering
+func (sdb *ScrnaDB) cellFilter(datasetId string,
+	clustering string,
+	filter string,
+	qc *QcThresholds,
+	isAdmin bool,
+	permissions []string) (*CellSet, error) {
+
+	var cells *CellSet
+	var err error
+
+	if strings.TrimSpace(filter) != "" {
+		cells, err = sdb.FilterCells(datasetId, clustering, filter, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	passed, err := sdb.qcCells(datasetId, qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case passed == nil:
+		return cells, nil
+	case cells == nil:
+		return passed, nil
+	default:
+		return cells.And(passed), nil
+	}
+}
+
+func parseCellFilter(filter string) (cellFilterNode, []string, error) {
+	tokens, err := tokenizeCellFilter(filter)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("empty filter")
+	}
+
+	p := cellFilterParser{tokens: tokens}
+
+	node, err := p.parseOr()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if p.pos < len(p.tokens) {
+		return nil, nil, fmt.Errorf("unexpected %s in filter", p.tokens[p.pos])
+	}
+
+	if len(p.genes) > MaxCellFilterGenes {
+		return nil, nil, fmt.Errorf("a filter can use at most %d genes", MaxCellFilterGenes)
+	}
+
+	return node, p.genes, nil
+}
+
+func tokenizeCellFilter(filter string) ([]string, error) {
+	tokens := make([]string, 0, 20)
+
+	runes := []rune(filter)
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, string(r))
+			i++
+		case r == '<' || r == '>' || r == '!' || r == '=':
+			if i+1 < len(runes) && runes[i+1] == '=' {
+				tokens = append(tokens, string(runes[i:i+2]))
+				i += 2
+			} else if r == '!' {
+				return nil, errors.New("expected != in filter")
+			} else {
+				tokens = append(tokens, string(r))
+				i++
+			}
+		case r == '"' || r == '\'':
+			end := slices.Index(runes[i+1:], r)
+
+			if end == -1 {
+				return nil, errors.New("unterminated string in filter")
+			}
+
+			// keep the opening quote so that the parser knows this
+			// is a literal and not a keyword
+			tokens = append(tokens, string(runes[i:i+1+end]))
+			i += end + 2
+		case isCellFilterWordRune(r):
+			start := i
+
+			for i < len(runes) && isCellFilterWordRune(runes[i]) {
+				i++
+			}
+
+			tokens = append(tokens, string(runes[start:i]))
+		default:
+			return nil, fmt.Errorf("unexpected %c in filter", r)
+		}
+	}
+
+	return tokens, nil
+}
+
+// gene names can contain dashes and dots, e.g. HLA-DRA
+func isCellFilterWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.' || r == ':'
+}
+
+func (p *cellFilterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+
+	return ""
+}
+
+func (p *cellFilterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", errors.New("unexpected end of filter")
+	}
+
+	t := p.tokens[p.pos]
+	p.pos++
+
+	return t, nil
+}
+
+func (p *cellFilterParser) keyword(k string) bool {
+	if strings.EqualFold(p.peek(), k) {
+		p.pos++
+		return true
+	}
+
+	return false
+}
+
+func (p *cellFilterParser) expect(t string) error {
+	next, err := p.next()
+
+	if err != nil {
+		return err
+	}
+
+	if next != t {
+		return fmt.Errorf("expected %s but found %s in filter", t, next)
+	}
+
+	return nil
+}
+
+func (p *cellFilterParser) parseOr() (cellFilterNode, error) {
+	left, err := p.parseAnd()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("OR") {
+		right, err := p.parseAnd()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &cellFilterOr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *cellFilterParser) parseAnd() (cellFilterNode, error) {
+	left, err := p.parseNot()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("AND") {
+		right, err := p.parseNot()
+
+		if err != nil {
+			return nil, err
+		}
+
+		left = &cellFilterAnd{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *cellFilterParser) parseNot() (cellFilterNode, error) {
+	if p.keyword("NOT") {
+		node, err := p.parseNot()
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &cellFilterNot{node: node}, nil
+	}
+
+	if p.peek() == "(" {
+		p.pos++
+
+		node, err := p.parseOr()
+
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect(")")
+
+		if err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	}
+
+	return p.parseCompare()
+}
+
+func (p *cellFilterParser) parseCompare() (cellFilterNode, error) {
+	field, err := p.next()
+
+	if err != nil {
+		return nil, err
+	}
+
+	field = unquote(field)
+
+	if field == "" || field == "(" || field == ")" || field == "," {
+		return nil, fmt.Errorf("expected field but found %s in filter", field)
+	}
+
+	node := cellFilterCompare{field: field}
+
+	switch strings.ToLower(field) {
+	case CellFilterCluster, CellFilterSample:
+		node.field = strings.ToLower(field)
+	default:
+		if !slices.ContainsFunc(p.genes, func(g string) bool { return strings.EqualFold(g, field) }) {
+			p.genes = append(p.genes, field)
+		}
+	}
+
+	if p.keyword("NOT") {
+		if !p.keyword("IN") {
+			return nil, errors.New("expected IN after NOT in filter")
+		}
+
+		node.op = "NOT IN"
+	} else if p.keyword("IN") {
+		node.op = "IN"
+	} else {
+		node.op, err = p.next()
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch node.op {
+		case "=", "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return nil, fmt.Errorf("unknown operator %s in filter", node.op)
+		}
+	}
+
+	if node.op == "IN" || node.op == "NOT IN" {
+		err = p.expect("(")
+
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			value, err := p.next()
+
+			if err != nil {
+				return nil, err
+			}
+
+			node.values = append(node.values, unquote(value))
+
+			if p.peek() != "," {
+				break
+			}
+
+			p.pos++
+		}
+
+		err = p.expect(")")
+
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		value, err := p.next()
+
+		if err != nil {
+			return nil, err
+		}
+
+		node.values = []string{unquote(value)}
+	}
+
+	if node.field == CellFilterSample {
+		switch node.op {
+		case "=", "==", "!=", "IN", "NOT IN":
+		default:
+			return nil, fmt.Errorf("operator %s cannot be used with sample", node.op)
+		}
+	}
+
+	return &node, nil
+}
+
+func unquote(token string) string {
+	if strings.HasPrefix(token, "\"") || strings.HasPrefix(token, "'") {
+		return token[1:]
+	}
+
+	return token
+}
+
+func (n *cellFilterAnd) eval(fc *cellFilterContext) (*CellSet, error) {
+	left, err := n.left.eval(fc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(fc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return left.And(right), nil
+}
+
+func (n *cellFilterOr) eval(fc *cellFilterContext) (*CellSet, error) {
+	left, err := n.left.eval(fc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(fc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return left.Or(right), nil
+}
+
+func (n *cellFilterNot) eval(fc *cellFilterContext) (*CellSet, error) {
+	set, err := n.node.eval(fc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return set.Not(), nil
+}
+
+func (n *cellFilterCompare) eval(fc *cellFilterContext) (*CellSet, error) {
+	// NOT IN is evaluated as IN and then inverted
+	op := n.op
+
+	if op == "NOT IN" {
+		op = "IN"
+	}
+
+	var set *CellSet
+	var err error
+
+	// the cells the comparison can select, nil for every cell
+	var mask *CellSet
+
+	switch n.field {
+	case CellFilterSample:
+		set = NewCellSet(fc.size)
+
+		for i, sample := range fc.samples {
+			if slices.ContainsFunc(n.values, func(v string) bool { return strings.EqualFold(v, sample) }) != (op == "!=") {
+				set.Add(i)
+			}
+		}
+	case CellFilterCluster:
+		// unclustered cells (label -1) never match a cluster
+		// comparison, not even the complement of NOT IN
+		mask = NewCellSet(fc.size)
+
+		set, err = n.evalNumeric(fc.size, op, func(fn func(i int, v float64)) {
+			for i, label := range fc.clusters {
+				if label != -1 {
+					mask.Add(i)
+					fn(i, float64(label))
+				}
+			}
+		}, false)
+	default:
+		gene := fc.genes[strings.ToLower(n.field)]
+
+		set, err = n.evalNumeric(fc.size, op, func(fn func(i int, v float64)) {
+			for i, index := range gene.Indexes {
+				fn(int(index), float64(gene.Gex[i]))
+			}
+		}, true)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if n.op == "NOT IN" {
+		set = set.Not()
+	}
+
+	if mask != nil {
+		set = set.And(mask)
+	}
+
+	return set, nil
+}
+
+// evalNumeric compares numeric values supplied by each to the values of
+// the comparison. If sparse is true, each only visits the cells with
+// non-zero values and the other cells are assumed to be zero.
+func (n *cellFilterCompare) evalNumeric(size int,
+	op string,
+	each func(fn func(i int, v float64)),
+	sparse bool) (*CellSet, error) {
+
+	values := make([]float64, len(n.values))
+
+	for i, s := range n.values {
+		v, err := strconv.ParseFloat(s, 64)
+
+		if err != nil {
+			return nil, fmt.Errorf("%s is not a number", s)
+		}
+
+		values[i] = v
+	}
+
+	test := func(v float64) bool {
+		switch op {
+		case "IN":
+			return slices.Contains(values, v)
+		case "=", "==":
+			return v == values[0]
+		case "!=":
+			return v != values[0]
+		case "<":
+			return v < values[0]
+		case "<=":
+			return v <= values[0]
+		case ">":
+			return v > values[0]
+		default:
+			return v >= values[0]
+		}
+	}
+
+	var set *CellSet
+
+	// if zero passes the test start with every cell and remove those
+	// whose recorded value fails
+	if sparse && test(0) {
+		set = NewFullCellSet(size)
+
+		each(func(i int, v float64) {
+			if !test(v) {
+				set.Remove(i)
+			}
+		})
+	} else {
+		set = NewCellSet(size)
+
+		each(func(i int, v float64) {
+			if test(v) {
+				set.Add(i)
+			}
+		})
+	}
+
+	return set, nil
+}
@@ -0,0 +1,500 @@
+package scrna
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Cells can have any number of metadata columns, e.g. condition, donor
+// or batch, which are either categorical or numeric. A categorical
+// column can be used wherever a clustering can by naming it as the
+// clustering with the metadata: prefix, e.g. metadata:donor, so that
+// cells can be grouped and colored by it.
+
+type (
+	CellMetadataType string
+
+	CellMetadataCategory struct {
+		Name  string `json:"name"`
+		Color string `json:"color"`
+	}
+
+	CellMetadataColumn struct {
+		Id   string           `json:"id"`
+		Name string           `json:"name"`
+		Type CellMetadataType `json:"type"`
+		// categories of a categorical column indexed by code
+		Categories []*CellMetadataCategory `json:"categories,omitempty"`
+	}
+
+	CellMetadataOptions struct {
+		// ids or names of the columns to return
+		Columns    []string          `json:"columns"`
+		Downsample DownsampleOptions `json:"downsample"`
+	}
+
+	// The values of a column in the same order as the cells returned
+	// by Metadata. Categorical columns have the category code of each
+	// cell, -1 if missing, and numeric columns the value of each cell,
+	// null if missing.
+	CellMetadataValues struct {
+		Column *CellMetadataColumn `json:"column"`
+		Codes  []int32             `json:"codes,omitempty"`
+		Values []*float32          `json:"values,omitempty"`
+	}
+
+	CellMetadata struct {
+		Dataset string                `json:"dataset"`
+		Columns []*CellMetadataValues `json:"columns"`
+		// if the cells were downsampled, the index of each cell
+		// returned as used by Gex and the other cell queries
+		Indexes []uint32 `json:"indexes,omitempty"`
+	}
+
+	// a column with its values decoded
+	cellMetadataColumn struct {
+		CellMetadataColumn
+		// codes of categorical columns
+		codes []int32
+		// values of numeric columns, NaN if missing
+		values []float32
+	}
+)
+
+const (
+	CellMetadataCategorical CellMetadataType = "categorical"
+	CellMetadataNumeric     CellMetadataType = "numeric"
+
+	// prefix of clusterings that are categorical cell metadata
+	CellMetadataGroupPrefix = "metadata:"
+
+	MaxCellMetadataColumns = 20
+
+	CellMetadataColumnsSql = `SELECT
+		cm.id,
+		cm.public_id,
+		cm.name,
+		cm.type
+		FROM cell_metadata cm
+		JOIN datasets d ON cm.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY cm.name`
+
+	CellMetadataCategoriesSql = `SELECT
+		cmc.metadata_id,
+		cmc.name,
+		cmc.color
+		FROM cell_metadata_categories cmc
+		JOIN cell_metadata cm ON cmc.metadata_id = cm.id
+		JOIN datasets d ON cm.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY cmc.metadata_id, cmc.code`
+
+	// values are stored as little endian float32 or int32 with the
+	// cells in id order
+	CellMetadataDataSql = `SELECT
+		cm.id,
+		cm.public_id,
+		cm.name,
+		cm.type,
+		cm.data
+		FROM cell_metadata cm
+		JOIN datasets d ON cm.dataset_id = d.id
+		WHERE d.public_id = :id
+		AND (cm.public_id = :column OR LOWER(cm.name) = LOWER(:column))`
+)
+
+// Lists the metadata columns of the cells of a dataset
+func (sdb *ScrnaDB) CellMetadataColumns(datasetId string, isAdmin bool, permissions []string) ([]*CellMetadataColumn, error) {
+	// check the user can view the dataset
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sdb.db.Query(CellMetadataColumnsSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*CellMetadataColumn, 0, 10)
+	columns := make(map[int]*CellMetadataColumn)
+
+	for rows.Next() {
+		var id int
+		var column CellMetadataColumn
+
+		err := rows.Scan(&id, &column.Id, &column.Name, &column.Type)
+
+		if err != nil {
+			return nil, err
+		}
+
+		columns[id] = &column
+		ret = append(ret, &column)
+	}
+
+	categories, err := sdb.cellMetadataCategories(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for id, column := range columns {
+		column.Categories = categories[id]
+	}
+
+	return ret, nil
+}
+
+// Returns the values of metadata columns for each cell, optionally
+// only for a downsampled subset of the cells
+func (sdb *ScrnaDB) CellMetadata(datasetId string, options *CellMetadataOptions, isAdmin bool, permissions []string) (*CellMetadata, error) {
+	if len(options.Columns) == 0 {
+		return nil, errors.New("no columns")
+	}
+
+	if len(options.Columns) > MaxCellMetadataColumns {
+		return nil, fmt.Errorf("at most %d columns can be returned", MaxCellMetadataColumns)
+	}
+
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	subset, err := sdb.downsample(datasetId, &options.Downsample)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := CellMetadata{Dataset: datasetId, Columns: make([]*CellMetadataValues, 0, len(options.Columns))}
+
+	var indexes []uint32
+
+	if subset != nil {
+		indexes = subset.Indexes()
+		ret.Indexes = indexes
+	}
+
+	for _, name := range options.Columns {
+		column, err := sdb.cellMetadataColumn(datasetId, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		values := CellMetadataValues{Column: &column.CellMetadataColumn}
+
+		n := column.size()
+
+		if indexes != nil {
+			n = len(indexes)
+		}
+
+		// the index of the i-th cell returned
+		cell := func(i int) int {
+			if indexes != nil {
+				return int(indexes[i])
+			}
+
+			return i
+		}
+
+		if column.Type == CellMetadataCategorical {
+			values.Codes = make([]int32, n)
+
+			for i := range n {
+				values.Codes[i] = column.codes[cell(i)]
+			}
+		} else {
+			values.Values = make([]*float32, n)
+
+			for i := range n {
+				v := column.values[cell(i)]
+
+				if !math.IsNaN(float64(v)) {
+					values.Values[i] = &v
+				}
+			}
+		}
+
+		ret.Columns = append(ret.Columns, &values)
+	}
+
+	return &ret, nil
+}
+
+// cellMetadataColumn reads and decodes a metadata column of a dataset
+// by id or name without checking permissions
+func (sdb *ScrnaDB) cellMetadataColumn(datasetId string, name string) (*cellMetadataColumn, error) {
+	var ret cellMetadataColumn
+	var id int
+	var data []byte
+
+	err := sdb.db.QueryRow(CellMetadataDataSql,
+		sql.Named("id", datasetId),
+		sql.Named("column", strings.TrimSpace(name))).
+		Scan(&id, &ret.Id, &ret.Name, &ret.Type, &data)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("cell metadata %s not found", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != cellCount*4 {
+		return nil, fmt.Errorf("cell metadata %s does not match the cells", ret.Name)
+	}
+
+	switch ret.Type {
+	case CellMetadataCategorical:
+		ret.codes = make([]int32, cellCount)
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, ret.codes)
+	case CellMetadataNumeric:
+		ret.values = make([]float32, cellCount)
+		err = binary.Read(bytes.NewReader(data), binary.LittleEndian, ret.values)
+	default:
+		err = fmt.Errorf("unknown cell metadata type %s", ret.Type)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.Type == CellMetadataCategorical {
+		categories, err := sdb.cellMetadataCategories(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Categories = categories[id]
+	}
+
+	return &ret, nil
+}
+
+// cellMetadataCategories returns the categories of each categorical
+// column of a dataset keyed by column
+func (sdb *ScrnaDB) cellMetadataCategories(datasetId string) (map[int][]*CellMetadataCategory, error) {
+	rows, err := sdb.db.Query(CellMetadataCategoriesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make(map[int][]*CellMetadataCategory)
+
+	for rows.Next() {
+		var id int
+		var category CellMetadataCategory
+
+		err := rows.Scan(&id, &category.Name, &category.Color)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret[id] = append(ret[id], &category)
+	}
+
+	return ret, nil
+}
+
+func (column *cellMetadataColumn) size() int {
+	if column.Type == CellMetadataCategorical {
+		return len(column.codes)
+	}
+
+	return len(column.values)
+}
+
+// addCellMetadata adds the values of metadata columns to each cell,
+// missing values being left out
+func (sdb *ScrnaDB) addCellMetadata(datasetId string, names []string, cells []*SingleCell) error {
+	if len(names) > MaxCellMetadataColumns {
+		return fmt.Errorf("at most %d columns can be returned", MaxCellMetadataColumns)
+	}
+
+	for _, name := range names {
+		column, err := sdb.cellMetadataColumn(datasetId, name)
+
+		if err != nil {
+			return err
+		}
+
+		if column.size() != len(cells) {
+			return fmt.Errorf("cell metadata %s does not match the cells", column.Name)
+		}
+
+		for i, cell := range cells {
+			value, ok := column.value(i)
+
+			if ok {
+				cell.Metadata = append(cell.Metadata, NameValueType{Name: column.Name, Value: value})
+			}
+		}
+	}
+
+	return nil
+}
+
+// value returns the value of a cell as text and false if missing
+func (column *cellMetadataColumn) value(cell int) (string, bool) {
+	if column.Type == CellMetadataCategorical {
+		code := column.codes[cell]
+
+		if code < 0 || int(code) >= len(column.Categories) {
+			return "", false
+		}
+
+		return column.Categories[code].Name, true
+	}
+
+	v := column.values[cell]
+
+	if math.IsNaN(float64(v)) {
+		return "", false
+	}
+
+	return strconv.FormatFloat(float64(v), 'g', -1, 32), true
+}
+
+// cellMetadataNumbers returns the name of a numeric column and its
+// value for each cell, NaN if missing, for coloring cells
+func (sdb *ScrnaDB) cellMetadataNumbers(datasetId string, name string) (string, []float64, error) {
+	column, err := sdb.cellMetadataColumn(datasetId, name)
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	if column.Type != CellMetadataNumeric {
+		return "", nil, fmt.Errorf("cell metadata %s is not numeric", column.Name)
+	}
+
+	ret := make([]float64, len(column.values))
+
+	for i, v := range column.values {
+		ret[i] = float64(v)
+	}
+
+	return column.Name, ret, nil
+}
+
+// numberRange returns the smallest and largest of values ignoring NaNs
+func numberRange(values []float64) (float64, float64) {
+	lo := math.Inf(1)
+	hi := math.Inf(-1)
+
+	for _, v := range values {
+		if !math.IsNaN(v) {
+			lo = min(lo, v)
+			hi = max(hi, v)
+		}
+	}
+
+	if math.IsInf(lo, 0) {
+		return 0, 0
+	}
+
+	return lo, hi
+}
+
+// cellMetadataGroup returns the column a clustering refers to if it is
+// categorical cell metadata, e.g. metadata:donor
+func cellMetadataGroup(clustering string) (string, bool) {
+	clustering = strings.TrimSpace(clustering)
+
+	if len(clustering) < len(CellMetadataGroupPrefix) ||
+		!strings.EqualFold(clustering[:len(CellMetadataGroupPrefix)], CellMetadataGroupPrefix) {
+		return "", false
+	}
+
+	return clustering[len(CellMetadataGroupPrefix):], true
+}
+
+// groupColumn reads a categorical column to group cells by
+func (sdb *ScrnaDB) groupColumn(datasetId string, name string) (*cellMetadataColumn, error) {
+	column, err := sdb.cellMetadataColumn(datasetId, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if column.Type != CellMetadataCategorical {
+		return nil, fmt.Errorf("cell metadata %s is not categorical", column.Name)
+	}
+
+	return column, nil
+}
+
+// metadataClusters returns the categories of a categorical column as
+// clusters labelled by category code
+func (sdb *ScrnaDB) metadataClusters(datasetId string, name string) ([]*Cluster, error) {
+	column, err := sdb.groupColumn(datasetId, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Cluster, len(column.Categories))
+
+	for code, category := range column.Categories {
+		ret[code] = &Cluster{
+			Id:    fmt.Sprintf("%s:%d", column.Id, code),
+			Label: code,
+			Name:  category.Name,
+			Color: category.Color,
+		}
+	}
+
+	for _, code := range column.codes {
+		if code >= 0 && int(code) < len(ret) {
+			ret[code].CellCount++
+		}
+	}
+
+	return ret, nil
+}
+
+// metadataCellClusters returns the category code of each cell in a
+// categorical column, -1 if missing, as the cell's cluster
+func (sdb *ScrnaDB) metadataCellClusters(datasetId string, name string) ([]int, error) {
+	column, err := sdb.groupColumn(datasetId, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]int, len(column.codes))
+
+	for i, code := range column.codes {
+		ret[i] = int(code)
+	}
+
+	return ret, nil
+}
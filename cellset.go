@@ -0,0 +1,140 @@
+package scrna
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+)
+
+// A set of cells stored as a bitmap where bit i is set if the
+// cell with index i, as used by the gex files, is in the set
+type CellSet struct {
+	words []uint64
+	size  int
+}
+
+func NewCellSet(size int) *CellSet {
+	return &CellSet{words: make([]uint64, (size+63)/64), size: size}
+}
+
+// A set containing every cell
+func NewFullCellSet(size int) *CellSet {
+	return NewCellSet(size).Not()
+}
+
+func NewCellSetFromIndexes(size int, indexes []uint32) *CellSet {
+	set := NewCellSet(size)
+
+	for _, index := range indexes {
+		set.Add(int(index))
+	}
+
+	return set
+}
+
+// Size is the number of cells the set can hold, not the
+// number in the set
+func (set *CellSet) Size() int {
+	return set.size
+}
+
+func (set *CellSet) Add(i int) {
+	if i >= 0 && i < set.size {
+		set.words[i>>6] |= 1 << (i & 63)
+	}
+}
+
+func (set *CellSet) Remove(i int) {
+	if i >= 0 && i < set.size {
+		set.words[i>>6] &^= 1 << (i & 63)
+	}
+}
+
+func (set *CellSet) Has(i int) bool {
+	return i >= 0 && i < set.size && set.words[i>>6]&(1<<(i&63)) != 0
+}
+
+// Returns the number of cells in the set
+func (set *CellSet) Count() int {
+	n := 0
+
+	for _, w := range set.words {
+		n += bits.OnesCount64(w)
+	}
+
+	return n
+}
+
+func (set *CellSet) And(other *CellSet) *CellSet {
+	ret := NewCellSet(set.size)
+
+	for i := range ret.words {
+		if i < len(other.words) {
+			ret.words[i] = set.words[i] & other.words[i]
+		}
+	}
+
+	return ret
+}
+
+func (set *CellSet) Or(other *CellSet) *CellSet {
+	ret := NewCellSet(set.size)
+
+	for i := range ret.words {
+		ret.words[i] = set.words[i]
+
+		if i < len(other.words) {
+			ret.words[i] |= other.words[i]
+		}
+	}
+
+	ret.trim()
+
+	return ret
+}
+
+func (set *CellSet) Not() *CellSet {
+	ret := NewCellSet(set.size)
+
+	for i := range ret.words {
+		ret.words[i] = ^set.words[i]
+	}
+
+	ret.trim()
+
+	return ret
+}
+
+// Returns the indexes of the cells in the set in ascending order
+func (set *CellSet) Indexes() []uint32 {
+	ret := make([]uint32, 0, set.Count())
+
+	for i, w := range set.words {
+		for w != 0 {
+			b := bits.TrailingZeros64(w)
+			ret = append(ret, uint32(i*64+b))
+			w &= w - 1
+		}
+	}
+
+	return ret
+}
+
+// Encodes the set as base64 of the little endian bytes of the
+// bitmap so bit i of byte j is set if cell 8j+i is in the set
+func (set *CellSet) Bitmap() string {
+	buf := make([]byte, len(set.words)*8)
+
+	for i, w := range set.words {
+		binary.LittleEndian.PutUint64(buf[i*8:], w)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf[:(set.size+7)/8])
+}
+
+// clear any bits beyond the size of the set
+func (set *CellSet) trim() {
+	if r := set.size & 63; r != 0 {
+		set.words[len(set.words)-1] &= (1 << r) - 1
+	}
+}
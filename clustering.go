@@ -0,0 +1,129 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antonybholmes/go-web/auth/sqlite"
+)
+
+// A dataset can be clustered several times, e.g. at different
+// resolutions, each clustering having its own clusters. Every API that
+// groups cells by cluster takes the id or name of the clustering to
+// use, an empty string meaning the dataset's default clustering, which
+// is that of the cells table, or a categorical cell metadata column
+// such as metadata:donor.
+
+type (
+	Clustering struct {
+		Id      string `json:"id"`
+		Name    string `json:"name"`
+		Default bool   `json:"default"`
+		// number of clusters
+		Clusters int `json:"clusters"`
+	}
+)
+
+const (
+	ClusteringsSql = `SELECT
+		cg.public_id,
+		cg.name,
+		cg.is_default,
+		COUNT(cl.id)
+		FROM clusterings cg
+		JOIN datasets d ON cg.dataset_id = d.id
+		JOIN dataset_permissions dp ON d.id = dp.dataset_id
+		JOIN permissions p ON dp.permission_id = p.id
+		LEFT JOIN clusters cl ON cg.id = cl.clustering_id
+		WHERE
+			<<PERMISSIONS>>
+			AND d.public_id = :id
+		GROUP BY cg.id
+		ORDER BY cg.is_default DESC, cg.name`
+
+	// match the default clustering if no clustering is given,
+	// otherwise by id or name
+	ClusteringIdSql = `SELECT
+		cg.id
+		FROM clusterings cg
+		JOIN datasets d ON cg.dataset_id = d.id
+		WHERE d.public_id = :id
+		AND ((:clustering = '' AND cg.is_default = 1)
+			OR cg.public_id = :clustering
+			OR LOWER(cg.name) = LOWER(:clustering))
+		LIMIT 1`
+)
+
+// Returns the clusterings of a dataset, the default first
+func (sdb *ScrnaDB) Clusterings(datasetId string, isAdmin bool, permissions []string) ([]*Clustering, error) {
+	namedArgs := []any{sql.Named("id", datasetId)}
+
+	query := sqlite.MakePermissionsSql(ClusteringsSql, isAdmin, permissions, &namedArgs)
+
+	rows, err := sdb.db.Query(query, namedArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Clustering, 0, 5)
+
+	for rows.Next() {
+		var clustering Clustering
+
+		err := rows.Scan(&clustering.Id, &clustering.Name, &clustering.Default, &clustering.Clusters)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &clustering)
+	}
+
+	return ret, nil
+}
+
+// clusteringId returns the database id of a dataset's clustering
+func (sdb *ScrnaDB) clusteringId(datasetId string, clustering string) (int, error) {
+	clustering = strings.TrimSpace(clustering)
+
+	if _, ok := cellMetadataGroup(clustering); ok {
+		return -1, fmt.Errorf("%s is cell metadata rather than a clustering", clustering)
+	}
+
+	var id int
+
+	err := sdb.db.QueryRow(ClusteringIdSql,
+		sql.Named("id", datasetId),
+		sql.Named("clustering", clustering)).Scan(&id)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		if clustering == "" {
+			return -1, errors.New("dataset has no default clustering")
+		}
+
+		return -1, fmt.Errorf("clustering %s not found", clustering)
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return id, nil
+}
+
+// matchesClustering returns true if clustering is the one named, the
+// default one being used if name is empty
+func matchesClustering(clustering *Clustering, name string) bool {
+	name = strings.TrimSpace(name)
+
+	if name == "" {
+		return clustering.Default
+	}
+
+	return clustering.Id == name || strings.EqualFold(clustering.Name, name)
+}
@@ -0,0 +1,272 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+)
+
+type (
+	CoexpressionGene struct {
+		GeneId     string  `json:"geneId"`
+		GeneSymbol string  `json:"geneSymbol"`
+		Threshold  float32 `json:"threshold"`
+	}
+
+	// Counts of cells in each co-expression category for
+	// one cluster
+	CoexpressionCluster struct {
+		Counts []int `json:"counts"`
+		Label  int   `json:"label"`
+		Cells  int   `json:"cells"`
+	}
+
+	// A cell's category is a bit mask where bit i is set if
+	// gene i is expressed above its threshold, so for two genes
+	// A and B the categories are 0 = neither, 1 = A only,
+	// 2 = B only and 3 = both.
+	CoexpressionResults struct {
+		Dataset    string                 `json:"dataset"`
+		Genes      []*CoexpressionGene    `json:"genes"`
+		Categories []string               `json:"categories"`
+		Counts     []int                  `json:"counts"`
+		Clusters   []*CoexpressionCluster `json:"clusters"`
+		// category of each cell in the same order as the
+		// cells returned by Metadata or -1 if the cell was
+		// excluded by the filter or QC thresholds
+		Cells []int `json:"cells"`
+	}
+)
+
+const (
+	// keep the number of categories (2^n) manageable
+	MaxCoexpressionGenes = 4
+
+	// cells not in the clustering have a label of -1
+	CellClustersSql = `SELECT
+		COALESCE(cl.label, -1)
+		FROM cells c
+		JOIN datasets d ON c.dataset_id = d.id
+		LEFT JOIN cell_clusters cc ON c.id = cc.cell_id AND cc.clustering_id = :clustering
+		LEFT JOIN clusters cl ON cc.cluster_id = cl.id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+)
+
+// Classify each cell of a dataset by which of the genes it expresses above
+// the matching threshold and count the categories in each cluster of a
+// clustering. Thresholds are matched to genes by position and default to 0
+// if not supplied. If filter is not empty only the cells it selects are
+// counted and cells failing the QC thresholds are always excluded.
+func (sdb *ScrnaDB) Coexpression(datasetId string,
+	geneIds []string,
+	thresholds []float32,
+	clustering string,
+	filter string,
+	qc *QcThresholds,
+	isAdmin bool,
+	permissions []string) (*CoexpressionResults, error) {
+
+	if len(geneIds) < 2 {
+		return nil, errors.New("at least two genes are required")
+	}
+
+	if len(geneIds) > MaxCoexpressionGenes {
+		return nil, fmt.Errorf("at most %d genes can be compared", MaxCoexpressionGenes)
+	}
+
+	if len(thresholds) > len(geneIds) {
+		return nil, errors.New("more thresholds than genes")
+	}
+
+	genes, err := sdb.GetGenes(datasetId, geneIds, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gex, err := sdb.orderedGex(genes, geneIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells, err := sdb.cellFilter(datasetId, clustering, filter, qc, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := CoexpressionResults{
+		Dataset:    datasetId,
+		Genes:      make([]*CoexpressionGene, 0, len(gex)),
+		Categories: coexpressionCategories(gex),
+		Clusters:   make([]*CoexpressionCluster, 0, 20),
+		Cells:      make([]int, len(clusters)),
+	}
+
+	for i, g := range gex {
+		var threshold float32
+
+		if i < len(thresholds) {
+			threshold = thresholds[i]
+		}
+
+		ret.Genes = append(ret.Genes, &CoexpressionGene{
+			GeneId:     g.GeneId,
+			GeneSymbol: g.GeneSymbol,
+			Threshold:  threshold,
+		})
+
+		bit := 1 << i
+
+		for j, index := range g.Indexes {
+			if g.Gex[j] > threshold && int(index) < len(ret.Cells) {
+				ret.Cells[index] |= bit
+			}
+		}
+	}
+
+	ret.Counts = make([]int, len(ret.Categories))
+
+	clusterMap := make(map[int]*CoexpressionCluster)
+
+	for i, category := range ret.Cells {
+		if cells != nil && !cells.Has(i) {
+			ret.Cells[i] = -1
+			continue
+		}
+
+		ret.Counts[category]++
+
+		label := clusters[i]
+
+		// cells the clustering does not assign only count in the totals
+		if label == -1 {
+			continue
+		}
+
+		cluster, ok := clusterMap[label]
+
+		if !ok {
+			cluster = &CoexpressionCluster{Label: label, Counts: make([]int, len(ret.Categories))}
+			clusterMap[label] = cluster
+			ret.Clusters = append(ret.Clusters, cluster)
+		}
+
+		cluster.Cells++
+		cluster.Counts[category]++
+	}
+
+	slices.SortFunc(ret.Clusters, func(a, b *CoexpressionCluster) int {
+		return a.Label - b.Label
+	})
+
+	return &ret, nil
+}
+
+// orderedGex reads the expression of each requested gene and returns
+// them in the order they were requested so that callers can match
+// them to per gene parameters. Requested ids can be gene symbols,
+// Ensembl ids or the public ids of genes.
+func (sdb *ScrnaDB) orderedGex(genes []*Gene, geneIds []string) ([]*dat.GexGene, error) {
+	ret := make([]*dat.GexGene, len(geneIds))
+
+	for _, gene := range genes {
+		data, err := sdb.readGex(gene)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, id := range geneIds {
+			if ret[i] == nil && (id == gene.Ensembl ||
+				strings.EqualFold(id, data.GeneId) ||
+				strings.EqualFold(id, data.GeneSymbol)) {
+				ret[i] = data
+			}
+		}
+	}
+
+	for i, g := range ret {
+		if g == nil {
+			return nil, fmt.Errorf("gene %s not found", geneIds[i])
+		}
+	}
+
+	return ret, nil
+}
+
+// cellClusters returns the cluster label of each cell in a clustering
+// in the same order as the cell indexes used by the gex files
+func (sdb *ScrnaDB) cellClusters(datasetId string, clustering string) ([]int, error) {
+	if column, ok := cellMetadataGroup(clustering); ok {
+		return sdb.metadataCellClusters(datasetId, column)
+	}
+
+	clusteringId, err := sdb.clusteringId(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sdb.db.Query(CellClustersSql,
+		sql.Named("id", datasetId),
+		sql.Named("clustering", clusteringId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]int, 0, 10000)
+
+	for rows.Next() {
+		var label int
+
+		err := rows.Scan(&label)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, label)
+	}
+
+	return ret, nil
+}
+
+// Name each category by the genes expressed in it, e.g.
+// none, BCL6, IRF4, BCL6+IRF4
+func coexpressionCategories(genes []*dat.GexGene) []string {
+	n := 1 << len(genes)
+
+	ret := make([]string, n)
+
+	ret[0] = "none"
+
+	for category := 1; category < n; category++ {
+		names := make([]string, 0, len(genes))
+
+		for i, g := range genes {
+			if category&(1<<i) != 0 {
+				names = append(names, g.GeneSymbol)
+			}
+		}
+
+		ret[category] = strings.Join(names, "+")
+	}
+
+	return ret
+}
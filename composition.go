@@ -0,0 +1,606 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/stats"
+)
+
+type (
+	CompositionTestMethod string
+
+	CompositionOptions struct {
+		Test CompositionTestMethod `json:"test"`
+		// clustering whose clusters are counted, the default if empty
+		Clustering string `json:"clustering"`
+		// name of the sample metadata used to group samples,
+		// e.g. condition
+		GroupBy string `json:"groupBy"`
+		// the two values of GroupBy to compare for the per cluster
+		// tests. If empty and GroupBy has exactly two values they
+		// are used.
+		Groups []string `json:"groups"`
+		// cells failing these are not counted
+		Qc *QcThresholds `json:"qc"`
+	}
+
+	CompositionSample struct {
+		Metadata map[string]string `json:"metadata,omitempty"`
+		Name     string            `json:"name"`
+		Cells    int               `json:"cells"`
+	}
+
+	CompositionCluster struct {
+		Name  string `json:"name"`
+		Color string `json:"color"`
+		Label int    `json:"label"`
+		Cells int    `json:"cells"`
+	}
+
+	// Per cluster result of comparing two groups of samples
+	ClusterAbundance struct {
+		// mean proportion of cells in the cluster for each group
+		Proportions []float64 `json:"proportions"`
+		Label       int       `json:"label"`
+		// odds ratio for fisher or t for propeller
+		Statistic float64 `json:"statistic"`
+		P         float64 `json:"p"`
+		// Benjamini-Hochberg adjusted p-value
+		Q float64 `json:"q"`
+	}
+
+	CompositionTest struct {
+		Method  CompositionTestMethod `json:"method"`
+		GroupBy string                `json:"groupBy,omitempty"`
+		Groups  []string              `json:"groups,omitempty"`
+		// chi-square test of independence over the whole table
+		Statistic float64 `json:"statistic,omitempty"`
+		Df        int     `json:"df,omitempty"`
+		// for group comparisons, the smallest per cluster p-value
+		// Bonferroni corrected for the number of clusters
+		P        float64             `json:"p"`
+		Clusters []*ClusterAbundance `json:"clusters,omitempty"`
+	}
+
+	// cells of a sample in a cluster
+	compositionCount struct {
+		sample string
+		label  int
+		cells  int
+	}
+
+	// Cell counts for each sample (rows) and cluster (columns).
+	// Proportions are the fraction of each sample's cells in
+	// each cluster.
+	Composition struct {
+		Dataset     string                `json:"dataset"`
+		Samples     []*CompositionSample  `json:"samples"`
+		Clusters    []*CompositionCluster `json:"clusters"`
+		Counts      [][]int               `json:"counts"`
+		Proportions [][]float64           `json:"proportions"`
+		Test        *CompositionTest      `json:"test,omitempty"`
+	}
+)
+
+const (
+	CompositionNoTest CompositionTestMethod = ""
+	// chi-square test that cluster membership is independent of
+	// sample or sample group
+	CompositionChiSquare CompositionTestMethod = "chisq"
+	// per cluster Fisher's exact test on the pooled cells of two
+	// sample groups
+	CompositionFisher CompositionTestMethod = "fisher"
+	// per cluster t-test between two sample groups of arcsine square
+	// root transformed sample proportions, in the style of propeller,
+	// which treats samples rather than cells as replicates
+	CompositionPropeller CompositionTestMethod = "propeller"
+
+	CompositionCountsSql = `SELECT
+		s.name,
+		cl.label,
+		COUNT(c.id)
+		FROM cells c
+		JOIN samples s ON c.sample_id = s.id
+		JOIN cell_clusters cc ON c.id = cc.cell_id AND cc.clustering_id = :clustering
+		JOIN clusters cl ON cc.cluster_id = cl.id
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id
+		GROUP BY s.id, cl.id
+		ORDER BY s.name, cl.label`
+
+	SampleMetadataSql = `SELECT
+		s.name,
+		m.name,
+		sm.value
+		FROM sample_metadata sm
+		JOIN samples s ON sm.sample_id = s.id
+		JOIN metadata m ON sm.metadata_id = m.id
+		JOIN datasets d ON s.dataset_id = d.id
+		WHERE d.public_id = :id`
+)
+
+func ParseCompositionTestMethod(method string) (CompositionTestMethod, error) {
+	switch strings.ToLower(method) {
+	case "", "none":
+		return CompositionNoTest, nil
+	case "chisq", "chi-square":
+		return CompositionChiSquare, nil
+	case "fisher":
+		return CompositionFisher, nil
+	case "propeller":
+		return CompositionPropeller, nil
+	default:
+		return "", fmt.Errorf("unknown composition test %s", method)
+	}
+}
+
+// Count the cells of each sample in each cluster and optionally test
+// whether cluster proportions differ between samples or sample groups
+func (sdb *ScrnaDB) Composition(datasetId string,
+	options *CompositionOptions,
+	isAdmin bool,
+	permissions []string) (*Composition, error) {
+
+	method, err := ParseCompositionTestMethod(string(options.Test))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// also checks the user can view the dataset
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := sdb.compositionCounts(datasetId, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := Composition{
+		Dataset:  datasetId,
+		Samples:  make([]*CompositionSample, 0, 20),
+		Clusters: make([]*CompositionCluster, 0, len(clusters)),
+	}
+
+	clusterColumns := make(map[int]int)
+
+	for _, cluster := range clusters {
+		clusterColumns[cluster.Label] = len(ret.Clusters)
+
+		ret.Clusters = append(ret.Clusters, &CompositionCluster{
+			Name:  cluster.Name,
+			Color: cluster.Color,
+			Label: cluster.Label,
+		})
+	}
+
+	sampleRows := make(map[string]int)
+
+	for _, count := range counts {
+		col, ok := clusterColumns[count.label]
+
+		if !ok {
+			continue
+		}
+
+		row, ok := sampleRows[count.sample]
+
+		if !ok {
+			row = len(ret.Samples)
+			sampleRows[count.sample] = row
+			ret.Samples = append(ret.Samples, &CompositionSample{Name: count.sample})
+			ret.Counts = append(ret.Counts, make([]int, len(ret.Clusters)))
+		}
+
+		ret.Counts[row][col] += count.cells
+		ret.Samples[row].Cells += count.cells
+		ret.Clusters[col].Cells += count.cells
+	}
+
+	if len(ret.Samples) == 0 {
+		return nil, errors.New("no cells found")
+	}
+
+	ret.Proportions = make([][]float64, len(ret.Samples))
+
+	for i, counts := range ret.Counts {
+		ret.Proportions[i] = make([]float64, len(counts))
+
+		for j, count := range counts {
+			ret.Proportions[i][j] = float64(count) / float64(ret.Samples[i].Cells)
+		}
+	}
+
+	err = sdb.sampleMetadata(datasetId, sampleRows, ret.Samples)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case CompositionChiSquare:
+		ret.Test, err = compositionChiSquare(&ret, options.GroupBy)
+	case CompositionFisher, CompositionPropeller:
+		ret.Test, err = compositionGroupTest(&ret, method, options)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// compositionCounts returns the number of cells of each sample in each
+// cluster ordered by sample and cluster. Clusters of a clustering are
+// counted by the database but cells must be counted one by one for
+// groups of cell metadata or to apply QC thresholds.
+func (sdb *ScrnaDB) compositionCounts(datasetId string, options *CompositionOptions) ([]*compositionCount, error) {
+	if _, ok := cellMetadataGroup(options.Clustering); ok || !options.Qc.IsEmpty() {
+		return sdb.cellCompositionCounts(datasetId, options)
+	}
+
+	clusteringId, err := sdb.clusteringId(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := sdb.db.Query(CompositionCountsSql,
+		sql.Named("id", datasetId),
+		sql.Named("clustering", clusteringId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*compositionCount, 0, 200)
+
+	for rows.Next() {
+		var count compositionCount
+
+		err := rows.Scan(&count.sample, &count.label, &count.cells)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &count)
+	}
+
+	return ret, nil
+}
+
+func (sdb *ScrnaDB) cellCompositionCounts(datasetId string, options *CompositionOptions) ([]*compositionCount, error) {
+	clusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	samples, err := sdb.cellSamples(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(samples) != len(clusters) {
+		return nil, errors.New("cell samples and clusters do not match")
+	}
+
+	passed, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[compositionCount]int)
+
+	for i, label := range clusters {
+		if label == -1 || (passed != nil && !passed.Has(i)) {
+			continue
+		}
+
+		counts[compositionCount{sample: samples[i], label: label}]++
+	}
+
+	ret := make([]*compositionCount, 0, len(counts))
+
+	for key, cells := range counts {
+		ret = append(ret, &compositionCount{sample: key.sample, label: key.label, cells: cells})
+	}
+
+	slices.SortFunc(ret, func(a, b *compositionCount) int {
+		if a.sample != b.sample {
+			return strings.Compare(a.sample, b.sample)
+		}
+
+		return a.label - b.label
+	})
+
+	return ret, nil
+}
+
+// sampleMetadata adds the metadata of each sample, e.g. condition, to
+// the samples of a composition
+func (sdb *ScrnaDB) sampleMetadata(datasetId string, sampleRows map[string]int, samples []*CompositionSample) error {
+	rows, err := sdb.db.Query(SampleMetadataSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var sample string
+		var name string
+		var value string
+
+		err := rows.Scan(&sample, &name, &value)
+
+		if err != nil {
+			return err
+		}
+
+		row, ok := sampleRows[sample]
+
+		if !ok {
+			continue
+		}
+
+		if samples[row].Metadata == nil {
+			samples[row].Metadata = make(map[string]string)
+		}
+
+		samples[row].Metadata[name] = value
+	}
+
+	return nil
+}
+
+// compositionChiSquare tests the independence of clusters and samples
+// or, if groupBy is set, of clusters and sample groups
+func compositionChiSquare(composition *Composition, groupBy string) (*CompositionTest, error) {
+	table := composition.Counts
+
+	ret := CompositionTest{Method: CompositionChiSquare, GroupBy: groupBy}
+
+	if groupBy != "" {
+		groups := make(map[string]int)
+		table = make([][]int, 0, 10)
+
+		for i, sample := range composition.Samples {
+			value, ok := sample.Metadata[groupBy]
+
+			if !ok {
+				continue
+			}
+
+			row, ok := groups[value]
+
+			if !ok {
+				row = len(table)
+				groups[value] = row
+				ret.Groups = append(ret.Groups, value)
+				table = append(table, make([]int, len(composition.Clusters)))
+			}
+
+			for j, count := range composition.Counts[i] {
+				table[row][j] += count
+			}
+		}
+	}
+
+	rowTotals := make([]float64, len(table))
+	colTotals := make([]float64, len(composition.Clusters))
+
+	var total float64
+
+	for i, counts := range table {
+		for j, count := range counts {
+			rowTotals[i] += float64(count)
+			colTotals[j] += float64(count)
+			total += float64(count)
+		}
+	}
+
+	// empty clusters contribute nothing and no degrees of freedom
+	cols := 0
+
+	for _, t := range colTotals {
+		if t > 0 {
+			cols++
+		}
+	}
+
+	if len(table) < 2 || cols < 2 {
+		return nil, errors.New("at least two rows and two clusters are needed for a chi-square test")
+	}
+
+	for i, counts := range table {
+		for j, count := range counts {
+			expected := rowTotals[i] * colTotals[j] / total
+
+			if expected > 0 {
+				ret.Statistic += (float64(count) - expected) * (float64(count) - expected) / expected
+			}
+		}
+	}
+
+	ret.Df = (len(table) - 1) * (cols - 1)
+	ret.P = stats.ChiSquareSf(ret.Statistic, float64(ret.Df))
+
+	return &ret, nil
+}
+
+// compositionGroupTest compares each cluster between two groups of
+// samples using either Fisher's exact test on pooled cells or a
+// propeller style t-test on per sample proportions
+func compositionGroupTest(composition *Composition,
+	method CompositionTestMethod,
+	options *CompositionOptions) (*CompositionTest, error) {
+
+	if options.GroupBy == "" {
+		return nil, errors.New("groupBy is required to compare sample groups")
+	}
+
+	groups := options.Groups
+
+	if len(groups) == 0 {
+		for _, sample := range composition.Samples {
+			value, ok := sample.Metadata[options.GroupBy]
+
+			if ok && !slices.Contains(groups, value) {
+				groups = append(groups, value)
+			}
+		}
+
+		slices.Sort(groups)
+	}
+
+	if len(groups) != 2 {
+		return nil, fmt.Errorf("exactly two groups of %s must be compared", options.GroupBy)
+	}
+
+	// samples in each group
+	members := [2][]int{}
+
+	for i, sample := range composition.Samples {
+		g := slices.Index(groups, sample.Metadata[options.GroupBy])
+
+		if g != -1 {
+			members[g] = append(members[g], i)
+		}
+	}
+
+	for g, m := range members {
+		if len(m) == 0 {
+			return nil, fmt.Errorf("no samples have %s = %s", options.GroupBy, groups[g])
+		}
+
+		if method == CompositionPropeller && len(m) < 2 {
+			return nil, fmt.Errorf("propeller needs at least two samples with %s = %s", options.GroupBy, groups[g])
+		}
+	}
+
+	ret := CompositionTest{
+		Method:   method,
+		GroupBy:  options.GroupBy,
+		Groups:   groups,
+		Clusters: make([]*ClusterAbundance, len(composition.Clusters)),
+	}
+
+	p := make([]float64, len(composition.Clusters))
+
+	for j, cluster := range composition.Clusters {
+		var abundance *ClusterAbundance
+
+		if method == CompositionFisher {
+			abundance = fisherAbundance(composition, members, j)
+		} else {
+			abundance = propellerAbundance(composition, members, j)
+		}
+
+		abundance.Label = cluster.Label
+		ret.Clusters[j] = abundance
+		p[j] = abundance.P
+	}
+
+	for j, q := range stats.BenjaminiHochberg(p) {
+		ret.Clusters[j].Q = q
+	}
+
+	ret.P = 1
+
+	if len(p) > 0 {
+		ret.P = min(1, float64(len(p))*slices.Min(p))
+	}
+
+	return &ret, nil
+}
+
+func fisherAbundance(composition *Composition, members [2][]int, cluster int) *ClusterAbundance {
+	var in [2]int
+	var out [2]int
+
+	for g, m := range members {
+		for _, i := range m {
+			in[g] += composition.Counts[i][cluster]
+			out[g] += composition.Samples[i].Cells - composition.Counts[i][cluster]
+		}
+	}
+
+	a := float64(in[0])
+	b := float64(out[0])
+	c := float64(in[1])
+	d := float64(out[1])
+
+	// Haldane-Anscombe correction so the odds ratio stays finite
+	if a == 0 || b == 0 || c == 0 || d == 0 {
+		a += 0.5
+		b += 0.5
+		c += 0.5
+		d += 0.5
+	}
+
+	return &ClusterAbundance{
+		Proportions: []float64{
+			float64(in[0]) / float64(max(in[0]+out[0], 1)),
+			float64(in[1]) / float64(max(in[1]+out[1], 1)),
+		},
+		Statistic: (a * d) / (b * c),
+		P:         stats.FisherExact(in[0], out[0], in[1], out[1]),
+	}
+}
+
+func propellerAbundance(composition *Composition, members [2][]int, cluster int) *ClusterAbundance {
+	var means [2]float64
+	var proportions [2]float64
+	var ss [2]float64
+
+	for g, m := range members {
+		for _, i := range m {
+			proportion := composition.Proportions[i][cluster]
+			proportions[g] += proportion
+			means[g] += math.Asin(math.Sqrt(proportion))
+		}
+
+		n := float64(len(m))
+		proportions[g] /= n
+		means[g] /= n
+
+		for _, i := range m {
+			diff := math.Asin(math.Sqrt(composition.Proportions[i][cluster])) - means[g]
+			ss[g] += diff * diff
+		}
+	}
+
+	n0 := float64(len(members[0]))
+	n1 := float64(len(members[1]))
+	df := n0 + n1 - 2
+
+	// pooled variance
+	variance := (ss[0] + ss[1]) / df
+	se := math.Sqrt(variance * (1/n0 + 1/n1))
+
+	ret := ClusterAbundance{Proportions: proportions[:], P: 1}
+
+	if se > 0 {
+		ret.Statistic = (means[0] - means[1]) / se
+		ret.P = stats.StudentTTwoSided(ret.Statistic, df)
+	}
+
+	return &ret
+}
@@ -0,0 +1,392 @@
+package scrna
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+)
+
+type (
+	CorrelationMethod string
+
+	CorrelatedGene struct {
+		GeneId     string  `json:"geneId"`
+		GeneSymbol string  `json:"geneSymbol"`
+		R          float64 `json:"r"`
+	}
+
+	CorrelationResults struct {
+		Dataset    string            `json:"dataset"`
+		GeneId     string            `json:"geneId"`
+		GeneSymbol string            `json:"geneSymbol"`
+		Method     CorrelationMethod `json:"method"`
+		Clusters   []int             `json:"clusters,omitempty"`
+		Cells      int               `json:"cells"`
+		Genes      []*CorrelatedGene `json:"genes"`
+	}
+
+	// Called periodically with the number of genes scanned so far
+	// and the total number of genes in the dataset
+	ProgressFunc func(done int, total int)
+
+	// A dense copy of the query gene over the cells being
+	// compared together with the summary statistics needed to
+	// correlate it with sparse genes
+	sparseCorrelator struct {
+		x       []float64
+		include []bool
+		n       float64
+		meanX   float64
+		ssX     float64
+		method  CorrelationMethod
+	}
+)
+
+const (
+	CorrelationPearson  CorrelationMethod = "pearson"
+	CorrelationSpearman CorrelationMethod = "spearman"
+
+	DefaultCorrelatedGenes = 50
+
+	// how many genes to scan between progress updates
+	progressInterval = 1000
+)
+
+func ParseCorrelationMethod(method string) (CorrelationMethod, error) {
+	switch strings.ToLower(method) {
+	case "", "pearson":
+		return CorrelationPearson, nil
+	case "spearman":
+		return CorrelationSpearman, nil
+	default:
+		return "", fmt.Errorf("unknown correlation method %s", method)
+	}
+}
+
+// Find the genes whose expression across cells is most correlated with
+// a query gene. Only cells in the given clusters of the clustering and
+// selected by the filter are compared unless clusters or filter are
+// empty and cells failing the QC thresholds are excluded. The gex blocks
+// are read sequentially and the scan stops early if ctx is cancelled.
+func (sdb *ScrnaDB) CorrelatedGenes(ctx context.Context,
+	datasetId string,
+	geneId string,
+	method CorrelationMethod,
+	limit int,
+	clustering string,
+	clusters []int,
+	filter string,
+	qc *QcThresholds,
+	progress ProgressFunc,
+	isAdmin bool,
+	permissions []string) (*CorrelationResults, error) {
+
+	if limit <= 0 {
+		limit = DefaultCorrelatedGenes
+	}
+
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := sdb.gexFiles(datasetId, gexType, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	genes, err := sdb.GetGenes(datasetId, []string{geneId}, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the query gene must be of the same type as the genes it is
+	// correlated with
+	genes = slices.DeleteFunc(genes, func(gene *Gene) bool {
+		return !slices.Contains(files, gene.Url)
+	})
+
+	gex, err := sdb.orderedGex(genes, []string{geneId})
+
+	if err != nil {
+		return nil, err
+	}
+
+	query := gex[0]
+
+	cellClusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells, err := sdb.cellFilter(datasetId, clustering, filter, qc, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	include := make([]bool, len(cellClusters))
+
+	for i, label := range cellClusters {
+		include[i] = (len(clusters) == 0 || slices.Contains(clusters, label)) &&
+			(cells == nil || cells.Has(i))
+	}
+
+	correlator := newSparseCorrelator(query, include, method)
+
+	if correlator.n < 2 {
+		return nil, fmt.Errorf("not enough cells to correlate")
+	}
+
+	// open all of the blocks first so we know how many genes there are
+	// for reporting progress
+	blocks := make([]*dat.GexBlockReader, 0, len(files))
+
+	defer func() {
+		for _, br := range blocks {
+			br.Close()
+		}
+	}()
+
+	total := 0
+
+	for _, file := range files {
+		br, err := dat.OpenGexBlock(filepath.Join(sdb.dir, file))
+
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, br)
+		total += int(br.Genes)
+	}
+
+	ret := CorrelationResults{
+		Dataset:    datasetId,
+		GeneId:     query.GeneId,
+		GeneSymbol: query.GeneSymbol,
+		Method:     method,
+		Clusters:   clusters,
+		Cells:      int(correlator.n),
+		Genes:      make([]*CorrelatedGene, 0, total),
+	}
+
+	done := 0
+
+	for _, br := range blocks {
+		for {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			gene, err := br.Next()
+
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				return nil, err
+			}
+
+			done++
+
+			if progress != nil && done%progressInterval == 0 {
+				progress(done, total)
+			}
+
+			if gene.GeneId == query.GeneId {
+				continue
+			}
+
+			r, ok := correlator.correlate(gene)
+
+			if ok {
+				ret.Genes = append(ret.Genes, &CorrelatedGene{
+					GeneId:     gene.GeneId,
+					GeneSymbol: gene.GeneSymbol,
+					R:          r,
+				})
+			}
+		}
+	}
+
+	if progress != nil {
+		progress(done, total)
+	}
+
+	slices.SortFunc(ret.Genes, func(a, b *CorrelatedGene) int {
+		switch {
+		case a.R > b.R:
+			return -1
+		case a.R < b.R:
+			return 1
+		default:
+			return strings.Compare(a.GeneSymbol, b.GeneSymbol)
+		}
+	})
+
+	if len(ret.Genes) > limit {
+		ret.Genes = ret.Genes[:limit]
+	}
+
+	return &ret, nil
+}
+
+func newSparseCorrelator(query *dat.GexGene, include []bool, method CorrelationMethod) *sparseCorrelator {
+	c := sparseCorrelator{
+		x:       make([]float64, len(include)),
+		include: include,
+		method:  method,
+	}
+
+	for _, in := range include {
+		if in {
+			c.n++
+		}
+	}
+
+	indexes, values := c.values(query)
+
+	var sumX float64
+	var sumX2 float64
+
+	for i, index := range indexes {
+		c.x[index] = values[i]
+		sumX += values[i]
+		sumX2 += values[i] * values[i]
+	}
+
+	if c.n > 0 {
+		c.meanX = sumX / c.n
+	}
+
+	c.ssX = sumX2 - c.n*c.meanX*c.meanX
+
+	return &c
+}
+
+// correlate returns the correlation between the query gene and
+// another sparse gene. The implicit zeros are accounted for in the
+// sums so that only the non-zero entries need to be visited. The
+// second value is false if either gene has no variance.
+func (c *sparseCorrelator) correlate(gene *dat.GexGene) (float64, bool) {
+	indexes, values := c.values(gene)
+
+	var sumY float64
+	var sumY2 float64
+	var sumXY float64
+
+	for i, index := range indexes {
+		y := values[i]
+		sumY += y
+		sumY2 += y * y
+		sumXY += c.x[index] * y
+	}
+
+	meanY := sumY / c.n
+	ssY := sumY2 - c.n*meanY*meanY
+
+	if c.ssX <= 0 || ssY <= 0 {
+		return 0, false
+	}
+
+	return (sumXY - c.n*c.meanX*meanY) / math.Sqrt(c.ssX*ssY), true
+}
+
+// values returns the non-zero entries of a gene restricted to the
+// included cells. For Spearman the values are replaced by their ranks
+// shifted so that the cells without expression have rank zero, which
+// keeps the vector sparse without changing the correlation.
+func (c *sparseCorrelator) values(gene *dat.GexGene) ([]uint32, []float64) {
+	indexes := make([]uint32, 0, len(gene.Indexes))
+	values := make([]float64, 0, len(gene.Indexes))
+
+	for i, index := range gene.Indexes {
+		if int(index) < len(c.include) && c.include[index] {
+			indexes = append(indexes, index)
+			values = append(values, float64(gene.Gex[i]))
+		}
+	}
+
+	if c.method == CorrelationSpearman {
+		sparseRanks(values, int(c.n))
+	}
+
+	return indexes, values
+}
+
+// sparseRanks replaces the non-zero values of a vector of length n, whose
+// other entries are zero, with their average ranks minus the average rank
+// of the zeros
+func sparseRanks(values []float64, n int) {
+	order := make([]int, len(values))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		switch {
+		case values[a] < values[b]:
+			return -1
+		case values[a] > values[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	zeros := n - len(values)
+
+	negative := 0
+
+	for _, v := range values {
+		if v < 0 {
+			negative++
+		}
+	}
+
+	// zeros occupy ranks negative+1 ... negative+zeros
+	zeroRank := float64(negative) + float64(zeros+1)/2
+
+	// position in the full vector of the sorted non-zero value at p
+	rank := func(p int) float64 {
+		if p < negative {
+			return float64(p + 1)
+		}
+
+		return float64(zeros + p + 1)
+	}
+
+	ranks := make([]float64, len(values))
+
+	for start := 0; start < len(order); {
+		end := start + 1
+
+		for end < len(order) && values[order[end]] == values[order[start]] {
+			end++
+		}
+
+		// ties share the average of their ranks
+		r := (rank(start) + rank(end-1)) / 2
+
+		for p := start; p < end; p++ {
+			ranks[order[p]] = r - zeroRank
+		}
+
+		start = end
+	}
+
+	copy(values, ranks)
+}
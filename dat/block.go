@@ -0,0 +1,115 @@
+package dat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// magic number at the start of every gex block file
+	GexMagic uint32 = 42
+
+	// magic, version and number of genes
+	GexHeaderSize = 4 + 4 + 4
+)
+
+// Reads the genes in a gex block file one after the other. This
+// is much faster than seeking to each gene when most of a
+// block is needed, for example when scanning all genes.
+type GexBlockReader struct {
+	f       *os.File
+	r       *bufio.Reader
+	Version uint32
+	Genes   uint32
+	read    uint32
+}
+
+func OpenGexBlock(file string) (*GexBlockReader, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	header := make([]byte, GexHeaderSize)
+
+	_, err = io.ReadFull(r, header)
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	magic := binary.LittleEndian.Uint32(header)
+
+	if magic != GexMagic {
+		f.Close()
+		return nil, fmt.Errorf("%s is not a gex file", file)
+	}
+
+	return &GexBlockReader{
+		f:       f,
+		r:       r,
+		Version: binary.LittleEndian.Uint32(header[4:]),
+		Genes:   binary.LittleEndian.Uint32(header[8:]),
+	}, nil
+}
+
+// Returns the next gene in the block or io.EOF once all genes
+// have been read
+func (br *GexBlockReader) Next() (*GexGene, error) {
+	if br.read == br.Genes {
+		return nil, io.EOF
+	}
+
+	var blockSize uint32
+
+	err := binary.Read(br.r, binary.LittleEndian, &blockSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if blockSize < 4 {
+		return nil, fmt.Errorf("invalid record size %d", blockSize)
+	}
+
+	// block size includes the 4 bytes of the block size itself
+	buf := make([]byte, blockSize-4)
+
+	_, err = io.ReadFull(br.r, buf)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var record GexGene
+
+	cur, err := extractGeneName(buf, 0, &record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// skip number of values since decode will handle that
+	cur += 4
+
+	err = decodeFloat32Pairs(buf, cur, &record)
+
+	if err != nil {
+		return nil, err
+	}
+
+	br.read++
+
+	return &record, nil
+}
+
+func (br *GexBlockReader) Close() error {
+	return br.f.Close()
+}
@@ -23,6 +23,8 @@ type (
 		//Data       [][2]float32 `json:"gex" msgpack:"d"`
 		Indexes []uint32  `json:"indexes" msgpack:"i"`
 		Gex     []float32 `json:"gex" msgpack:"g"`
+		// set if the values were transformed on the fly
+		Transform *GexTransformResult `json:"transform,omitempty" msgpack:"t,omitempty"`
 	}
 
 	// ResultDataset struct {
@@ -39,9 +41,28 @@ type (
 		//Dataset *Dataset      `json:"dataset"`
 		Dataset string     `json:"dataset"`
 		Genes   []*GexGene `json:"genes"`
+		// base64 bitmap of the cells kept if some were excluded,
+		// e.g. by QC thresholds; excluded cells have no values
+		Cells string `json:"cells,omitempty" msgpack:"c,omitempty"`
 	}
 )
 
+// Keep removes the values of the cells for which keep returns false
+func (gene *GexGene) Keep(keep func(index int) bool) {
+	n := 0
+
+	for i, index := range gene.Indexes {
+		if keep(int(index)) {
+			gene.Indexes[n] = index
+			gene.Gex[n] = gene.Gex[i]
+			n++
+		}
+	}
+
+	gene.Indexes = gene.Indexes[:n]
+	gene.Gex = gene.Gex[:n]
+}
+
 func SeekGexGeneFromDat(file string, offset int64) (*GexGene, error) {
 	f, err := os.Open(file)
 
@@ -0,0 +1,254 @@
+package dat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+type (
+	// A neighbour graph over the cells of a dataset in compressed
+	// sparse row form: the neighbours of cell i are
+	// Neighbours[Offsets[i]:Offsets[i+1]]. Weights are only set for
+	// graphs with edge weights, e.g. an SNN graph.
+	NeighbourGraph struct {
+		Offsets    []uint32
+		Neighbours []uint32
+		Weights    []float32
+	}
+)
+
+const (
+	// magic number at the start of every graph file
+	GraphMagic uint32 = 43
+
+	// magic, version, cells, edges and whether there are weights
+	GraphHeaderSize = 5 * 4
+)
+
+// ReadNeighbourGraph reads a graph file, which after the header has
+// the cells+1 uint32 offsets, the uint32 neighbours and, if weighted,
+// a float32 weight for each edge, all little endian
+func ReadNeighbourGraph(file string) (*NeighbourGraph, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, 1<<20)
+
+	header := make([]uint32, GraphHeaderSize/4)
+
+	err = binary.Read(r, binary.LittleEndian, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header[0] != GraphMagic {
+		return nil, fmt.Errorf("%s is not a graph file", file)
+	}
+
+	cells := header[2]
+	edges := header[3]
+
+	ret := NeighbourGraph{
+		Offsets:    make([]uint32, cells+1),
+		Neighbours: make([]uint32, edges),
+	}
+
+	err = binary.Read(r, binary.LittleEndian, ret.Offsets)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = binary.Read(r, binary.LittleEndian, ret.Neighbours)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header[4] != 0 {
+		ret.Weights = make([]float32, edges)
+
+		err = binary.Read(r, binary.LittleEndian, ret.Weights)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// check the graph is consistent so that lookups cannot panic
+	if ret.Offsets[0] != 0 || ret.Offsets[cells] != edges {
+		return nil, fmt.Errorf("%s has invalid offsets", file)
+	}
+
+	for i := range cells {
+		if ret.Offsets[i] > ret.Offsets[i+1] {
+			return nil, fmt.Errorf("%s has invalid offsets", file)
+		}
+	}
+
+	for _, n := range ret.Neighbours {
+		if n >= cells {
+			return nil, fmt.Errorf("%s has invalid neighbours", file)
+		}
+	}
+
+	_, err = r.ReadByte()
+
+	if err != io.EOF {
+		return nil, fmt.Errorf("%s has trailing data", file)
+	}
+
+	return &ret, nil
+}
+
+func (g *NeighbourGraph) Cells() int {
+	return len(g.Offsets) - 1
+}
+
+func (g *NeighbourGraph) CellNeighbours(cell int) []uint32 {
+	return g.Neighbours[g.Offsets[cell]:g.Offsets[cell+1]]
+}
+
+// CellWeights returns the weights of the edges of a cell in the same
+// order as its neighbours or nil if the graph is unweighted
+func (g *NeighbourGraph) CellWeights(cell int) []float32 {
+	if g.Weights == nil {
+		return nil
+	}
+
+	return g.Weights[g.Offsets[cell]:g.Offsets[cell+1]]
+}
+
+// Expand adds the cells within hops edges of any of the cells and
+// returns them all in ascending order
+func (g *NeighbourGraph) Expand(cells []uint32, hops int) []uint32 {
+	n := g.Cells()
+
+	in := make([]bool, n)
+
+	frontier := make([]uint32, 0, len(cells))
+
+	for _, cell := range cells {
+		if int(cell) < n && !in[cell] {
+			in[cell] = true
+			frontier = append(frontier, cell)
+		}
+	}
+
+	ret := slices.Clone(frontier)
+
+	for range hops {
+		next := make([]uint32, 0, len(frontier))
+
+		for _, cell := range frontier {
+			for _, neighbour := range g.CellNeighbours(int(cell)) {
+				if !in[neighbour] {
+					in[neighbour] = true
+					next = append(next, neighbour)
+				}
+			}
+		}
+
+		if len(next) == 0 {
+			break
+		}
+
+		ret = append(ret, next...)
+		frontier = next
+	}
+
+	slices.Sort(ret)
+
+	return ret
+}
+
+// Smooth replaces the values of a gene with the mean of each cell's
+// value and those of its neighbours. For weighted graphs this is the
+// weighted mean sum(w_ij x_j) / sum(w_ij), the cell itself having a
+// weight of 1 unless it has an edge to itself. The gene stays sparse:
+// cells whose smoothed value is 0 are not listed.
+func (g *NeighbourGraph) Smooth(gene *GexGene) error {
+	cells := g.Cells()
+
+	values := make([]float64, cells)
+
+	for i, index := range gene.Indexes {
+		if int(index) >= cells {
+			return errors.New("gene has cells not in the neighbour graph")
+		}
+
+		values[index] = float64(gene.Gex[i])
+	}
+
+	indexes := make([]uint32, 0, len(gene.Indexes))
+	gex := make([]float32, 0, len(gene.Indexes))
+
+	for cell := range cells {
+		neighbours := g.CellNeighbours(cell)
+
+		var mean float64
+
+		if g.Weights != nil {
+			mean = weightedMean(cell, neighbours, g.CellWeights(cell), values)
+		} else {
+			sum := values[cell]
+
+			for _, n := range neighbours {
+				sum += values[n]
+			}
+
+			mean = sum / float64(len(neighbours)+1)
+		}
+
+		if mean != 0 {
+			indexes = append(indexes, uint32(cell))
+			gex = append(gex, float32(mean))
+		}
+	}
+
+	gene.Indexes = indexes
+	gene.Gex = gex
+
+	return nil
+}
+
+// weightedMean returns the weighted mean of a cell's value and those
+// of its neighbours
+func weightedMean(cell int, neighbours []uint32, weights []float32, values []float64) float64 {
+	sum := 0.0
+	total := 0.0
+	self := false
+
+	for i, n := range neighbours {
+		w := float64(weights[i])
+
+		sum += w * values[n]
+		total += w
+
+		if int(n) == cell {
+			self = true
+		}
+	}
+
+	if !self {
+		sum += values[cell]
+		total++
+	}
+
+	if total <= 0 {
+		return values[cell]
+	}
+
+	return sum / total
+}
@@ -0,0 +1,205 @@
+package dat
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+)
+
+type (
+	// One step of a transform applied to expression values. Steps are
+	// applied in order so e.g. log1p followed by zscore is possible.
+	GexTransform struct {
+		Name string `json:"name"`
+		// percentile (0-100) to clip at for the clip transform
+		Percentile float64 `json:"percentile,omitempty"`
+	}
+
+	// The parameters used by a transform step so that clients can
+	// reproduce or label the scaling
+	GexTransformParams struct {
+		Name string  `json:"name"`
+		Mean float64 `json:"mean,omitempty"`
+		Sd   float64 `json:"sd,omitempty"`
+		Clip float64 `json:"clip,omitempty"`
+		Min  float64 `json:"min,omitempty"`
+		Max  float64 `json:"max,omitempty"`
+	}
+
+	// Describes how the values of a gene were transformed
+	GexTransformResult struct {
+		Steps []*GexTransformParams `json:"steps"`
+		// The value of cells with no recorded expression after the
+		// transform. Gene vectors are sparse so cells not listed in
+		// Indexes should be drawn with this value, which is no
+		// longer 0 after e.g. z-scoring.
+		Zero float32 `json:"zero"`
+	}
+)
+
+const (
+	TransformLog1p  = "log1p"
+	TransformLog2p1 = "log2p1"
+	TransformZScore = "zscore"
+	TransformClip   = "clip"
+	TransformMinMax = "minmax"
+
+	DefaultClipPercentile = 99
+)
+
+// ApplyTransforms applies a series of transforms to the values of a gene
+// spread over cells cells in total, those not in Indexes having an
+// expression of 0. The statistics used by the transforms, e.g. mean and
+// sd for z-scoring, include these implicit zeros.
+func (gene *GexGene) ApplyTransforms(transforms []*GexTransform, cells int) error {
+	if len(transforms) == 0 {
+		return nil
+	}
+
+	if cells < len(gene.Gex) {
+		return errors.New("gene has more values than cells")
+	}
+
+	values := make([]float64, len(gene.Gex))
+
+	for i, v := range gene.Gex {
+		values[i] = float64(v)
+	}
+
+	// the value of the cells not in indexes and how many there are
+	var zero float64
+	zeros := cells - len(values)
+
+	result := GexTransformResult{Steps: make([]*GexTransformParams, 0, len(transforms))}
+
+	for _, t := range transforms {
+		params := GexTransformParams{Name: strings.ToLower(t.Name)}
+
+		var fn func(v float64) float64
+
+		switch params.Name {
+		case TransformLog1p, TransformLog2p1:
+			if zeros > 0 && zero <= -1 || slices.ContainsFunc(values, func(v float64) bool { return v <= -1 }) {
+				return fmt.Errorf("cannot apply %s to values <= -1", params.Name)
+			}
+
+			if params.Name == TransformLog1p {
+				fn = math.Log1p
+			} else {
+				fn = func(v float64) float64 { return math.Log1p(v) / math.Ln2 }
+			}
+		case TransformZScore:
+			n := float64(cells)
+			sum := zero * float64(zeros)
+			ss := zero * zero * float64(zeros)
+
+			for _, v := range values {
+				sum += v
+				ss += v * v
+			}
+
+			params.Mean = sum / n
+			params.Sd = math.Sqrt(max(ss/n-params.Mean*params.Mean, 0))
+
+			fn = func(v float64) float64 {
+				if params.Sd == 0 {
+					return 0
+				}
+
+				return (v - params.Mean) / params.Sd
+			}
+		case TransformClip:
+			p := t.Percentile
+
+			if p <= 0 {
+				p = DefaultClipPercentile
+			}
+
+			if p > 100 {
+				return fmt.Errorf("invalid percentile %f", p)
+			}
+
+			params.Clip = percentile(values, zero, zeros, p)
+
+			fn = func(v float64) float64 { return min(v, params.Clip) }
+		case TransformMinMax:
+			params.Min = math.Inf(1)
+			params.Max = math.Inf(-1)
+
+			if zeros > 0 {
+				params.Min = zero
+				params.Max = zero
+			}
+
+			for _, v := range values {
+				params.Min = min(params.Min, v)
+				params.Max = max(params.Max, v)
+			}
+
+			fn = func(v float64) float64 {
+				if params.Max == params.Min {
+					return 0
+				}
+
+				return (v - params.Min) / (params.Max - params.Min)
+			}
+		default:
+			return fmt.Errorf("unknown transform %s", t.Name)
+		}
+
+		for i, v := range values {
+			values[i] = fn(v)
+		}
+
+		zero = fn(zero)
+
+		result.Steps = append(result.Steps, &params)
+	}
+
+	gene.Gex = make([]float32, len(values))
+
+	for i, v := range values {
+		gene.Gex[i] = float32(v)
+	}
+
+	result.Zero = float32(zero)
+	gene.Transform = &result
+
+	return nil
+}
+
+// percentile returns the p-th percentile (0-100) of values plus zeros
+// copies of zero using linear interpolation between order statistics
+func percentile(values []float64, zero float64, zeros int, p float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+
+	n := len(sorted) + zeros
+
+	if n == 0 {
+		return 0
+	}
+
+	// below are the number of values less than zero which come before
+	// the zeros in the combined order
+	below, _ := slices.BinarySearch(sorted, zero)
+
+	at := func(k int) float64 {
+		switch {
+		case k < below:
+			return sorted[k]
+		case k < below+zeros:
+			return zero
+		default:
+			return sorted[k-zeros]
+		}
+	}
+
+	rank := p / 100 * float64(n-1)
+	lo := int(math.Floor(rank))
+	hi := int(math.Ceil(rank))
+
+	return at(lo) + (at(hi)-at(lo))*(rank-float64(lo))
+}
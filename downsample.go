@@ -0,0 +1,215 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+type (
+	DownsampleStrata string
+
+	// Picks a subset of cells, either a fixed number or a fraction.
+	// With the same options the same cells are always picked so that
+	// Metadata and Gex return the same subset.
+	DownsampleOptions struct {
+		Cells    int              `json:"cells" form:"cells"`
+		Fraction float64          `json:"fraction" form:"fraction"`
+		Stratify DownsampleStrata `json:"stratify" form:"stratify"`
+		// clustering whose clusters are the strata when stratifying
+		// by cluster, the default if empty
+		Clustering string `json:"clustering" form:"clustering"`
+		Seed       uint64 `json:"seed" form:"seed"`
+	}
+)
+
+const (
+	// sample from all cells at once
+	StratifyNone DownsampleStrata = ""
+	// keep the proportion of cells in each cluster
+	StratifyCluster DownsampleStrata = "cluster"
+	// keep the proportion of cells from each sample
+	StratifySample DownsampleStrata = "sample"
+)
+
+func ParseDownsampleStrata(strata string) (DownsampleStrata, error) {
+	switch strings.ToLower(strata) {
+	case "", "none":
+		return StratifyNone, nil
+	case "cluster", "clusters":
+		return StratifyCluster, nil
+	case "sample", "samples":
+		return StratifySample, nil
+	default:
+		return "", fmt.Errorf("unknown downsample strata %s", strata)
+	}
+}
+
+// IsEmpty returns true if no downsampling was requested, including
+// when options is nil
+func (options *DownsampleOptions) IsEmpty() bool {
+	return options == nil || (options.Cells <= 0 && options.Fraction <= 0)
+}
+
+// downsample returns the cells picked by the options or nil if no
+// downsampling was requested or every cell would be picked. Each
+// stratum gets a share of the cells proportional to its size.
+func (sdb *ScrnaDB) downsample(datasetId string, options *DownsampleOptions) (*CellSet, error) {
+	if options.IsEmpty() {
+		return nil, nil
+	}
+
+	if options.Fraction > 1 {
+		return nil, errors.New("fraction must not be greater than 1")
+	}
+
+	strata, err := ParseDownsampleStrata(string(options.Stratify))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the stratum of each cell
+	var keys []string
+
+	switch strata {
+	case StratifyCluster:
+		clusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = make([]string, len(clusters))
+
+		for i, label := range clusters {
+			keys[i] = strconv.Itoa(label)
+		}
+	case StratifySample:
+		keys, err = sdb.cellSamples(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		cellCount, err := sdb.cellCount(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keys = make([]string, cellCount)
+	}
+
+	size := len(keys)
+
+	n := options.Cells
+
+	if options.Fraction > 0 {
+		n = int(math.Round(options.Fraction * float64(size)))
+	}
+
+	if n >= size {
+		return nil, nil
+	}
+
+	groups := make(map[string][]int)
+
+	for i, key := range keys {
+		groups[key] = append(groups[key], i)
+	}
+
+	// visit strata in a fixed order so the random numbers are
+	// always used in the same way
+	names := make([]string, 0, len(groups))
+
+	for name := range groups {
+		names = append(names, name)
+	}
+
+	slices.SortFunc(names, compareStrata)
+
+	quotas := downsampleQuotas(names, groups, n, size)
+
+	rng := rand.New(rand.NewPCG(options.Seed, options.Seed))
+
+	ret := NewCellSet(size)
+
+	for i, name := range names {
+		cells := groups[name]
+		quota := quotas[i]
+
+		// partial Fisher-Yates shuffle to pick the stratum's cells
+		for j := range quota {
+			k := j + rng.IntN(len(cells)-j)
+			cells[j], cells[k] = cells[k], cells[j]
+			ret.Add(cells[j])
+		}
+	}
+
+	return ret, nil
+}
+
+// downsampleQuotas shares n cells between strata in proportion to
+// their size, giving the cells left over after rounding down to the
+// strata with the largest remainders
+func downsampleQuotas(names []string, groups map[string][]int, n int, size int) []int {
+	quotas := make([]int, len(names))
+	remainders := make([]float64, len(names))
+
+	total := 0
+
+	for i, name := range names {
+		share := float64(n) * float64(len(groups[name])) / float64(size)
+
+		quotas[i] = int(share)
+		remainders[i] = share - float64(quotas[i])
+		total += quotas[i]
+	}
+
+	order := make([]int, len(names))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortStableFunc(order, func(a, b int) int {
+		switch {
+		case remainders[a] > remainders[b]:
+			return -1
+		case remainders[a] < remainders[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	for _, i := range order {
+		if total >= n {
+			break
+		}
+
+		if quotas[i] < len(groups[names[i]]) {
+			quotas[i]++
+			total++
+		}
+	}
+
+	return quotas
+}
+
+// order cluster labels numerically and sample names alphabetically
+func compareStrata(a string, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+
+	if errA == nil && errB == nil {
+		return x - y
+	}
+
+	return strings.Compare(a, b)
+}
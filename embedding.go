@@ -0,0 +1,216 @@
+package scrna
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+type (
+	Embedding struct {
+		Name       string `json:"name"`
+		Dimensions int    `json:"dimensions"`
+		// the umap stored with the cells, which is the embedding
+		// Metadata uses unless another is requested
+		Default bool `json:"default,omitempty"`
+	}
+
+	// The coordinates of every cell in an embedding in the same
+	// order as the cells returned by Metadata
+	EmbeddingCoords struct {
+		Dataset string `json:"dataset"`
+		Embedding
+		Coords [][]float32 `json:"coords"`
+	}
+)
+
+const (
+	DefaultEmbedding = "umap"
+
+	// number of embedding kd-trees kept in memory
+	MaxCachedTrees = 16
+
+	EmbeddingsSql = `SELECT
+		e.name,
+		e.dimensions
+		FROM embeddings e
+		JOIN datasets d ON e.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY e.id`
+
+	// coordinates are stored as little endian float32 with the cells
+	// in id order and the dimensions of each cell together
+	EmbeddingSql = `SELECT
+		e.name,
+		e.dimensions,
+		e.data
+		FROM embeddings e
+		JOIN datasets d ON e.dataset_id = d.id
+		WHERE d.public_id = :id AND LOWER(e.name) = LOWER(:name)`
+)
+
+// Lists the embeddings of a dataset, the default umap first
+func (sdb *ScrnaDB) Embeddings(datasetId string, isAdmin bool, permissions []string) ([]*Embedding, error) {
+	// check the user can view the dataset
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sdb.embeddings(datasetId)
+}
+
+// Returns the coordinates of every cell in an embedding, the default
+// umap if name is empty
+func (sdb *ScrnaDB) Embedding(datasetId string, name string, isAdmin bool, permissions []string) (*EmbeddingCoords, error) {
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return sdb.embeddingCoords(datasetId, name)
+}
+
+// embeddings lists the embeddings of a dataset without checking
+// permissions
+func (sdb *ScrnaDB) embeddings(datasetId string) ([]*Embedding, error) {
+	rows, err := sdb.db.Query(EmbeddingsSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := []*Embedding{{Name: DefaultEmbedding, Dimensions: 2, Default: true}}
+
+	for rows.Next() {
+		var embedding Embedding
+
+		err := rows.Scan(&embedding.Name, &embedding.Dimensions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &embedding)
+	}
+
+	return ret, nil
+}
+
+func (sdb *ScrnaDB) embeddingCoords(datasetId string, name string) (*EmbeddingCoords, error) {
+	ret := EmbeddingCoords{Dataset: datasetId}
+
+	if isDefaultEmbedding(name) {
+		points, err := sdb.cellPositions(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret.Embedding = Embedding{Name: DefaultEmbedding, Dimensions: 2, Default: true}
+		ret.Coords = make([][]float32, len(points))
+
+		for i, p := range points {
+			ret.Coords[i] = []float32{float32(p.X), float32(p.Y)}
+		}
+
+		return &ret, nil
+	}
+
+	var data []byte
+
+	err := sdb.db.QueryRow(EmbeddingSql, sql.Named("id", datasetId), sql.Named("name", name)).
+		Scan(&ret.Name, &ret.Dimensions, &data)
+
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("embedding %s not found", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.Dimensions < 1 || len(data) != cellCount*ret.Dimensions*4 {
+		return nil, fmt.Errorf("embedding %s does not match the cells", ret.Name)
+	}
+
+	values := make([]float32, cellCount*ret.Dimensions)
+
+	err = binary.Read(bytes.NewReader(data), binary.LittleEndian, values)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Coords = make([][]float32, cellCount)
+
+	for i := range ret.Coords {
+		ret.Coords[i] = values[i*ret.Dimensions : (i+1)*ret.Dimensions]
+	}
+
+	return &ret, nil
+}
+
+// embeddingPoints returns the first two dimensions of each cell in an
+// embedding for spatial queries
+func (sdb *ScrnaDB) embeddingPoints(datasetId string, name string) ([]spatial.Point, error) {
+	if isDefaultEmbedding(name) {
+		return sdb.cellPositions(datasetId)
+	}
+
+	coords, err := sdb.embeddingCoords(datasetId, name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if coords.Dimensions < 2 {
+		return nil, errors.New("embedding must have at least two dimensions")
+	}
+
+	ret := make([]spatial.Point, len(coords.Coords))
+
+	for i, c := range coords.Coords {
+		ret[i] = spatial.Point{X: float64(c[0]), Y: float64(c[1])}
+	}
+
+	return ret, nil
+}
+
+func isDefaultEmbedding(name string) bool {
+	return name == "" || strings.EqualFold(name, DefaultEmbedding)
+}
+
+// spatialIndex returns a kd-tree over the first two dimensions of an
+// embedding. Trees are cached as building one over hundreds of
+// thousands of cells takes longer than most queries.
+func (sdb *ScrnaDB) spatialIndex(datasetId string, name string) (*spatial.KDTree, error) {
+	if isDefaultEmbedding(name) {
+		name = DefaultEmbedding
+	}
+
+	return sdb.trees.get(datasetId+":"+strings.ToLower(name), func() (*spatial.KDTree, error) {
+		points, err := sdb.embeddingPoints(datasetId, name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return spatial.NewKDTree(points), nil
+	})
+}
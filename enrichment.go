@@ -0,0 +1,217 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/genesets"
+	"github.com/antonybholmes/go-web/auth/sqlite"
+)
+
+type (
+	OraResults struct {
+		Dataset string `json:"dataset"`
+		Library string `json:"library"`
+		// the query genes as symbols of the dataset
+		Genes []string `json:"genes"`
+		// query genes not found in the dataset
+		Unmapped []string              `json:"unmapped"`
+		Universe int                   `json:"universe"`
+		Sets     []*genesets.OraResult `json:"sets"`
+	}
+
+	GseaResults struct {
+		Dataset  string                 `json:"dataset"`
+		Library  string                 `json:"library"`
+		Genes    int                    `json:"genes"`
+		Unmapped []string               `json:"unmapped"`
+		Sets     []*genesets.GseaResult `json:"sets"`
+	}
+)
+
+const (
+	// subdirectory of the data dir holding the gmt files
+	GeneSetsDir = "genesets"
+
+	DatasetGenesSql = `SELECT DISTINCT
+		g.gene_id,
+		g.ensembl,
+		g.gene_symbol
+		FROM gex gx
+		JOIN genes g ON gx.gene_id = g.id
+		JOIN datasets d ON gx.dataset_id = d.id
+		JOIN dataset_permissions dp ON d.id = dp.dataset_id
+		JOIN permissions p ON dp.permission_id = p.id
+		WHERE
+			<<PERMISSIONS>>
+			AND d.public_id = :id`
+)
+
+func (sdb *ScrnaDB) GeneSetLibraries() ([]*genesets.LibraryInfo, error) {
+	return sdb.genesets.List()
+}
+
+// Test the sets of a library for over-representation in a list of
+// genes, e.g. cluster markers, using the genes of the dataset as
+// the background
+func (sdb *ScrnaDB) OverRepresentation(datasetId string,
+	library string,
+	genes []string,
+	options *genesets.EnrichmentOptions,
+	isAdmin bool,
+	permissions []string) (*OraResults, error) {
+
+	if len(genes) == 0 {
+		return nil, errors.New("no genes")
+	}
+
+	lib, err := sdb.genesets.Get(library)
+
+	if err != nil {
+		return nil, err
+	}
+
+	symbols, universe, err := sdb.datasetGeneSymbols(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := OraResults{
+		Dataset:  datasetId,
+		Library:  lib.Name,
+		Genes:    make([]string, 0, len(genes)),
+		Unmapped: make([]string, 0, 10),
+		Universe: len(universe),
+	}
+
+	for _, gene := range genes {
+		symbol, ok := symbols[strings.ToUpper(gene)]
+
+		if ok {
+			ret.Genes = append(ret.Genes, symbol)
+		} else {
+			ret.Unmapped = append(ret.Unmapped, gene)
+		}
+	}
+
+	ret.Sets, err = genesets.OverRepresentation(ret.Genes, universe, lib, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// Run a preranked GSEA of a library against genes ranked by a score
+// such as the log fold change of a differential expression result
+func (sdb *ScrnaDB) Gsea(datasetId string,
+	library string,
+	ranked []*genesets.RankedGene,
+	options *genesets.EnrichmentOptions,
+	isAdmin bool,
+	permissions []string) (*GseaResults, error) {
+
+	lib, err := sdb.genesets.Get(library)
+
+	if err != nil {
+		return nil, err
+	}
+
+	symbols, _, err := sdb.datasetGeneSymbols(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := GseaResults{
+		Dataset:  datasetId,
+		Library:  lib.Name,
+		Unmapped: make([]string, 0, 10),
+	}
+
+	mapped := make([]*genesets.RankedGene, 0, len(ranked))
+	used := make(map[string]bool, len(ranked))
+
+	for _, gene := range ranked {
+		symbol, ok := symbols[strings.ToUpper(gene.Gene)]
+
+		if !ok {
+			ret.Unmapped = append(ret.Unmapped, gene.Gene)
+			continue
+		}
+
+		// keep the first score if ids map to the same symbol
+		if used[symbol] {
+			continue
+		}
+
+		used[symbol] = true
+
+		mapped = append(mapped, &genesets.RankedGene{Gene: symbol, Score: gene.Score})
+	}
+
+	ret.Genes = len(mapped)
+
+	ret.Sets, err = genesets.Gsea(mapped, lib, options)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+// datasetGeneSymbols returns a map from the upper case gene ids,
+// Ensembl ids and symbols of the genes in a dataset to their symbols
+// together with the list of symbols
+func (sdb *ScrnaDB) datasetGeneSymbols(datasetId string, isAdmin bool, permissions []string) (map[string]string, []string, error) {
+	namedArgs := []any{sql.Named("id", datasetId)}
+
+	query := sqlite.MakePermissionsSql(DatasetGenesSql, isAdmin, permissions, &namedArgs)
+
+	rows, err := sdb.db.Query(query, namedArgs...)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	symbols := make(map[string]string, 30000)
+	universe := make([]string, 0, 30000)
+
+	for rows.Next() {
+		var geneId string
+		var ensembl string
+		var symbol string
+
+		err := rows.Scan(&geneId, &ensembl, &symbol)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		key := strings.ToUpper(symbol)
+
+		if _, ok := symbols[key]; !ok {
+			universe = append(universe, symbol)
+		}
+
+		symbols[key] = symbol
+
+		for _, id := range []string{geneId, ensembl} {
+			if id != "" {
+				symbols[strings.ToUpper(id)] = symbol
+			}
+		}
+	}
+
+	if len(universe) == 0 {
+		return nil, nil, errors.New("dataset has no genes")
+	}
+
+	return symbols, universe, nil
+}
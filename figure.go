@@ -0,0 +1,554 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/plot"
+	"github.com/antonybholmes/go-scrna/tiles"
+)
+
+type (
+	FigureKind string
+
+	FigureOptions struct {
+		// svg or pdf
+		Format string `json:"format"`
+		// embedding of embedding plots, the default umap if empty
+		Embedding string `json:"embedding"`
+		// clustering cells are grouped by, the default if empty
+		Clustering string `json:"clustering"`
+		// an embedding plot colors cells by the expression of a gene
+		// if given rather than by cluster; violin plots need one gene
+		Genes []string `json:"genes"`
+		// or by a numeric cell metadata column
+		Metadata string `json:"metadata"`
+		Colormap string `json:"colormap"`
+		// right, bottom or none
+		Legend string `json:"legend"`
+		// none or data to write cluster names on embedding plots
+		Labels    string  `json:"labels"`
+		Title     string  `json:"title"`
+		Width     float64 `json:"width"`
+		Height    float64 `json:"height"`
+		PointSize float64 `json:"pointSize"`
+		FontSize  float64 `json:"fontSize"`
+		// color dot plots by each gene's mean relative to its
+		// highest mean rather than by the mean itself
+		Scale bool `json:"scale"`
+		// cells failing these are not plotted
+		Qc *QcThresholds `json:"qc"`
+	}
+)
+
+const (
+	// cells of an embedding colored by cluster or a gene
+	FigureEmbedding FigureKind = "embedding"
+	// mean expression and fraction expressing of genes per cluster
+	FigureDotPlot FigureKind = "dotplot"
+	// distribution of a gene's expression per cluster
+	FigureViolin FigureKind = "violin"
+
+	MaxFigureGenes = 50
+)
+
+func ParseFigureKind(kind string) (FigureKind, error) {
+	switch strings.ToLower(kind) {
+	case "embedding", "umap", "feature":
+		return FigureEmbedding, nil
+	case "dotplot", "dot":
+		return FigureDotPlot, nil
+	case "violin":
+		return FigureViolin, nil
+	default:
+		return "", fmt.Errorf("unknown figure %s", kind)
+	}
+}
+
+// Render a figure of a dataset as svg or pdf so that figures for
+// publication do not depend on screenshots of the browser
+func (sdb *ScrnaDB) Figure(datasetId string,
+	kind FigureKind,
+	options *FigureOptions,
+	isAdmin bool,
+	permissions []string) ([]byte, error) {
+
+	format, err := plot.ParseFormat(options.Format)
+
+	if err != nil {
+		return nil, err
+	}
+
+	legend, err := plot.ParseLegendPosition(options.Legend)
+
+	if err != nil {
+		return nil, err
+	}
+
+	labels, err := plot.ParseLabelPosition(options.Labels)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(options.Genes) > MaxFigureGenes {
+		return nil, fmt.Errorf("at most %d genes can be plotted", MaxFigureGenes)
+	}
+
+	style := plot.Style{
+		Legend:    legend,
+		Labels:    labels,
+		Title:     options.Title,
+		PointSize: options.PointSize,
+		FontSize:  options.FontSize,
+		Width:     options.Width,
+		Height:    options.Height,
+	}
+
+	style.Normalize()
+
+	// also checks the user can view the dataset
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := plot.NewCanvas(format, style.Width, style.Height)
+
+	switch kind {
+	case FigureEmbedding:
+		err = sdb.embeddingFigure(canvas, datasetId, clusters, options, &style, isAdmin, permissions)
+	case FigureDotPlot:
+		err = sdb.dotPlotFigure(canvas, datasetId, clusters, options, &style, isAdmin, permissions)
+	case FigureViolin:
+		err = sdb.violinFigure(canvas, datasetId, clusters, options, &style, isAdmin, permissions)
+	default:
+		err = fmt.Errorf("unknown figure %s", kind)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return canvas.Bytes()
+}
+
+func (sdb *ScrnaDB) embeddingFigure(canvas plot.Canvas,
+	datasetId string,
+	clusters []*Cluster,
+	options *FigureOptions,
+	style *plot.Style,
+	isAdmin bool,
+	permissions []string) error {
+
+	if len(options.Genes) > 1 {
+		return errors.New("an embedding can be colored by one gene")
+	}
+
+	if len(options.Genes) > 0 && options.Metadata != "" {
+		return errors.New("an embedding can be colored by a gene or by cell metadata")
+	}
+
+	points, err := sdb.embeddingPoints(datasetId, options.Embedding)
+
+	if err != nil {
+		return err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return err
+	}
+
+	if len(cellClusters) != len(points) {
+		return errors.New("embedding does not match the cells")
+	}
+
+	passed, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return err
+	}
+
+	name := embeddingName(options.Embedding)
+
+	if name == DefaultEmbedding {
+		name = "UMAP"
+	} else {
+		name = strings.ToUpper(name[:1]) + name[1:]
+	}
+
+	scatter := plot.ScatterPlot{
+		XLabel:      name + "-1",
+		YLabel:      name + "-2",
+		EqualAspect: isSpatialEmbedding(options.Embedding),
+	}
+
+	// cells failing qc are left out of the plot
+	cells := make([]int, 0, len(points))
+
+	for i := range points {
+		if passed == nil || passed.Has(i) {
+			cells = append(cells, i)
+			scatter.Points = append(scatter.Points, points[i])
+		}
+	}
+
+	scatter.Colors = make([]color.RGBA, len(cells))
+
+	if len(options.Genes) == 1 {
+		cmap, err := tiles.ParseColormap(options.Colormap)
+
+		if err != nil {
+			return err
+		}
+
+		gex, err := sdb.figureGex(datasetId, options.Genes, options.Qc, isAdmin, permissions)
+
+		if err != nil {
+			return err
+		}
+
+		values := cellValues(gex[0], len(points))
+
+		scatter.Order = make([]float64, len(cells))
+
+		m := 0.0
+
+		for i, cell := range cells {
+			scatter.Order[i] = values[cell]
+			m = max(m, values[cell])
+		}
+
+		scatter.Colorbar = &plot.Colorbar{Colormap: cmap, Label: gex[0].GeneSymbol, Max: m}
+
+		for i, v := range scatter.Order {
+			if v > 0 {
+				scatter.Colors[i] = scatter.Colorbar.Colormap.At(v / max(m, 1e-9))
+			} else {
+				scatter.Colors[i] = plot.LightGrey
+			}
+		}
+
+		if style.Title == "" {
+			style.Title = gex[0].GeneSymbol
+		}
+	} else if options.Metadata != "" {
+		cmap, err := tiles.ParseColormap(options.Colormap)
+
+		if err != nil {
+			return err
+		}
+
+		label, values, err := sdb.cellMetadataNumbers(datasetId, options.Metadata)
+
+		if err != nil {
+			return err
+		}
+
+		if len(values) != len(points) {
+			return errors.New("embedding does not match the cells")
+		}
+
+		scatter.Order = make([]float64, len(cells))
+
+		for i, cell := range cells {
+			scatter.Order[i] = values[cell]
+		}
+
+		lo, hi := numberRange(scatter.Order)
+
+		scatter.Colorbar = &plot.Colorbar{Colormap: cmap, Label: label, Min: lo, Max: hi}
+
+		for i, v := range scatter.Order {
+			if math.IsNaN(v) {
+				// missing values are drawn first
+				scatter.Order[i] = math.Inf(-1)
+				scatter.Colors[i] = plot.LightGrey
+			} else {
+				scatter.Colors[i] = scatter.Colorbar.Color(v)
+			}
+		}
+
+		if style.Title == "" {
+			style.Title = label
+		}
+	} else {
+		categories, groups := clusterCategories(clusters)
+
+		scatter.Categories = categories
+		scatter.Groups = make([]int, len(cells))
+
+		for i, cell := range cells {
+			g, ok := groups[cellClusters[cell]]
+
+			if !ok {
+				scatter.Groups[i] = -1
+				scatter.Colors[i] = plot.LightGrey
+				continue
+			}
+
+			scatter.Groups[i] = g
+			scatter.Colors[i] = categories[g].Color
+		}
+	}
+
+	scatter.Draw(canvas, style)
+
+	return nil
+}
+
+func (sdb *ScrnaDB) dotPlotFigure(canvas plot.Canvas,
+	datasetId string,
+	clusters []*Cluster,
+	options *FigureOptions,
+	style *plot.Style,
+	isAdmin bool,
+	permissions []string) error {
+
+	if len(options.Genes) == 0 {
+		return errors.New("no genes")
+	}
+
+	cmap, err := tiles.ParseColormap(options.Colormap)
+
+	if err != nil {
+		return err
+	}
+
+	gex, err := sdb.figureGex(datasetId, options.Genes, options.Qc, isAdmin, permissions)
+
+	if err != nil {
+		return err
+	}
+
+	categories, groups := clusterCategories(clusters)
+
+	cellGroups, err := sdb.figureGroups(datasetId, options.Clustering, options.Qc, groups)
+
+	if err != nil {
+		return err
+	}
+
+	dots := plot.DotPlot{
+		Genes:     make([]string, len(gex)),
+		Groups:    categories,
+		Means:     make([][]float64, len(categories)),
+		Fractions: make([][]float64, len(categories)),
+		Colorbar:  &plot.Colorbar{Colormap: cmap, Label: "Mean expression"},
+	}
+
+	counts := make([]int, len(categories))
+
+	for _, g := range cellGroups {
+		if g != -1 {
+			counts[g]++
+		}
+	}
+
+	for g := range categories {
+		dots.Means[g] = make([]float64, len(gex))
+		dots.Fractions[g] = make([]float64, len(gex))
+	}
+
+	for i, gene := range gex {
+		dots.Genes[i] = gene.GeneSymbol
+
+		for j, index := range gene.Indexes {
+			if int(index) >= len(cellGroups) || cellGroups[index] == -1 {
+				continue
+			}
+
+			g := cellGroups[index]
+
+			dots.Means[g][i] += float64(gene.Gex[j])
+
+			if gene.Gex[j] > 0 {
+				dots.Fractions[g][i]++
+			}
+		}
+	}
+
+	for g := range categories {
+		for i := range gex {
+			if counts[g] > 0 {
+				dots.Means[g][i] /= float64(counts[g])
+				dots.Fractions[g][i] /= float64(counts[g])
+			}
+		}
+	}
+
+	if options.Scale {
+		for i := range gex {
+			m := 0.0
+
+			for g := range categories {
+				m = max(m, dots.Means[g][i])
+			}
+
+			if m > 0 {
+				for g := range categories {
+					dots.Means[g][i] /= m
+				}
+			}
+		}
+
+		dots.Colorbar.Label = "Scaled mean"
+		dots.Colorbar.Max = 1
+	} else {
+		for g := range categories {
+			for i := range gex {
+				dots.Colorbar.Max = max(dots.Colorbar.Max, dots.Means[g][i])
+			}
+		}
+	}
+
+	dots.Draw(canvas, style)
+
+	return nil
+}
+
+func (sdb *ScrnaDB) violinFigure(canvas plot.Canvas,
+	datasetId string,
+	clusters []*Cluster,
+	options *FigureOptions,
+	style *plot.Style,
+	isAdmin bool,
+	permissions []string) error {
+
+	if len(options.Genes) != 1 {
+		return errors.New("a violin plot needs one gene")
+	}
+
+	gex, err := sdb.figureGex(datasetId, options.Genes, options.Qc, isAdmin, permissions)
+
+	if err != nil {
+		return err
+	}
+
+	categories, groups := clusterCategories(clusters)
+
+	cellGroups, err := sdb.figureGroups(datasetId, options.Clustering, options.Qc, groups)
+
+	if err != nil {
+		return err
+	}
+
+	violins := plot.ViolinPlot{
+		YLabel: gex[0].GeneSymbol,
+		Groups: categories,
+		Values: make([][]float64, len(categories)),
+	}
+
+	values := cellValues(gex[0], len(cellGroups))
+
+	for cell, v := range values {
+		if g := cellGroups[cell]; g != -1 {
+			violins.Values[g] = append(violins.Values[g], v)
+		}
+	}
+
+	if style.Title == "" {
+		style.Title = gex[0].GeneSymbol
+	}
+
+	violins.Draw(canvas, style)
+
+	return nil
+}
+
+// figureGex returns the expression of genes from Gex in the order they
+// were requested
+func (sdb *ScrnaDB) figureGex(datasetId string, geneIds []string, qc *QcThresholds, isAdmin bool, permissions []string) ([]*dat.GexGene, error) {
+	results, err := sdb.Gex(datasetId, geneIds, &GexOptions{Qc: qc}, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*dat.GexGene, len(geneIds))
+
+	for i, id := range geneIds {
+		for _, gene := range results.Genes {
+			if strings.EqualFold(id, gene.GeneId) || strings.EqualFold(id, gene.GeneSymbol) {
+				ret[i] = gene
+				break
+			}
+		}
+
+		if ret[i] == nil {
+			return nil, fmt.Errorf("gene %s not found", id)
+		}
+	}
+
+	return ret, nil
+}
+
+// figureGroups returns the index of the category of each cell or -1
+// if it fails qc or is not in a cluster
+func (sdb *ScrnaDB) figureGroups(datasetId string, clustering string, qc *QcThresholds, groups map[int]int) ([]int, error) {
+	cellClusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	passed, err := sdb.qcCells(datasetId, qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]int, len(cellClusters))
+
+	for i, label := range cellClusters {
+		g, ok := groups[label]
+
+		if !ok || (passed != nil && !passed.Has(i)) {
+			g = -1
+		}
+
+		ret[i] = g
+	}
+
+	return ret, nil
+}
+
+// clusterCategories returns the clusters as plot categories and the
+// index of each cluster label
+func clusterCategories(clusters []*Cluster) ([]plot.Category, map[int]int) {
+	categories := make([]plot.Category, len(clusters))
+	groups := make(map[int]int, len(clusters))
+
+	for i, cluster := range clusters {
+		c, err := tiles.ParseHexColor(cluster.Color)
+
+		if err != nil {
+			c = plot.Grey
+		}
+
+		categories[i] = plot.Category{Name: cluster.Name, Color: c}
+		groups[cluster.Label] = i
+	}
+
+	return categories, groups
+}
+
+// cellValues expands the sparse values of a gene to every cell
+func cellValues(gene *dat.GexGene, cells int) []float64 {
+	ret := make([]float64, cells)
+
+	for i, index := range gene.Indexes {
+		if int(index) < cells {
+			ret[index] = float64(gene.Gex[i])
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,424 @@
+package genesets
+
+import (
+	"errors"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/stats"
+)
+
+type (
+	EnrichmentOptions struct {
+		// gene sets with fewer or more genes in the universe
+		// than these are skipped
+		MinSize int `json:"minSize"`
+		MaxSize int `json:"maxSize"`
+		// number of random gene sets used to estimate GSEA p-values
+		Permutations int    `json:"permutations"`
+		Seed         uint64 `json:"seed"`
+	}
+
+	OraResult struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Genes       []string `json:"genes"`
+		// size of the set restricted to the universe
+		Size           int     `json:"size"`
+		Overlap        int     `json:"overlap"`
+		FoldEnrichment float64 `json:"foldEnrichment"`
+		P              float64 `json:"p"`
+		Q              float64 `json:"q"`
+	}
+
+	RankedGene struct {
+		Gene  string  `json:"gene"`
+		Score float64 `json:"score"`
+	}
+
+	GseaResult struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		// genes of the set contributing to the enrichment score
+		LeadingEdge []string `json:"leadingEdge"`
+		Size        int      `json:"size"`
+		ES          float64  `json:"es"`
+		NES         float64  `json:"nes"`
+		P           float64  `json:"p"`
+		Q           float64  `json:"q"`
+	}
+)
+
+const (
+	DefaultMinSetSize   = 10
+	DefaultMaxSetSize   = 500
+	DefaultPermutations = 1000
+	MaxPermutations     = 10000
+)
+
+func (options *EnrichmentOptions) sizes() (int, int) {
+	minSize := options.MinSize
+
+	if minSize <= 0 {
+		minSize = DefaultMinSetSize
+	}
+
+	maxSize := options.MaxSize
+
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSetSize
+	}
+
+	return minSize, maxSize
+}
+
+// restrict returns the genes of a set found in the universe using
+// the universe's names. Genes are matched case insensitively so case
+// variants of a gene in a set, e.g. Cd4 and CD4, are only used once.
+func restrict(set *GeneSet, universe map[string]string) []string {
+	ret := make([]string, 0, len(set.Genes))
+	seen := make(map[string]bool, len(set.Genes))
+
+	for _, gene := range set.Genes {
+		key := strings.ToUpper(gene)
+
+		if seen[key] {
+			continue
+		}
+
+		name, ok := universe[key]
+
+		if ok {
+			seen[key] = true
+			ret = append(ret, name)
+		}
+	}
+
+	return ret
+}
+
+// OverRepresentation tests each set of a library for enrichment in a
+// list of genes relative to a universe of background genes using the
+// hypergeometric distribution. Genes not in the universe are ignored.
+// Results are sorted by p-value.
+func OverRepresentation(genes []string,
+	universe []string,
+	library *Library,
+	options *EnrichmentOptions) ([]*OraResult, error) {
+
+	background := make(map[string]string, len(universe))
+
+	for _, gene := range universe {
+		background[strings.ToUpper(gene)] = gene
+	}
+
+	query := make(map[string]bool, len(genes))
+
+	for _, gene := range genes {
+		name, ok := background[strings.ToUpper(gene)]
+
+		if ok {
+			query[name] = true
+		}
+	}
+
+	if len(query) == 0 {
+		return nil, errors.New("none of the genes are in the universe")
+	}
+
+	minSize, maxSize := options.sizes()
+
+	N := len(background)
+	n := len(query)
+
+	ret := make([]*OraResult, 0, len(library.Sets))
+
+	for _, set := range library.Sets {
+		members := restrict(set, background)
+
+		if len(members) < minSize || len(members) > maxSize {
+			continue
+		}
+
+		result := OraResult{
+			Name:        set.Name,
+			Description: set.Description,
+			Size:        len(members),
+			Genes:       make([]string, 0, len(members)),
+		}
+
+		for _, gene := range members {
+			if query[gene] {
+				result.Genes = append(result.Genes, gene)
+			}
+		}
+
+		result.Overlap = len(result.Genes)
+		result.FoldEnrichment = float64(result.Overlap) / (float64(n) * float64(result.Size) / float64(N))
+		result.P = stats.HypergeometricSf(result.Overlap, N, result.Size, n)
+
+		ret = append(ret, &result)
+	}
+
+	adjust(ret, func(r *OraResult) *float64 { return &r.P }, func(r *OraResult) *float64 { return &r.Q })
+
+	slices.SortStableFunc(ret, func(a, b *OraResult) int {
+		return compareFloat(a.P, b.P)
+	})
+
+	return ret, nil
+}
+
+// Gsea runs a preranked gene set enrichment analysis. Genes are ranked
+// by decreasing score and each set's weighted Kolmogorov-Smirnov style
+// enrichment score is compared with those of random sets of the same
+// size to estimate normalized enrichment scores and p-values. Results
+// are sorted by p-value then by absolute NES.
+func Gsea(ranked []*RankedGene, library *Library, options *EnrichmentOptions) ([]*GseaResult, error) {
+	if len(ranked) == 0 {
+		return nil, errors.New("no ranked genes")
+	}
+
+	ranked = slices.Clone(ranked)
+
+	slices.SortStableFunc(ranked, func(a, b *RankedGene) int {
+		return compareFloat(b.Score, a.Score)
+	})
+
+	// position of each gene in the ranking
+	positions := make(map[string]int, len(ranked))
+	background := make(map[string]string, len(ranked))
+	weights := make([]float64, len(ranked))
+
+	allZero := true
+
+	for i, gene := range ranked {
+		key := strings.ToUpper(gene.Gene)
+
+		if _, ok := background[key]; ok {
+			return nil, errors.New("ranked genes must be unique")
+		}
+
+		positions[gene.Gene] = i
+		background[key] = gene.Gene
+		weights[i] = math.Abs(gene.Score)
+
+		if weights[i] != 0 {
+			allZero = false
+		}
+	}
+
+	// fall back to the unweighted statistic
+	if allZero {
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+
+	permutations := options.Permutations
+
+	if permutations <= 0 {
+		permutations = DefaultPermutations
+	}
+
+	permutations = min(permutations, MaxPermutations)
+
+	minSize, maxSize := options.sizes()
+
+	rng := rand.New(rand.NewPCG(options.Seed, options.Seed))
+
+	// sets of the same size share a null distribution
+	nulls := make(map[int][]float64)
+
+	ret := make([]*GseaResult, 0, len(library.Sets))
+
+	for _, set := range library.Sets {
+		members := restrict(set, background)
+
+		// a set containing every gene has no misses to score against
+		if len(members) < minSize || len(members) > maxSize || len(members) == len(ranked) {
+			continue
+		}
+
+		hits := make([]int, len(members))
+
+		for i, gene := range members {
+			hits[i] = positions[gene]
+		}
+
+		slices.Sort(hits)
+
+		es, peak := enrichmentScore(hits, weights)
+
+		result := GseaResult{
+			Name:        set.Name,
+			Description: set.Description,
+			Size:        len(members),
+			ES:          es,
+		}
+
+		// leading edge genes are those before the peak for a positive
+		// score and after it for a negative one
+		edge := hits[:peak+1]
+
+		if es < 0 {
+			edge = hits[peak:]
+		}
+
+		result.LeadingEdge = make([]string, len(edge))
+
+		for i, position := range edge {
+			result.LeadingEdge[i] = ranked[position].Gene
+		}
+
+		null, ok := nulls[len(members)]
+
+		if !ok {
+			null = nullScores(len(members), weights, permutations, rng)
+			nulls[len(members)] = null
+		}
+
+		result.NES, result.P = normalize(es, null)
+
+		ret = append(ret, &result)
+	}
+
+	adjust(ret, func(r *GseaResult) *float64 { return &r.P }, func(r *GseaResult) *float64 { return &r.Q })
+
+	slices.SortStableFunc(ret, func(a, b *GseaResult) int {
+		if a.P != b.P {
+			return compareFloat(a.P, b.P)
+		}
+
+		return compareFloat(math.Abs(b.NES), math.Abs(a.NES))
+	})
+
+	return ret, nil
+}
+
+// enrichmentScore returns the maximum deviation from zero of the running
+// sum statistic for a set whose genes are at the sorted positions hits
+// of a ranking with the given weights, and the index in hits of the
+// peak. The running sum only changes direction at hits so only those
+// need to be visited.
+func enrichmentScore(hits []int, weights []float64) (float64, int) {
+	var hitWeight float64
+
+	for _, position := range hits {
+		hitWeight += weights[position]
+	}
+
+	// no information if the set's genes all have zero score
+	if hitWeight == 0 {
+		return 0, 0
+	}
+
+	misses := float64(len(weights) - len(hits))
+
+	var es float64
+	var sum float64
+
+	peak := 0
+
+	for j, position := range hits {
+		// misses before this hit
+		missed := float64(position-j) / misses
+
+		// lowest point is just before a hit
+		if low := sum/hitWeight - missed; -low > math.Abs(es) {
+			es = low
+			peak = j
+		}
+
+		sum += weights[position]
+
+		// highest point is just after a hit
+		if high := sum/hitWeight - missed; high > math.Abs(es) {
+			es = high
+			peak = j
+		}
+	}
+
+	return es, peak
+}
+
+// nullScores returns the enrichment scores of random sets of size genes
+func nullScores(size int, weights []float64, permutations int, rng *rand.Rand) []float64 {
+	ret := make([]float64, permutations)
+
+	indexes := make([]int, len(weights))
+
+	for i := range indexes {
+		indexes[i] = i
+	}
+
+	hits := make([]int, size)
+
+	for p := range ret {
+		// partial Fisher-Yates shuffle to pick a random set
+		for i := range size {
+			j := i + rng.IntN(len(indexes)-i)
+			indexes[i], indexes[j] = indexes[j], indexes[i]
+		}
+
+		copy(hits, indexes[:size])
+		slices.Sort(hits)
+
+		ret[p], _ = enrichmentScore(hits, weights)
+	}
+
+	return ret
+}
+
+// normalize divides an enrichment score by the mean of the null scores
+// with the same sign and estimates its p-value from those scores
+func normalize(es float64, null []float64) (float64, float64) {
+	var sum float64
+	var count int
+	var extreme int
+
+	for _, v := range null {
+		if (es >= 0 && v >= 0) || (es < 0 && v < 0) {
+			sum += v
+			count++
+
+			if math.Abs(v) >= math.Abs(es) {
+				extreme++
+			}
+		}
+	}
+
+	p := float64(extreme+1) / float64(count+1)
+
+	if count == 0 || sum == 0 {
+		return 0, p
+	}
+
+	return es / math.Abs(sum/float64(count)), p
+}
+
+// adjust sets the Benjamini-Hochberg adjusted p-value of each result
+func adjust[T any](results []T, p func(T) *float64, q func(T) *float64) {
+	values := make([]float64, len(results))
+
+	for i, r := range results {
+		values[i] = *p(r)
+	}
+
+	for i, v := range stats.BenjaminiHochberg(values) {
+		*q(results[i]) = v
+	}
+}
+
+func compareFloat(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,186 @@
+package genesets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+type (
+	GeneSet struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Genes       []string `json:"genes"`
+	}
+
+	Library struct {
+		Name string     `json:"name"`
+		Sets []*GeneSet `json:"sets"`
+	}
+
+	LibraryInfo struct {
+		Name string `json:"name"`
+		Sets int    `json:"sets"`
+	}
+
+	// Gene set libraries stored as GMT files in a directory. Libraries
+	// are loaded on first use and then cached.
+	Libraries struct {
+		cache map[string]*Library
+		dir   string
+		mu    sync.Mutex
+	}
+)
+
+const GmtExt = ".gmt"
+
+// ParseGmt reads a GMT file where each line is a set name, a
+// description and then the genes of the set, all tab separated
+func ParseGmt(name string, r io.Reader) (*Library, error) {
+	ret := Library{Name: name, Sets: make([]*GeneSet, 0, 100)}
+
+	scanner := bufio.NewScanner(r)
+
+	// some GO sets are very long
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r\n")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		tokens := strings.Split(line, "\t")
+
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("invalid gmt line for set %s", tokens[0])
+		}
+
+		set := GeneSet{
+			Name:        tokens[0],
+			Description: tokens[1],
+			Genes:       make([]string, 0, len(tokens)-2),
+		}
+
+		seen := make(map[string]bool, len(tokens)-2)
+
+		for _, gene := range tokens[2:] {
+			gene = strings.TrimSpace(gene)
+
+			if gene != "" && !seen[gene] {
+				seen[gene] = true
+				set.Genes = append(set.Genes, gene)
+			}
+		}
+
+		ret.Sets = append(ret.Sets, &set)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ret, nil
+}
+
+func LoadGmt(file string) (*Library, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return ParseGmt(strings.TrimSuffix(filepath.Base(file), GmtExt), f)
+}
+
+func NewLibraries(dir string) *Libraries {
+	return &Libraries{dir: dir, cache: make(map[string]*Library)}
+}
+
+// Names returns the names of the available libraries, i.e. the gmt
+// files in the library directory without their extension
+func (libs *Libraries) Names() ([]string, error) {
+	entries, err := os.ReadDir(libs.dir)
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []string{}, nil
+		}
+
+		return nil, err
+	}
+
+	ret := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == GmtExt {
+			ret = append(ret, strings.TrimSuffix(entry.Name(), GmtExt))
+		}
+	}
+
+	slices.Sort(ret)
+
+	return ret, nil
+}
+
+func (libs *Libraries) List() ([]*LibraryInfo, error) {
+	names, err := libs.Names()
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*LibraryInfo, 0, len(names))
+
+	for _, name := range names {
+		library, err := libs.Get(name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, &LibraryInfo{Name: name, Sets: len(library.Sets)})
+	}
+
+	return ret, nil
+}
+
+// Get returns a library by name. Only libraries in the library
+// directory can be loaded.
+func (libs *Libraries) Get(name string) (*Library, error) {
+	libs.mu.Lock()
+	defer libs.mu.Unlock()
+
+	library, ok := libs.cache[name]
+
+	if ok {
+		return library, nil
+	}
+
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("invalid library %s", name)
+	}
+
+	library, err := LoadGmt(filepath.Join(libs.dir, name+GmtExt))
+
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("library %s not found", name)
+		}
+
+		return nil, err
+	}
+
+	libs.cache[name] = library
+
+	return library, nil
+}
@@ -0,0 +1,72 @@
+package scrna
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// Per dataset gene statistics computed at import from the gex
+	// blocks. Mean and variance include the cells with no expression.
+	GeneStats struct {
+		Mean       float64 `json:"mean"`
+		Variance   float64 `json:"variance"`
+		Dispersion float64 `json:"dispersion"`
+		// log dispersion z-scored against genes of similar mean
+		DispersionNorm float64 `json:"dispersionNorm"`
+		// fraction of cells expressing the gene
+		Fraction       float64 `json:"fraction"`
+		HighlyVariable bool    `json:"highlyVariable"`
+	}
+
+	GeneSort string
+)
+
+const (
+	GeneSortSymbol     GeneSort = "symbol"
+	GeneSortMean       GeneSort = "mean"
+	GeneSortVariance   GeneSort = "variance"
+	GeneSortDispersion GeneSort = "dispersion"
+	GeneSortFraction   GeneSort = "fraction"
+	// highly variable genes first ordered by normalized dispersion
+	GeneSortHighlyVariable GeneSort = "hvg"
+
+	DefaultGenesLimit = 100
+	MaxGenesLimit     = 50000
+)
+
+func ParseGeneSort(sort string) (GeneSort, error) {
+	switch s := GeneSort(strings.ToLower(sort)); s {
+	case "":
+		return GeneSortSymbol, nil
+	case GeneSortSymbol,
+		GeneSortMean,
+		GeneSortVariance,
+		GeneSortDispersion,
+		GeneSortFraction,
+		GeneSortHighlyVariable:
+		return s, nil
+	default:
+		return "", fmt.Errorf("unknown gene sort %s", sort)
+	}
+}
+
+// orderBy returns the sql ORDER BY clause for a sort. Statistics
+// are sorted in descending order so the most interesting genes are
+// first and ties are broken alphabetically.
+func (sort GeneSort) orderBy() string {
+	switch sort {
+	case GeneSortMean:
+		return "gs.mean DESC, g.gene_symbol"
+	case GeneSortVariance:
+		return "gs.variance DESC, g.gene_symbol"
+	case GeneSortDispersion:
+		return "gs.dispersion DESC, g.gene_symbol"
+	case GeneSortFraction:
+		return "gs.fraction DESC, g.gene_symbol"
+	case GeneSortHighlyVariable:
+		return "gs.highly_variable DESC, gs.dispersion_norm DESC, g.gene_symbol"
+	default:
+		return "g.gene_symbol"
+	}
+}
@@ -0,0 +1,104 @@
+package scrna
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+)
+
+// A dataset can have expression of more than one type, e.g. raw counts
+// and normalized values, each in its own gex files. Whole dataset scans
+// must only read one type so that each gene is seen once and values
+// are on one scale.
+
+const (
+	GexTypeCounts = "Counts"
+
+	DatasetGexTypesSql = `SELECT DISTINCT
+		gt.id,
+		gt.name
+		FROM gex gx
+		JOIN gex_types gt ON gx.gex_type_id = gt.id
+		JOIN datasets d ON gx.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY gt.id`
+)
+
+// normalized types in order of preference
+var NormalizedGexTypes = []string{"Normalized", "log1p(CPM)", "CPM"}
+
+// countsGexType returns the id of the raw counts type of a dataset
+func (sdb *ScrnaDB) countsGexType(datasetId string) (int, error) {
+	types, err := sdb.datasetGexTypes(datasetId)
+
+	if err != nil {
+		return -1, err
+	}
+
+	id, ok := types[GexTypeCounts]
+
+	if !ok {
+		return -1, fmt.Errorf("dataset %s has no raw counts", datasetId)
+	}
+
+	return id, nil
+}
+
+// normalizedGexType returns the id of the preferred normalized type of
+// a dataset, or its only type if it has no normalized values
+func (sdb *ScrnaDB) normalizedGexType(datasetId string) (int, error) {
+	types, err := sdb.datasetGexTypes(datasetId)
+
+	if err != nil {
+		return -1, err
+	}
+
+	for _, name := range NormalizedGexTypes {
+		id, ok := types[name]
+
+		if ok {
+			return id, nil
+		}
+	}
+
+	// fall back to the first type there is, usually counts
+	ids := make([]int, 0, len(types))
+
+	for _, id := range types {
+		ids = append(ids, id)
+	}
+
+	if len(ids) == 0 {
+		return -1, fmt.Errorf("no expression data found for dataset %s", datasetId)
+	}
+
+	return slices.Min(ids), nil
+}
+
+// datasetGexTypes returns the ids of the gex types of a dataset by name
+func (sdb *ScrnaDB) datasetGexTypes(datasetId string) (map[string]int, error) {
+	rows, err := sdb.db.Query(DatasetGexTypesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make(map[string]int)
+
+	for rows.Next() {
+		var id int
+		var name string
+
+		err := rows.Scan(&id, &name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret[name] = id
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,329 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/stats"
+)
+
+type (
+	HeatmapMode string
+
+	HeatmapOptions struct {
+		Mode HeatmapMode `json:"mode"`
+		// clustering whose clusters are the columns in clusters
+		// mode, the default if empty
+		Clustering string `json:"clustering"`
+		// filter selecting which cells to use
+		Filter string `json:"filter"`
+		// cells failing these are excluded
+		Qc *QcThresholds `json:"qc"`
+		// maximum number of cells to sample in cells mode
+		Cells int `json:"cells"`
+		// seed for sampling cells so that heatmaps are reproducible
+		Seed           uint64 `json:"seed"`
+		ZScore         bool   `json:"zscore"`
+		ClusterRows    bool   `json:"clusterRows"`
+		ClusterColumns bool   `json:"clusterColumns"`
+	}
+
+	HeatmapGene struct {
+		GeneId     string `json:"geneId"`
+		GeneSymbol string `json:"geneSymbol"`
+	}
+
+	// A heatmap column is either a cluster, in which case Cells is
+	// the number of cells averaged and Cell is -1, or a single cell
+	HeatmapColumn struct {
+		Name    string `json:"name,omitempty"`
+		Color   string `json:"color,omitempty"`
+		Cluster int    `json:"cluster"`
+		Cell    int    `json:"cell"`
+		Cells   int    `json:"cells"`
+	}
+
+	Heatmap struct {
+		Dataset string           `json:"dataset"`
+		Mode    HeatmapMode      `json:"mode"`
+		Genes   []*HeatmapGene   `json:"genes"`
+		Columns []*HeatmapColumn `json:"columns"`
+		// one row per gene in the order of Genes with a value
+		// for each column
+		Values [][]float64 `json:"values"`
+		// dendrograms are only returned if rows or columns were
+		// clustered; their Order gives the display order
+		RowTree    *stats.Dendrogram `json:"rowTree,omitempty"`
+		ColumnTree *stats.Dendrogram `json:"columnTree,omitempty"`
+		ZScore     bool              `json:"zscore"`
+	}
+)
+
+const (
+	// genes averaged over the cells of each cluster
+	HeatmapClusters HeatmapMode = "clusters"
+	// genes across a sample of individual cells
+	HeatmapCells HeatmapMode = "cells"
+
+	MaxHeatmapGenes     = 200
+	DefaultHeatmapCells = 1000
+	MaxHeatmapCells     = 5000
+)
+
+func ParseHeatmapMode(mode string) (HeatmapMode, error) {
+	switch strings.ToLower(mode) {
+	case "", "clusters":
+		return HeatmapClusters, nil
+	case "cells":
+		return HeatmapCells, nil
+	default:
+		return "", fmt.Errorf("unknown heatmap mode %s", mode)
+	}
+}
+
+// Build a genes x clusters or genes x cells heatmap, optionally z-scoring
+// each gene and ordering rows and columns by hierarchical clustering
+func (sdb *ScrnaDB) Heatmap(datasetId string,
+	geneIds []string,
+	options *HeatmapOptions,
+	isAdmin bool,
+	permissions []string) (*Heatmap, error) {
+
+	if len(geneIds) == 0 {
+		return nil, errors.New("no genes")
+	}
+
+	if len(geneIds) > MaxHeatmapGenes {
+		return nil, fmt.Errorf("at most %d genes can be shown", MaxHeatmapGenes)
+	}
+
+	mode, err := ParseHeatmapMode(string(options.Mode))
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	genes, err := sdb.GetGenes(datasetId, geneIds, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gex, err := sdb.orderedGex(genes, geneIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells, err := sdb.cellFilter(datasetId, options.Clustering, options.Filter, options.Qc, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := Heatmap{
+		Dataset: datasetId,
+		Mode:    mode,
+		Genes:   make([]*HeatmapGene, len(gex)),
+		Values:  make([][]float64, len(gex)),
+		ZScore:  options.ZScore,
+	}
+
+	for i, g := range gex {
+		ret.Genes[i] = &HeatmapGene{GeneId: g.GeneId, GeneSymbol: g.GeneSymbol}
+	}
+
+	// map each cell used to a column, -1 if not used
+	cellColumns := make([]int, len(cellClusters))
+
+	if mode == HeatmapClusters {
+		counts := make(map[int]int)
+
+		for i, label := range cellClusters {
+			if cells == nil || cells.Has(i) {
+				counts[label]++
+			}
+		}
+
+		// clusters with no cells after filtering are not shown
+		clusterColumns := make(map[int]int)
+
+		for _, cluster := range clusters {
+			if counts[cluster.Label] == 0 {
+				continue
+			}
+
+			clusterColumns[cluster.Label] = len(ret.Columns)
+
+			ret.Columns = append(ret.Columns, &HeatmapColumn{
+				Name:    cluster.Name,
+				Color:   cluster.Color,
+				Cluster: cluster.Label,
+				Cell:    -1,
+				Cells:   counts[cluster.Label],
+			})
+		}
+
+		for i, label := range cellClusters {
+			col, ok := clusterColumns[label]
+
+			if !ok || (cells != nil && !cells.Has(i)) {
+				col = -1
+			}
+
+			cellColumns[i] = col
+		}
+	} else {
+		ret.Columns = sampleHeatmapCells(cellClusters, cells, options)
+
+		for i := range cellColumns {
+			cellColumns[i] = -1
+		}
+
+		for col, column := range ret.Columns {
+			cellColumns[column.Cell] = col
+		}
+	}
+
+	if len(ret.Columns) == 0 {
+		return nil, errors.New("no cells selected")
+	}
+
+	for i, g := range gex {
+		row := make([]float64, len(ret.Columns))
+
+		for j, index := range g.Indexes {
+			if int(index) < len(cellColumns) && cellColumns[index] != -1 {
+				row[cellColumns[index]] += float64(g.Gex[j])
+			}
+		}
+
+		if mode == HeatmapClusters {
+			for col, column := range ret.Columns {
+				row[col] /= float64(column.Cells)
+			}
+		}
+
+		if options.ZScore {
+			zscore(row)
+		}
+
+		ret.Values[i] = row
+	}
+
+	if options.ClusterRows && len(ret.Values) > 1 {
+		ret.RowTree = stats.AverageLinkage(ret.Values)
+	}
+
+	if options.ClusterColumns && len(ret.Columns) > 1 {
+		columns := make([][]float64, len(ret.Columns))
+
+		for col := range columns {
+			columns[col] = make([]float64, len(ret.Values))
+
+			for row, values := range ret.Values {
+				columns[col][row] = values[col]
+			}
+		}
+
+		ret.ColumnTree = stats.AverageLinkage(columns)
+	}
+
+	return &ret, nil
+}
+
+// sampleHeatmapCells picks up to options.Cells of the cells passing the
+// filter at random and returns them as columns grouped by cluster
+func sampleHeatmapCells(cellClusters []int, cells *CellSet, options *HeatmapOptions) []*HeatmapColumn {
+	n := options.Cells
+
+	if n <= 0 {
+		n = DefaultHeatmapCells
+	}
+
+	n = min(n, MaxHeatmapCells)
+
+	candidates := make([]int, 0, len(cellClusters))
+
+	for i := range cellClusters {
+		if cells == nil || cells.Has(i) {
+			candidates = append(candidates, i)
+		}
+	}
+
+	if len(candidates) > n {
+		rng := rand.New(rand.NewPCG(options.Seed, options.Seed))
+
+		// partial Fisher-Yates shuffle to pick n cells
+		for i := range n {
+			j := i + rng.IntN(len(candidates)-i)
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+
+		candidates = candidates[:n]
+	}
+
+	slices.SortFunc(candidates, func(a, b int) int {
+		if cellClusters[a] != cellClusters[b] {
+			return cellClusters[a] - cellClusters[b]
+		}
+
+		return a - b
+	})
+
+	ret := make([]*HeatmapColumn, len(candidates))
+
+	for i, cell := range candidates {
+		ret[i] = &HeatmapColumn{Cluster: cellClusters[cell], Cell: cell, Cells: 1}
+	}
+
+	return ret
+}
+
+// zscore standardizes values in place to mean 0 and sd 1. Values
+// with no variance are set to 0.
+func zscore(values []float64) {
+	if len(values) == 0 {
+		return
+	}
+
+	var mean float64
+
+	for _, v := range values {
+		mean += v
+	}
+
+	mean /= float64(len(values))
+
+	var ss float64
+
+	for _, v := range values {
+		ss += (v - mean) * (v - mean)
+	}
+
+	sd := math.Sqrt(ss / float64(len(values)))
+
+	for i, v := range values {
+		if sd > 0 {
+			values[i] = (v - mean) / sd
+		} else {
+			values[i] = 0
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package scrna
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+type (
+	LassoOptions struct {
+		// embedding the polygon is in, the default umap if empty
+		Embedding string `json:"embedding"`
+		// clustering selected cells are counted by, the default if empty
+		Clustering string          `json:"clustering"`
+		Polygon    spatial.Polygon `json:"polygon"`
+		// number of top genes to return, the default if 0 and
+		// none if negative, which avoids scanning every gene
+		Genes int `json:"genes"`
+		// cells failing these are neither selected nor in the rest
+		Qc *QcThresholds `json:"qc"`
+	}
+
+	// How many cells of a cluster or sample were selected. Fraction
+	// is the fraction of the group's cells that were selected.
+	LassoGroup struct {
+		Name     string  `json:"name"`
+		Color    string  `json:"color,omitempty"`
+		Label    int     `json:"label"`
+		Cells    int     `json:"cells"`
+		Fraction float64 `json:"fraction"`
+	}
+
+	// Mean expression of a gene in the selected cells and the rest
+	// of the cells, cells without a value counting as 0
+	LassoGene struct {
+		GeneId     string  `json:"geneId"`
+		GeneSymbol string  `json:"geneSymbol"`
+		Mean       float64 `json:"mean"`
+		RestMean   float64 `json:"restMean"`
+		// fraction of selected cells expressing the gene
+		Fraction float64 `json:"fraction"`
+	}
+
+	LassoSelection struct {
+		Dataset   string `json:"dataset"`
+		Embedding string `json:"embedding"`
+		// indexes of the selected cells in the order of the
+		// cells returned by Metadata
+		Indexes  []uint32      `json:"indexes"`
+		Cells    int           `json:"cells"`
+		Clusters []*LassoGroup `json:"clusters"`
+		Samples  []*LassoGroup `json:"samples"`
+		// genes most increased in the selection relative to the
+		// rest ordered by the difference in mean
+		Genes []*LassoGene `json:"genes,omitempty"`
+	}
+)
+
+const (
+	DefaultLassoGenes = 20
+	MaxLassoGenes     = 200
+	MaxLassoVertices  = 10000
+)
+
+// Select the cells inside a polygon drawn on an embedding and summarize
+// them by cluster, sample and the genes most highly expressed in them
+// compared to the other cells
+func (sdb *ScrnaDB) Lasso(datasetId string,
+	options *LassoOptions,
+	isAdmin bool,
+	permissions []string) (*LassoSelection, error) {
+
+	if len(options.Polygon) < 3 {
+		return nil, errors.New("polygon must have at least three vertices")
+	}
+
+	if len(options.Polygon) > MaxLassoVertices {
+		return nil, fmt.Errorf("polygon can have at most %d vertices", MaxLassoVertices)
+	}
+
+	// also checks the user can view the dataset
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := sdb.spatialIndex(datasetId, options.Embedding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellSamples, err := sdb.cellSamples(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cellClusters) != tree.Len() || len(cellSamples) != tree.Len() {
+		return nil, errors.New("embedding does not match the cells")
+	}
+
+	passed, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected := NewCellSet(tree.Len())
+
+	for _, i := range options.Polygon.Within(tree) {
+		if passed == nil || passed.Has(i) {
+			selected.Add(i)
+		}
+	}
+
+	ret := LassoSelection{
+		Dataset:   datasetId,
+		Embedding: embeddingName(options.Embedding),
+		Indexes:   selected.Indexes(),
+		Clusters:  make([]*LassoGroup, 0, len(clusters)),
+		Samples:   make([]*LassoGroup, 0, 20),
+	}
+
+	ret.Cells = len(ret.Indexes)
+
+	// count the selected and total cells of each group
+	clusterGroups := make(map[int]*LassoGroup)
+
+	for _, cluster := range clusters {
+		group := LassoGroup{Name: cluster.Name, Color: cluster.Color, Label: cluster.Label}
+		clusterGroups[cluster.Label] = &group
+		ret.Clusters = append(ret.Clusters, &group)
+	}
+
+	sampleGroups := make(map[string]*LassoGroup)
+	clusterTotals := make(map[int]int)
+	sampleTotals := make(map[string]int)
+
+	for i, label := range cellClusters {
+		if passed != nil && !passed.Has(i) {
+			continue
+		}
+
+		sample := cellSamples[i]
+
+		group, ok := sampleGroups[sample]
+
+		if !ok {
+			group = &LassoGroup{Name: sample}
+			sampleGroups[sample] = group
+			ret.Samples = append(ret.Samples, group)
+		}
+
+		clusterTotals[label]++
+		sampleTotals[sample]++
+
+		if selected.Has(i) {
+			group.Cells++
+
+			if cluster, ok := clusterGroups[label]; ok {
+				cluster.Cells++
+			}
+		}
+	}
+
+	for _, group := range ret.Clusters {
+		if n := clusterTotals[group.Label]; n > 0 {
+			group.Fraction = float64(group.Cells) / float64(n)
+		}
+	}
+
+	for _, group := range ret.Samples {
+		group.Fraction = float64(group.Cells) / float64(sampleTotals[group.Name])
+	}
+
+	slices.SortFunc(ret.Samples, func(a, b *LassoGroup) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	limit := options.Genes
+
+	if limit == 0 {
+		limit = DefaultLassoGenes
+	}
+
+	limit = min(limit, MaxLassoGenes)
+
+	if limit > 0 && ret.Cells > 0 {
+		ret.Genes, err = sdb.lassoGenes(datasetId, selected, passed, limit, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &ret, nil
+}
+
+// lassoGenes scans every gene for those whose mean expression in the
+// selected cells most exceeds that in the rest
+func (sdb *ScrnaDB) lassoGenes(datasetId string,
+	selected *CellSet,
+	passed *CellSet,
+	limit int,
+	isAdmin bool,
+	permissions []string) ([]*LassoGene, error) {
+
+	n := float64(selected.Count())
+
+	rest := float64(selected.Size()) - n
+
+	if passed != nil {
+		rest = float64(passed.Count()) - n
+	}
+
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*LassoGene, 0, 1000)
+
+	err = sdb.scanGex(datasetId, gexType, isAdmin, permissions, func(gex *dat.GexGene) error {
+		var sum float64
+		var restSum float64
+		var expressed int
+
+		for i, index := range gex.Indexes {
+			cell := int(index)
+
+			switch {
+			case selected.Has(cell):
+				sum += float64(gex.Gex[i])
+
+				if gex.Gex[i] > 0 {
+					expressed++
+				}
+			case passed == nil || passed.Has(cell):
+				restSum += float64(gex.Gex[i])
+			}
+		}
+
+		if sum == 0 {
+			return nil
+		}
+
+		gene := LassoGene{
+			GeneId:     gex.GeneId,
+			GeneSymbol: gex.GeneSymbol,
+			Mean:       sum / n,
+			Fraction:   float64(expressed) / n,
+		}
+
+		if rest > 0 {
+			gene.RestMean = restSum / rest
+		}
+
+		ret = append(ret, &gene)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(ret, func(a, b *LassoGene) int {
+		da := a.Mean - a.RestMean
+		db := b.Mean - b.RestMean
+
+		switch {
+		case da > db:
+			return -1
+		case da < db:
+			return 1
+		default:
+			return strings.Compare(a.GeneSymbol, b.GeneSymbol)
+		}
+	})
+
+	if len(ret) > limit {
+		ret = ret[:limit]
+	}
+
+	return ret, nil
+}
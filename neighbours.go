@@ -0,0 +1,96 @@
+package scrna
+
+import (
+	"fmt"
+)
+
+type (
+	CellNeighbours struct {
+		Dataset    string   `json:"dataset"`
+		Cell       int      `json:"cell"`
+		Neighbours []uint32 `json:"neighbours"`
+		// edge weights in the order of the neighbours if the
+		// graph is weighted
+		Weights []float32 `json:"weights,omitempty"`
+	}
+
+	ExpandedSelection struct {
+		Dataset string `json:"dataset"`
+		Hops    int    `json:"hops"`
+		// the selected cells and those added in ascending order
+		Indexes []uint32 `json:"indexes"`
+		// number of cells added to the selection
+		Added int `json:"added"`
+	}
+)
+
+const MaxExpandHops = 10
+
+// Returns the neighbours of a cell in the dataset's neighbour graph,
+// the graph stored at import if there is one
+func (sdb *ScrnaDB) Neighbours(datasetId string, cell int, isAdmin bool, permissions []string) (*CellNeighbours, error) {
+	// check the user can view the dataset
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := sdb.neighbourGraph(datasetId, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cell < 0 || cell >= graph.Cells() {
+		return nil, fmt.Errorf("cell %d not found", cell)
+	}
+
+	return &CellNeighbours{
+		Dataset:    datasetId,
+		Cell:       cell,
+		Neighbours: graph.CellNeighbours(cell),
+		Weights:    graph.CellWeights(cell),
+	}, nil
+}
+
+// Grows a selection of cells by adding every cell within hops edges
+// of it in the neighbour graph
+func (sdb *ScrnaDB) ExpandSelection(datasetId string,
+	cells []uint32,
+	hops int,
+	isAdmin bool,
+	permissions []string) (*ExpandedSelection, error) {
+
+	if hops < 0 || hops > MaxExpandHops {
+		return nil, fmt.Errorf("hops must be between 0 and %d", MaxExpandHops)
+	}
+
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := sdb.neighbourGraph(datasetId, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cell := range cells {
+		if int(cell) >= graph.Cells() {
+			return nil, fmt.Errorf("cell %d not found", cell)
+		}
+	}
+
+	ret := ExpandedSelection{
+		Dataset: datasetId,
+		Hops:    hops,
+		Indexes: graph.Expand(cells, hops),
+	}
+
+	ret.Added = len(ret.Indexes) - NewCellSetFromIndexes(graph.Cells(), cells).Count()
+
+	return &ret, nil
+}
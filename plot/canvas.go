@@ -0,0 +1,96 @@
+package plot
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// Plots are drawn on a canvas in points with the origin at the top left
+// and y increasing downwards, as in svg. Colors with an alpha of 0 are
+// not drawn.
+type (
+	Format string
+
+	Anchor string
+
+	TextStyle struct {
+		Color  color.RGBA
+		Anchor Anchor
+		Size   float64
+		// degrees clockwise about the text's position, e.g. -90
+		// for text reading upwards
+		Rotate float64
+	}
+
+	Canvas interface {
+		Width() float64
+		Height() float64
+		Circle(x float64, y float64, r float64, fill color.RGBA)
+		Rect(x float64, y float64, w float64, h float64, fill color.RGBA)
+		Line(x1 float64, y1 float64, x2 float64, y2 float64, stroke color.RGBA, width float64)
+		Polygon(points []spatial.Point, fill color.RGBA, stroke color.RGBA, width float64)
+		Text(x float64, y float64, text string, style TextStyle)
+		// Bytes finishes the document
+		Bytes() ([]byte, error)
+	}
+)
+
+const (
+	FormatSvg Format = "svg"
+	FormatPdf Format = "pdf"
+
+	AnchorStart  Anchor = "start"
+	AnchorMiddle Anchor = "middle"
+	AnchorEnd    Anchor = "end"
+
+	fontFamily = "Helvetica, Arial, sans-serif"
+
+	// average width of a character relative to the font size, used to
+	// lay out text without font metrics
+	charWidth = 0.55
+)
+
+var (
+	Black       = color.RGBA{A: 255}
+	White       = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	Grey        = color.RGBA{R: 128, G: 128, B: 128, A: 255}
+	LightGrey   = color.RGBA{R: 220, G: 220, B: 220, A: 255}
+	Transparent = color.RGBA{}
+)
+
+func ParseFormat(format string) (Format, error) {
+	switch strings.ToLower(format) {
+	case "", "svg":
+		return FormatSvg, nil
+	case "pdf":
+		return FormatPdf, nil
+	default:
+		return "", fmt.Errorf("unknown plot format %s", format)
+	}
+}
+
+func (format Format) ContentType() string {
+	if format == FormatPdf {
+		return "application/pdf"
+	}
+
+	return "image/svg+xml"
+}
+
+// NewCanvas returns an empty canvas of the given size in points
+func NewCanvas(format Format, width float64, height float64) Canvas {
+	if format == FormatPdf {
+		return NewPdf(width, height)
+	}
+
+	return NewSvg(width, height)
+}
+
+// TextWidth estimates the width of text in points
+func TextWidth(text string, size float64) float64 {
+	return float64(utf8.RuneCountInString(text)) * size * charWidth
+}
@@ -0,0 +1,130 @@
+package plot
+
+import (
+	"fmt"
+	"math"
+)
+
+// A dot plot of genes across groups. Each dot's area shows the fraction
+// of a group's cells expressing a gene and its color the mean
+// expression, mapped to the colorbar's range.
+type DotPlot struct {
+	Genes  []string
+	Groups []Category
+	// indexed by group then gene
+	Means     [][]float64
+	Fractions [][]float64
+	Colorbar  *Colorbar
+}
+
+// fractions shown in the size legend
+var dotLegendFractions = []float64{0.25, 0.5, 0.75, 1}
+
+func (plot *DotPlot) Draw(c Canvas, style *Style) {
+	if len(plot.Genes) == 0 || len(plot.Groups) == 0 {
+		return
+	}
+
+	top := margin + drawTitle(c, style)
+
+	box := style.FontSize * swatch
+
+	left := 0.0
+
+	for _, group := range plot.Groups {
+		left = max(left, TextWidth(group.Name, style.FontSize))
+	}
+
+	left += margin + box + style.FontSize
+
+	bottom := 0.0
+
+	for _, gene := range plot.Genes {
+		bottom = max(bottom, TextWidth(gene, style.FontSize))
+	}
+
+	bottom += margin + style.FontSize*0.5
+
+	right := max(colorbarWidth(plot.Colorbar, style), TextWidth("100%", style.FontSize)+style.FontSize*3)
+
+	if style.Legend == LegendNone {
+		right = 0
+	}
+
+	cell := min((c.Width()-left-margin-right)/float64(len(plot.Genes)),
+		(c.Height()-top-bottom)/float64(len(plot.Groups)))
+
+	if cell <= 0 {
+		return
+	}
+
+	// large dots look crude so few genes leave space on the right
+	cell = min(cell, style.FontSize*3)
+
+	f := frame{x: left, y: top, w: cell * float64(len(plot.Genes)), h: cell * float64(len(plot.Groups))}
+
+	maxRadius := cell * 0.45
+
+	text := style.text()
+
+	for g, group := range plot.Groups {
+		y := f.y + (float64(g)+0.5)*cell
+
+		c.Rect(margin, y-box/2, box, box, group.Color)
+
+		text.Anchor = AnchorEnd
+		c.Text(f.x-style.FontSize*0.5, y+style.FontSize*0.35, group.Name, text)
+
+		for i := range plot.Genes {
+			fraction := plot.Fractions[g][i]
+
+			if fraction <= 0 {
+				continue
+			}
+
+			x := f.x + (float64(i)+0.5)*cell
+
+			c.Circle(x, y, maxRadius*math.Sqrt(fraction), plot.Colorbar.Color(plot.Means[g][i]))
+		}
+	}
+
+	text.Anchor = AnchorEnd
+	text.Rotate = -90
+
+	for i, gene := range plot.Genes {
+		x := f.x + (float64(i)+0.5)*cell
+
+		c.Text(x+style.FontSize*0.35, f.y+f.h+style.FontSize*0.5, gene, text)
+	}
+
+	if style.Legend == LegendNone {
+		return
+	}
+
+	legendX := f.x + f.w + margin
+
+	barHeight := min(f.h, 120.0)
+
+	drawColorbar(c, plot.Colorbar, style, legendX, f.y, barHeight)
+
+	// size legend below the colorbar
+	y := f.y + barHeight + style.FontSize*2
+
+	text = style.text()
+
+	c.Text(legendX, y, "Fraction", text)
+
+	y += style.FontSize * 0.5
+
+	for _, fraction := range dotLegendFractions {
+		r := maxRadius * math.Sqrt(fraction)
+
+		y += max(2*maxRadius, style.FontSize) + 2
+
+		c.Circle(legendX+maxRadius, y-max(maxRadius, style.FontSize/2), r, Grey)
+		c.Text(legendX+2*maxRadius+style.FontSize*0.5,
+			y-max(maxRadius, style.FontSize/2)+style.FontSize*0.35,
+			fmt.Sprintf("%d%%", int(fraction*100)),
+			text)
+	}
+}
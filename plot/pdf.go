@@ -0,0 +1,277 @@
+package plot
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// Pdf is a single page pdf using the standard Helvetica font so that
+// no fonts need to be embedded. Coordinates are flipped so that, as
+// with svg, y increases downwards.
+type Pdf struct {
+	content bytes.Buffer
+	// graphics states for each opacity used
+	alphas map[uint8]bool
+	// current state so it is only set when it changes
+	fillColor   string
+	strokeColor string
+	alpha       int
+	width       float64
+	height      float64
+}
+
+// control point distance for approximating a quarter circle with a
+// cubic bezier
+const bezierCircle = 0.5523
+
+func NewPdf(width float64, height float64) *Pdf {
+	return &Pdf{width: width, height: height, alphas: make(map[uint8]bool), alpha: -1}
+}
+
+func (pdf *Pdf) Width() float64 {
+	return pdf.width
+}
+
+func (pdf *Pdf) Height() float64 {
+	return pdf.height
+}
+
+func (pdf *Pdf) Circle(x float64, y float64, r float64, fill color.RGBA) {
+	if fill.A == 0 {
+		return
+	}
+
+	pdf.fill(fill)
+
+	y = pdf.height - y
+	k := bezierCircle * r
+
+	fmt.Fprintf(&pdf.content, "%s %s m\n", num(x+r), num(y))
+	fmt.Fprintf(&pdf.content, "%s %s %s %s %s %s c\n", num(x+r), num(y+k), num(x+k), num(y+r), num(x), num(y+r))
+	fmt.Fprintf(&pdf.content, "%s %s %s %s %s %s c\n", num(x-k), num(y+r), num(x-r), num(y+k), num(x-r), num(y))
+	fmt.Fprintf(&pdf.content, "%s %s %s %s %s %s c\n", num(x-r), num(y-k), num(x-k), num(y-r), num(x), num(y-r))
+	fmt.Fprintf(&pdf.content, "%s %s %s %s %s %s c\n", num(x+k), num(y-r), num(x+r), num(y-k), num(x+r), num(y))
+	pdf.content.WriteString("f\n")
+}
+
+func (pdf *Pdf) Rect(x float64, y float64, w float64, h float64, fill color.RGBA) {
+	if fill.A == 0 {
+		return
+	}
+
+	pdf.fill(fill)
+
+	fmt.Fprintf(&pdf.content, "%s %s %s %s re f\n", num(x), num(pdf.height-y-h), num(w), num(h))
+}
+
+func (pdf *Pdf) Line(x1 float64, y1 float64, x2 float64, y2 float64, stroke color.RGBA, width float64) {
+	if stroke.A == 0 {
+		return
+	}
+
+	pdf.stroke(stroke, width)
+
+	fmt.Fprintf(&pdf.content, "%s %s m %s %s l S\n", num(x1), num(pdf.height-y1), num(x2), num(pdf.height-y2))
+}
+
+func (pdf *Pdf) Polygon(points []spatial.Point, fill color.RGBA, stroke color.RGBA, width float64) {
+	if len(points) < 3 || (fill.A == 0 && stroke.A == 0) {
+		return
+	}
+
+	// graphics state cannot change inside a path so it must be set
+	// before the path starts
+	var op string
+
+	switch {
+	case fill.A > 0 && stroke.A > 0:
+		pdf.fill(fill)
+		pdf.stroke(stroke, width)
+		op = "b"
+	case fill.A > 0:
+		pdf.fill(fill)
+		op = "h f"
+	default:
+		pdf.stroke(stroke, width)
+		op = "s"
+	}
+
+	for i, p := range points {
+		cmd := "l"
+
+		if i == 0 {
+			cmd = "m"
+		}
+
+		fmt.Fprintf(&pdf.content, "%s %s %s\n", num(p.X), num(pdf.height-p.Y), cmd)
+	}
+
+	pdf.content.WriteString(op + "\n")
+}
+
+func (pdf *Pdf) Text(x float64, y float64, text string, style TextStyle) {
+	// pdf angles are anticlockwise with y up
+	a := -style.Rotate * math.Pi / 180
+	cos := math.Cos(a)
+	sin := math.Sin(a)
+
+	y = pdf.height - y
+
+	// pdf text always starts at its position so shift it along its
+	// direction to anchor it
+	var shift float64
+
+	switch style.Anchor {
+	case AnchorMiddle:
+		shift = -TextWidth(text, style.Size) / 2
+	case AnchorEnd:
+		shift = -TextWidth(text, style.Size)
+	}
+
+	x += shift * cos
+	y += shift * sin
+
+	pdf.fill(style.Color)
+
+	fmt.Fprintf(&pdf.content, "BT /F1 %s Tf %s %s %s %s %s %s Tm (%s) Tj ET\n",
+		num(style.Size),
+		short(cos), short(sin), short(-sin), short(cos),
+		num(x), num(y),
+		pdfString(text))
+}
+
+func (pdf *Pdf) Bytes() ([]byte, error) {
+	var stream bytes.Buffer
+
+	w := zlib.NewWriter(&stream)
+
+	_, err := w.Write(pdf.content.Bytes())
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	var states bytes.Buffer
+
+	alphas := make([]int, 0, len(pdf.alphas))
+
+	for alpha := range pdf.alphas {
+		alphas = append(alphas, int(alpha))
+	}
+
+	slices.Sort(alphas)
+
+	for _, alpha := range alphas {
+		fmt.Fprintf(&states, " /GA%d << /ca %s /CA %s >>", alpha, num(float64(alpha)/255), num(float64(alpha)/255))
+	}
+
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %s %s] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> /ExtGState <<%s >> >> >>",
+			num(pdf.width), num(pdf.height), states.String()),
+		fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", stream.Len(), stream.Bytes()),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+
+	var ret bytes.Buffer
+
+	ret.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	offsets := make([]int, len(objects))
+
+	for i, object := range objects {
+		offsets[i] = ret.Len()
+		fmt.Fprintf(&ret, "%d 0 obj\n%s\nendobj\n", i+1, object)
+	}
+
+	xref := ret.Len()
+
+	fmt.Fprintf(&ret, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+
+	for _, offset := range offsets {
+		fmt.Fprintf(&ret, "%010d 00000 n \n", offset)
+	}
+
+	fmt.Fprintf(&ret, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xref)
+
+	return ret.Bytes(), nil
+}
+
+func (pdf *Pdf) fill(c color.RGBA) {
+	pdf.setAlpha(c.A)
+
+	rgb := fmt.Sprintf("%s %s %s", channel(c.R), channel(c.G), channel(c.B))
+
+	if rgb != pdf.fillColor {
+		pdf.fillColor = rgb
+		fmt.Fprintf(&pdf.content, "%s rg\n", rgb)
+	}
+}
+
+func (pdf *Pdf) stroke(c color.RGBA, width float64) {
+	pdf.setAlpha(c.A)
+
+	rgb := fmt.Sprintf("%s w %s %s %s", num(width), channel(c.R), channel(c.G), channel(c.B))
+
+	if rgb != pdf.strokeColor {
+		pdf.strokeColor = rgb
+		fmt.Fprintf(&pdf.content, "%s RG\n", rgb)
+	}
+}
+
+func (pdf *Pdf) setAlpha(a uint8) {
+	if int(a) == pdf.alpha {
+		return
+	}
+
+	pdf.alpha = int(a)
+	pdf.alphas[a] = true
+
+	fmt.Fprintf(&pdf.content, "/GA%d gs\n", a)
+}
+
+func channel(v uint8) string {
+	return short(float64(v) / 255)
+}
+
+// short formats a value to 4 decimal places, pdf not allowing
+// exponents
+func short(v float64) string {
+	return strconv.FormatFloat(math.Round(v*10000)/10000, 'f', -1, 64)
+}
+
+// pdfString escapes text for a pdf string, replacing characters the
+// standard fonts cannot show
+func pdfString(text string) string {
+	var ret bytes.Buffer
+
+	for _, r := range text {
+		switch {
+		case r == '\\' || r == '(' || r == ')':
+			ret.WriteByte('\\')
+			ret.WriteRune(r)
+		case r >= 32 && r < 127:
+			ret.WriteRune(r)
+		case r >= 160 && r <= 255:
+			fmt.Fprintf(&ret, "\\%03o", r)
+		default:
+			ret.WriteByte('?')
+		}
+	}
+
+	return ret.String()
+}
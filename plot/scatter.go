@@ -0,0 +1,161 @@
+package plot
+
+import (
+	"image/color"
+	"slices"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// A scatter plot of cells in an embedding, colored either by category,
+// e.g. cluster, or by a value such as a gene's expression
+type ScatterPlot struct {
+	XLabel string
+	YLabel string
+	Points []spatial.Point
+	Colors []color.RGBA
+	// points are drawn in ascending order of these values, if given,
+	// so that high expressing cells are on top
+	Order []float64
+	// index of each point's category, which places labels on the data
+	Groups     []int
+	Categories []Category
+	Colorbar   *Colorbar
+	// use the same scale for x and y, e.g. for spatial coordinates
+	EqualAspect bool
+}
+
+func (plot *ScatterPlot) Draw(c Canvas, style *Style) {
+	top := margin + drawTitle(c, style)
+
+	right := colorbarWidth(plot.Colorbar, style)
+
+	var bottom float64
+
+	if plot.Colorbar == nil {
+		right, bottom = legendSize(plot.Categories, style, c.Width()-2*margin)
+	}
+
+	left := margin + style.FontSize*1.5
+
+	f := frame{
+		x: left,
+		y: top,
+		w: c.Width() - left - margin - right,
+		h: c.Height() - top - margin - style.FontSize*1.5 - bottom,
+	}
+
+	if f.w <= 0 || f.h <= 0 {
+		return
+	}
+
+	bounds := spatial.Bounds(plot.Points)
+
+	// keep points at the edge clear of the axes
+	pad := style.PointSize * 2
+
+	sx := (f.w - 2*pad) / max(bounds.Width(), 1e-9)
+	sy := (f.h - 2*pad) / max(bounds.Height(), 1e-9)
+
+	ox := f.x + pad
+	oy := f.y + pad
+
+	if plot.EqualAspect {
+		s := min(sx, sy)
+
+		ox += (f.w - 2*pad - bounds.Width()*s) / 2
+		oy += (f.h - 2*pad - bounds.Height()*s) / 2
+
+		sx = s
+		sy = s
+	}
+
+	// y increases upwards in the embedding
+	toCanvas := func(p spatial.Point) (float64, float64) {
+		return ox + (p.X-bounds.Min.X)*sx, oy + (bounds.Max.Y-p.Y)*sy
+	}
+
+	axis := color.RGBA{R: 64, G: 64, B: 64, A: 255}
+
+	c.Line(f.x, f.y+f.h, f.x+f.w, f.y+f.h, axis, 0.75)
+	c.Line(f.x, f.y, f.x, f.y+f.h, axis, 0.75)
+
+	text := style.text()
+	text.Anchor = AnchorMiddle
+
+	c.Text(f.x+f.w/2, f.y+f.h+style.FontSize*1.3, plot.XLabel, text)
+
+	text.Rotate = -90
+
+	c.Text(f.x-style.FontSize*0.5, f.y+f.h/2, plot.YLabel, text)
+
+	order := make([]int, len(plot.Points))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	if plot.Order != nil {
+		slices.SortStableFunc(order, func(a, b int) int {
+			switch {
+			case plot.Order[a] < plot.Order[b]:
+				return -1
+			case plot.Order[a] > plot.Order[b]:
+				return 1
+			default:
+				return 0
+			}
+		})
+	}
+
+	for _, i := range order {
+		x, y := toCanvas(plot.Points[i])
+
+		c.Circle(x, y, style.PointSize, plot.Colors[i])
+	}
+
+	if style.Labels == LabelsData && plot.Groups != nil {
+		plot.drawLabels(c, style, toCanvas)
+	}
+
+	if plot.Colorbar != nil {
+		drawColorbar(c, plot.Colorbar, style, f.x+f.w+margin, f.y, min(f.h, 150))
+	} else if style.Legend == LegendBottom {
+		drawLegend(c, plot.Categories, style, f.x, f.y+f.h+style.FontSize*1.5+margin, f.w)
+	} else {
+		drawLegend(c, plot.Categories, style, f.x+f.w+margin, f.y, 0)
+	}
+}
+
+// drawLabels writes the name of each category at the median position
+// of its points, which unlike the mean is inside the group even if it
+// has outlying cells
+func (plot *ScatterPlot) drawLabels(c Canvas, style *Style, toCanvas func(spatial.Point) (float64, float64)) {
+	xs := make([][]float64, len(plot.Categories))
+	ys := make([][]float64, len(plot.Categories))
+
+	for i, g := range plot.Groups {
+		if g < 0 || g >= len(plot.Categories) {
+			continue
+		}
+
+		xs[g] = append(xs[g], plot.Points[i].X)
+		ys[g] = append(ys[g], plot.Points[i].Y)
+	}
+
+	text := style.text()
+	text.Anchor = AnchorMiddle
+
+	for g, category := range plot.Categories {
+		if len(xs[g]) == 0 {
+			continue
+		}
+
+		slices.Sort(xs[g])
+		slices.Sort(ys[g])
+
+		x, y := toCanvas(spatial.Point{X: xs[g][len(xs[g])/2], Y: ys[g][len(ys[g])/2]})
+
+		c.Text(x, y+style.FontSize*0.35, category.Name, text)
+	}
+}
@@ -0,0 +1,291 @@
+package plot
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/tiles"
+)
+
+type (
+	LegendPosition string
+
+	LabelPosition string
+
+	// Options shared by all plots, sizes being in points
+	Style struct {
+		Legend LegendPosition
+		Labels LabelPosition
+		Title  string
+		// radius of the points of scatter plots
+		PointSize float64
+		FontSize  float64
+		Width     float64
+		Height    float64
+	}
+
+	// A named group, e.g. a cluster, drawn in its own color
+	Category struct {
+		Name  string
+		Color color.RGBA
+	}
+
+	// Maps values to colors for continuous legends
+	Colorbar struct {
+		Colormap tiles.Colormap
+		Label    string
+		Min      float64
+		Max      float64
+	}
+
+	// region of the canvas in which data is drawn
+	frame struct {
+		x float64
+		y float64
+		w float64
+		h float64
+	}
+)
+
+const (
+	LegendRight  LegendPosition = "right"
+	LegendBottom LegendPosition = "bottom"
+	LegendNone   LegendPosition = "none"
+
+	// cluster names are not shown on the data
+	LabelsNone LabelPosition = "none"
+	// cluster names are drawn at the centre of their cells
+	LabelsData LabelPosition = "data"
+
+	DefaultPlotSize  = 480
+	MaxPlotSize      = 5000
+	DefaultPointSize = 1
+	DefaultFontSize  = 10
+
+	margin = 10
+	// size of legend swatches relative to the font size
+	swatch = 0.8
+	// number of steps drawn in a colorbar
+	colorbarSteps = 64
+)
+
+func ParseLegendPosition(position string) (LegendPosition, error) {
+	switch strings.ToLower(position) {
+	case "", "right":
+		return LegendRight, nil
+	case "bottom":
+		return LegendBottom, nil
+	case "none":
+		return LegendNone, nil
+	default:
+		return "", fmt.Errorf("unknown legend position %s", position)
+	}
+}
+
+func ParseLabelPosition(position string) (LabelPosition, error) {
+	switch strings.ToLower(position) {
+	case "", "none":
+		return LabelsNone, nil
+	case "data":
+		return LabelsData, nil
+	default:
+		return "", fmt.Errorf("unknown label position %s", position)
+	}
+}
+
+// Normalize fills in defaults and clamps sizes to sensible values
+func (style *Style) Normalize() {
+	if style.Width <= 0 {
+		style.Width = DefaultPlotSize
+	}
+
+	if style.Height <= 0 {
+		style.Height = DefaultPlotSize
+	}
+
+	style.Width = min(style.Width, MaxPlotSize)
+	style.Height = min(style.Height, MaxPlotSize)
+
+	if style.PointSize <= 0 {
+		style.PointSize = DefaultPointSize
+	}
+
+	if style.FontSize <= 0 {
+		style.FontSize = DefaultFontSize
+	}
+
+	if style.Legend == "" {
+		style.Legend = LegendRight
+	}
+
+	if style.Labels == "" {
+		style.Labels = LabelsNone
+	}
+}
+
+func (style *Style) text() TextStyle {
+	return TextStyle{Size: style.FontSize, Color: Black}
+}
+
+// drawTitle draws the title, if any, and returns the space it takes
+func drawTitle(c Canvas, style *Style) float64 {
+	if style.Title == "" {
+		return 0
+	}
+
+	size := style.FontSize * 1.4
+
+	c.Text(c.Width()/2, margin+size, style.Title, TextStyle{Size: size, Color: Black, Anchor: AnchorMiddle})
+
+	return size * 1.5
+}
+
+// legendSize returns the space needed by a legend of categories on
+// the right or at the bottom of a plot of the given width
+func legendSize(categories []Category, style *Style, width float64) (float64, float64) {
+	if len(categories) == 0 || style.Legend == LegendNone {
+		return 0, 0
+	}
+
+	item := style.FontSize * 1.5
+
+	widest := 0.0
+
+	for _, category := range categories {
+		widest = max(widest, TextWidth(category.Name, style.FontSize))
+	}
+
+	itemWidth := style.FontSize*(swatch+0.5) + widest + margin
+
+	if style.Legend == LegendBottom {
+		perRow := max(int(width/itemWidth), 1)
+		rows := (len(categories) + perRow - 1) / perRow
+
+		return 0, float64(rows)*item + margin
+	}
+
+	return itemWidth + margin, 0
+}
+
+// drawLegend draws a legend of categories starting at x, y either as a
+// column or as rows of the given width
+func drawLegend(c Canvas, categories []Category, style *Style, x float64, y float64, width float64) {
+	if len(categories) == 0 || style.Legend == LegendNone {
+		return
+	}
+
+	item := style.FontSize * 1.5
+	box := style.FontSize * swatch
+
+	widest := 0.0
+
+	for _, category := range categories {
+		widest = max(widest, TextWidth(category.Name, style.FontSize))
+	}
+
+	itemWidth := style.FontSize*(swatch+0.5) + widest + margin
+
+	perRow := 1
+
+	if style.Legend == LegendBottom {
+		perRow = max(int(width/itemWidth), 1)
+	}
+
+	for i, category := range categories {
+		ix := x + float64(i%perRow)*itemWidth
+		iy := y + float64(i/perRow)*item
+
+		c.Rect(ix, iy, box, box, category.Color)
+		c.Text(ix+box+style.FontSize*0.5, iy+box*0.9, category.Name, style.text())
+	}
+}
+
+// Color maps a value in the colorbar's range to its colormap
+func (bar *Colorbar) Color(v float64) color.RGBA {
+	if bar.Max <= bar.Min {
+		return bar.Colormap.At(1)
+	}
+
+	return bar.Colormap.At((v - bar.Min) / (bar.Max - bar.Min))
+}
+
+// colorbarWidth is the space needed by a vertical colorbar
+func colorbarWidth(bar *Colorbar, style *Style) float64 {
+	if bar == nil || style.Legend == LegendNone {
+		return 0
+	}
+
+	labels := max(TextWidth(formatTick(bar.Max), style.FontSize),
+		TextWidth(formatTick(bar.Min), style.FontSize),
+		TextWidth(bar.Label, style.FontSize)-style.FontSize)
+
+	return style.FontSize*1.5 + labels + 2*margin
+}
+
+// drawColorbar draws a vertical colorbar of the given height with
+// its label above it
+func drawColorbar(c Canvas, bar *Colorbar, style *Style, x float64, y float64, height float64) {
+	if bar == nil || style.Legend == LegendNone || height <= 0 {
+		return
+	}
+
+	width := style.FontSize
+
+	if bar.Label != "" {
+		c.Text(x, y+style.FontSize, bar.Label, style.text())
+		y += style.FontSize * 1.5
+		height -= style.FontSize * 1.5
+	}
+
+	step := height / colorbarSteps
+
+	for i := range colorbarSteps {
+		// high values at the top
+		t := 1 - (float64(i)+0.5)/colorbarSteps
+
+		// overlap slightly so no gaps show between steps
+		c.Rect(x, y+float64(i)*step, width, step+0.5, bar.Colormap.At(t))
+	}
+
+	text := style.text()
+
+	c.Text(x+width+style.FontSize*0.5, y+style.FontSize*0.8, formatTick(bar.Max), text)
+	c.Text(x+width+style.FontSize*0.5, y+height, formatTick(bar.Min), text)
+}
+
+// niceTicks returns about n evenly spaced round values covering
+// [lo, hi]
+func niceTicks(lo float64, hi float64, n int) []float64 {
+	if hi <= lo {
+		return []float64{lo}
+	}
+
+	raw := (hi - lo) / float64(max(n, 1))
+	magnitude := math.Pow(10, math.Floor(math.Log10(raw)))
+
+	step := magnitude
+
+	for _, m := range []float64{1, 2, 5, 10} {
+		step = m * magnitude
+
+		if step >= raw {
+			break
+		}
+	}
+
+	ret := make([]float64, 0, n+2)
+
+	for v := math.Ceil(lo/step) * step; v <= hi+step*1e-9; v += step {
+		// avoid values such as 0.30000000000000004
+		ret = append(ret, math.Round(v/step)*step)
+	}
+
+	return ret
+}
+
+func formatTick(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
@@ -0,0 +1,136 @@
+package plot
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image/color"
+	"math"
+	"strconv"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+type Svg struct {
+	buf    bytes.Buffer
+	width  float64
+	height float64
+}
+
+func NewSvg(width float64, height float64) *Svg {
+	ret := Svg{width: width, height: height}
+
+	fmt.Fprintf(&ret.buf,
+		`<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s" font-family="%s">`+"\n",
+		num(width), num(height), num(width), num(height), fontFamily)
+
+	return &ret
+}
+
+func (svg *Svg) Width() float64 {
+	return svg.width
+}
+
+func (svg *Svg) Height() float64 {
+	return svg.height
+}
+
+func (svg *Svg) Circle(x float64, y float64, r float64, fill color.RGBA) {
+	if fill.A == 0 {
+		return
+	}
+
+	fmt.Fprintf(&svg.buf, `<circle cx="%s" cy="%s" r="%s"%s/>`+"\n", num(x), num(y), num(r), svgPaint("fill", fill))
+}
+
+func (svg *Svg) Rect(x float64, y float64, w float64, h float64, fill color.RGBA) {
+	if fill.A == 0 {
+		return
+	}
+
+	fmt.Fprintf(&svg.buf, `<rect x="%s" y="%s" width="%s" height="%s"%s/>`+"\n", num(x), num(y), num(w), num(h), svgPaint("fill", fill))
+}
+
+func (svg *Svg) Line(x1 float64, y1 float64, x2 float64, y2 float64, stroke color.RGBA, width float64) {
+	if stroke.A == 0 {
+		return
+	}
+
+	fmt.Fprintf(&svg.buf, `<line x1="%s" y1="%s" x2="%s" y2="%s"%s stroke-width="%s"/>`+"\n",
+		num(x1), num(y1), num(x2), num(y2), svgPaint("stroke", stroke), num(width))
+}
+
+func (svg *Svg) Polygon(points []spatial.Point, fill color.RGBA, stroke color.RGBA, width float64) {
+	if len(points) < 3 || (fill.A == 0 && stroke.A == 0) {
+		return
+	}
+
+	svg.buf.WriteString(`<polygon points="`)
+
+	for i, p := range points {
+		if i > 0 {
+			svg.buf.WriteByte(' ')
+		}
+
+		svg.buf.WriteString(num(p.X))
+		svg.buf.WriteByte(',')
+		svg.buf.WriteString(num(p.Y))
+	}
+
+	svg.buf.WriteByte('"')
+
+	if fill.A == 0 {
+		svg.buf.WriteString(` fill="none"`)
+	} else {
+		svg.buf.WriteString(svgPaint("fill", fill))
+	}
+
+	if stroke.A > 0 {
+		fmt.Fprintf(&svg.buf, `%s stroke-width="%s"`, svgPaint("stroke", stroke), num(width))
+	}
+
+	svg.buf.WriteString("/>\n")
+}
+
+func (svg *Svg) Text(x float64, y float64, text string, style TextStyle) {
+	anchor := style.Anchor
+
+	if anchor == "" {
+		anchor = AnchorStart
+	}
+
+	fmt.Fprintf(&svg.buf, `<text x="%s" y="%s" font-size="%s" text-anchor="%s"%s`,
+		num(x), num(y), num(style.Size), anchor, svgPaint("fill", style.Color))
+
+	if style.Rotate != 0 {
+		fmt.Fprintf(&svg.buf, ` transform="rotate(%s %s %s)"`, num(style.Rotate), num(x), num(y))
+	}
+
+	svg.buf.WriteByte('>')
+
+	xml.EscapeText(&svg.buf, []byte(text))
+
+	svg.buf.WriteString("</text>\n")
+}
+
+func (svg *Svg) Bytes() ([]byte, error) {
+	svg.buf.WriteString("</svg>\n")
+
+	return svg.buf.Bytes(), nil
+}
+
+func svgPaint(attr string, c color.RGBA) string {
+	ret := fmt.Sprintf(` %s="#%02x%02x%02x"`, attr, c.R, c.G, c.B)
+
+	if c.A < 255 {
+		ret += fmt.Sprintf(` %s-opacity="%s"`, attr, num(float64(c.A)/255))
+	}
+
+	return ret
+}
+
+// num formats coordinates to a hundredth of a point, which is enough
+// for print and keeps files with many cells small
+func num(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
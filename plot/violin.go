@@ -0,0 +1,230 @@
+package plot
+
+import (
+	"image/color"
+	"math"
+	"slices"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// Violin plots of the distribution of a value, e.g. a gene's
+// expression, in each group. Each violin spans the range of its
+// group's values and is scaled to the width of its slot.
+type ViolinPlot struct {
+	YLabel string
+	Groups []Category
+	// values of every cell of each group including zeros
+	Values [][]float64
+}
+
+const (
+	// points at which each density is estimated
+	violinPoints = 64
+	// fraction of a group's slot a violin can fill
+	violinWidth = 0.8
+)
+
+var violinOutline = color.RGBA{R: 64, G: 64, B: 64, A: 255}
+
+func (plot *ViolinPlot) Draw(c Canvas, style *Style) {
+	if len(plot.Groups) == 0 {
+		return
+	}
+
+	lo := math.Inf(1)
+	hi := math.Inf(-1)
+
+	for _, values := range plot.Values {
+		for _, v := range values {
+			lo = min(lo, v)
+			hi = max(hi, v)
+		}
+	}
+
+	if math.IsInf(lo, 0) {
+		lo = 0
+		hi = 1
+	}
+
+	lo = min(lo, 0)
+
+	if hi <= lo {
+		hi = lo + 1
+	}
+
+	ticks := niceTicks(lo, hi, 5)
+
+	top := margin + drawTitle(c, style)
+
+	tickWidth := 0.0
+
+	for _, tick := range ticks {
+		tickWidth = max(tickWidth, TextWidth(formatTick(tick), style.FontSize))
+	}
+
+	left := margin + style.FontSize*1.5 + tickWidth + style.FontSize*0.5
+
+	bottom := 0.0
+
+	for _, group := range plot.Groups {
+		bottom = max(bottom, TextWidth(group.Name, style.FontSize))
+	}
+
+	bottom += margin + style.FontSize*0.5
+
+	f := frame{x: left, y: top, w: c.Width() - left - margin, h: c.Height() - top - bottom}
+
+	if f.w <= 0 || f.h <= 0 {
+		return
+	}
+
+	toY := func(v float64) float64 {
+		return f.y + f.h - (v-lo)/(hi-lo)*f.h
+	}
+
+	text := style.text()
+
+	// axis and ticks
+	c.Line(f.x, f.y, f.x, f.y+f.h, violinOutline, 0.75)
+
+	text.Anchor = AnchorEnd
+
+	for _, tick := range ticks {
+		y := toY(tick)
+
+		c.Line(f.x-3, y, f.x, y, violinOutline, 0.75)
+		c.Text(f.x-style.FontSize*0.5, y+style.FontSize*0.35, formatTick(tick), text)
+	}
+
+	text.Anchor = AnchorMiddle
+	text.Rotate = -90
+
+	c.Text(margin+style.FontSize, f.y+f.h/2, plot.YLabel, text)
+
+	slot := f.w / float64(len(plot.Groups))
+
+	text.Anchor = AnchorEnd
+
+	for g, group := range plot.Groups {
+		x := f.x + (float64(g)+0.5)*slot
+
+		c.Text(x+style.FontSize*0.35, f.y+f.h+style.FontSize*0.5, group.Name, text)
+
+		if g >= len(plot.Values) || len(plot.Values[g]) == 0 {
+			continue
+		}
+
+		values := slices.Clone(plot.Values[g])
+
+		slices.Sort(values)
+
+		half := slot * violinWidth / 2
+
+		ys, widths := density(values)
+
+		if ys == nil {
+			// all values are the same so draw a line
+			y := toY(values[0])
+
+			c.Line(x-half, y, x+half, y, group.Color, 2)
+			continue
+		}
+
+		outline := make([]spatial.Point, 0, 2*len(ys))
+
+		for i, v := range ys {
+			outline = append(outline, spatial.Point{X: x + widths[i]*half, Y: toY(v)})
+		}
+
+		for i := len(ys) - 1; i >= 0; i-- {
+			outline = append(outline, spatial.Point{X: x - widths[i]*half, Y: toY(ys[i])})
+		}
+
+		c.Polygon(outline, group.Color, violinOutline, 0.5)
+
+		median := toY(values[len(values)/2])
+
+		c.Line(x-half*0.3, median, x+half*0.3, median, Black, 1.5)
+	}
+}
+
+// density estimates the density of sorted values with a gaussian
+// kernel and Silverman's bandwidth, returning where it was estimated
+// and the density scaled so its maximum is 1. It returns nil if the
+// values are all the same.
+func density(values []float64) ([]float64, []float64) {
+	n := len(values)
+
+	lo := values[0]
+	hi := values[n-1]
+
+	if hi <= lo {
+		return nil, nil
+	}
+
+	mean := 0.0
+
+	for _, v := range values {
+		mean += v
+	}
+
+	mean /= float64(n)
+
+	variance := 0.0
+
+	for _, v := range values {
+		variance += (v - mean) * (v - mean)
+	}
+
+	sd := math.Sqrt(variance / float64(max(n-1, 1)))
+
+	iqr := values[3*n/4] - values[n/4]
+
+	spread := sd
+
+	if iqr > 0 {
+		spread = min(sd, iqr/1.34)
+	}
+
+	bw := 0.9 * spread * math.Pow(float64(n), -0.2)
+
+	if bw <= 0 {
+		bw = (hi - lo) / violinPoints
+	}
+
+	ys := make([]float64, violinPoints)
+	ds := make([]float64, violinPoints)
+
+	peak := 0.0
+
+	for i := range ys {
+		y := lo + (hi-lo)*float64(i)/(violinPoints-1)
+
+		// values beyond 4 bandwidths add almost nothing so only
+		// those within them are summed
+		start, _ := slices.BinarySearch(values, y-4*bw)
+
+		d := 0.0
+
+		for _, v := range values[start:] {
+			if v > y+4*bw {
+				break
+			}
+
+			z := (y - v) / bw
+			d += math.Exp(-0.5 * z * z)
+		}
+
+		ys[i] = y
+		ds[i] = d
+
+		peak = max(peak, d)
+	}
+
+	for i := range ds {
+		ds[i] /= peak
+	}
+
+	return ys, ds
+}
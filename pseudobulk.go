@@ -0,0 +1,429 @@
+package scrna
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-web/auth/sqlite"
+	"github.com/apache/arrow-go/v18/arrow"
+	"github.com/apache/arrow-go/v18/arrow/array"
+	"github.com/apache/arrow-go/v18/arrow/ipc"
+	"github.com/apache/arrow-go/v18/arrow/memory"
+)
+
+type (
+	PseudobulkMethod string
+
+	PseudobulkGroup struct {
+		Sample  string `json:"sample"`
+		Cluster int    `json:"cluster"`
+		Cells   int    `json:"cells"`
+	}
+
+	PseudobulkGene struct {
+		GeneId     string    `json:"geneId"`
+		GeneSymbol string    `json:"geneSymbol"`
+		Values     []float64 `json:"values"`
+	}
+
+	// Expression of every gene aggregated over the cells of each
+	// (sample, cluster) group. The values of each gene are in the
+	// same order as the groups.
+	Pseudobulk struct {
+		Dataset string             `json:"dataset"`
+		Method  PseudobulkMethod   `json:"method"`
+		Groups  []*PseudobulkGroup `json:"groups"`
+		Genes   []*PseudobulkGene  `json:"genes"`
+	}
+
+	pseudobulkKey struct {
+		sample  string
+		cluster int
+	}
+)
+
+const (
+	PseudobulkSum  PseudobulkMethod = "sum"
+	PseudobulkMean PseudobulkMethod = "mean"
+
+	CellSamplesSql = `SELECT
+		s.name
+		FROM cells c
+		JOIN samples s ON c.sample_id = s.id
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+
+	GexFilesSql = `SELECT DISTINCT
+		f.id,
+		f.url
+		FROM gex
+		JOIN files f ON gex.file_id = f.id
+		JOIN datasets d ON gex.dataset_id = d.id
+		JOIN dataset_permissions dp ON d.id = dp.dataset_id
+		JOIN permissions p ON dp.permission_id = p.id
+		WHERE
+			<<PERMISSIONS>>
+			AND d.public_id = :id
+			AND gex.gex_type_id = :gex_type
+		ORDER BY f.id`
+)
+
+func ParsePseudobulkMethod(method string) (PseudobulkMethod, error) {
+	switch strings.ToLower(method) {
+	case "", "sum":
+		return PseudobulkSum, nil
+	case "mean":
+		return PseudobulkMean, nil
+	default:
+		return "", fmt.Errorf("unknown pseudobulk method %s", method)
+	}
+}
+
+// Aggregate every gene over the cells of each (sample, cluster) group,
+// the clusters being those of a clustering. Groups with fewer than
+// minCells cells are dropped. If filter is not empty only the cells it
+// selects are aggregated and cells failing the QC thresholds and those
+// not in the clustering are always excluded.
+func (sdb *ScrnaDB) Pseudobulk(datasetId string,
+	method PseudobulkMethod,
+	minCells int,
+	clustering string,
+	filter string,
+	qc *QcThresholds,
+	isAdmin bool,
+	permissions []string) (*Pseudobulk, error) {
+
+	samples, err := sdb.cellSamples(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	clusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(samples) != len(clusters) {
+		return nil, errors.New("cell samples and clusters do not match")
+	}
+
+	cells, err := sdb.cellFilter(datasetId, clustering, filter, qc, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// map each cell to the index of its group or -1 if the cell
+	// is not being aggregated
+	groups := make([]*PseudobulkGroup, 0, 100)
+	groupMap := make(map[pseudobulkKey]int)
+	cellGroups := make([]int, len(samples))
+
+	for i, sample := range samples {
+		if (cells != nil && !cells.Has(i)) || clusters[i] == -1 {
+			cellGroups[i] = -1
+			continue
+		}
+
+		key := pseudobulkKey{sample: sample, cluster: clusters[i]}
+
+		g, ok := groupMap[key]
+
+		if !ok {
+			g = len(groups)
+			groupMap[key] = g
+			groups = append(groups, &PseudobulkGroup{Sample: sample, Cluster: clusters[i]})
+		}
+
+		groups[g].Cells++
+		cellGroups[i] = g
+	}
+
+	// sums must be of raw counts, e.g. for DESeq2, whereas means
+	// are of the normalized values
+	var gexType int
+
+	if method == PseudobulkSum {
+		gexType, err = sdb.countsGexType(datasetId)
+	} else {
+		gexType, err = sdb.normalizedGexType(datasetId)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	genes := make([]*PseudobulkGene, 0, 30000)
+
+	err = sdb.scanGex(datasetId, gexType, isAdmin, permissions, func(gex *dat.GexGene) error {
+		values := make([]float64, len(groups))
+
+		for i, index := range gex.Indexes {
+			if int(index) < len(cellGroups) && cellGroups[index] != -1 {
+				values[cellGroups[index]] += float64(gex.Gex[i])
+			}
+		}
+
+		genes = append(genes, &PseudobulkGene{
+			GeneId:     gex.GeneId,
+			GeneSymbol: gex.GeneSymbol,
+			Values:     values,
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// sort groups by sample then cluster and drop any that are too
+	// small, remembering where each group's values came from
+	order := make([]int, 0, len(groups))
+
+	for g, group := range groups {
+		if group.Cells >= minCells {
+			order = append(order, g)
+		}
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		if groups[a].Sample != groups[b].Sample {
+			return strings.Compare(groups[a].Sample, groups[b].Sample)
+		}
+
+		return groups[a].Cluster - groups[b].Cluster
+	})
+
+	ret := Pseudobulk{
+		Dataset: datasetId,
+		Method:  method,
+		Groups:  make([]*PseudobulkGroup, len(order)),
+		Genes:   genes,
+	}
+
+	for i, g := range order {
+		ret.Groups[i] = groups[g]
+	}
+
+	for _, gene := range genes {
+		values := make([]float64, len(order))
+
+		for i, g := range order {
+			values[i] = gene.Values[g]
+
+			if method == PseudobulkMean {
+				values[i] /= float64(groups[g].Cells)
+			}
+		}
+
+		gene.Values = values
+	}
+
+	return &ret, nil
+}
+
+// Write the pseudobulk matrix as a tab separated table with a row
+// for each gene and a column for each sample:cluster group
+func (pb *Pseudobulk) WriteTsv(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	bw.WriteString("Gene ID\tGene Symbol")
+
+	for _, group := range pb.Groups {
+		fmt.Fprintf(bw, "\t%s:%d", group.Sample, group.Cluster)
+	}
+
+	bw.WriteString("\n")
+
+	for _, gene := range pb.Genes {
+		bw.WriteString(gene.GeneId)
+		bw.WriteString("\t")
+		bw.WriteString(gene.GeneSymbol)
+
+		for _, v := range gene.Values {
+			fmt.Fprintf(bw, "\t%g", v)
+		}
+
+		bw.WriteString("\n")
+	}
+
+	return bw.Flush()
+}
+
+// Write the pseudobulk matrix as an Arrow IPC file with the same
+// layout as the tsv, i.e. gene id and symbol columns followed by a
+// float64 column for each sample:cluster group
+func (pb *Pseudobulk) WriteArrow(w io.Writer) error {
+	fields := make([]arrow.Field, 0, len(pb.Groups)+2)
+
+	fields = append(fields,
+		arrow.Field{Name: "Gene ID", Type: arrow.BinaryTypes.String},
+		arrow.Field{Name: "Gene Symbol", Type: arrow.BinaryTypes.String})
+
+	for _, group := range pb.Groups {
+		fields = append(fields, arrow.Field{
+			Name: fmt.Sprintf("%s:%d", group.Sample, group.Cluster),
+			Type: arrow.PrimitiveTypes.Float64,
+		})
+	}
+
+	schema := arrow.NewSchema(fields, nil)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+
+	ids := builder.Field(0).(*array.StringBuilder)
+	symbols := builder.Field(1).(*array.StringBuilder)
+
+	for _, gene := range pb.Genes {
+		ids.Append(gene.GeneId)
+		symbols.Append(gene.GeneSymbol)
+
+		for i, v := range gene.Values {
+			builder.Field(i + 2).(*array.Float64Builder).Append(v)
+		}
+	}
+
+	record := builder.NewRecordBatch()
+	defer record.Release()
+
+	fw, err := ipc.NewFileWriter(w, ipc.WithSchema(schema))
+
+	if err != nil {
+		return err
+	}
+
+	err = fw.Write(record)
+
+	if err != nil {
+		fw.Close()
+		return err
+	}
+
+	return fw.Close()
+}
+
+// scanGex reads every gene of one gex type of a dataset block by
+// block calling fn on each. This is the preferred way to process all
+// genes as it avoids seeking to each gene individually.
+func (sdb *ScrnaDB) scanGex(datasetId string, gexType int, isAdmin bool, permissions []string, fn func(gex *dat.GexGene) error) error {
+	files, err := sdb.gexFiles(datasetId, gexType, isAdmin, permissions)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err := scanGexBlock(filepath.Join(sdb.dir, file), fn)
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanGexBlock(file string, fn func(gex *dat.GexGene) error) error {
+	br, err := dat.OpenGexBlock(file)
+
+	if err != nil {
+		return err
+	}
+
+	defer br.Close()
+
+	for {
+		gex, err := br.Next()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(gex)
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// gexFiles returns the urls of the gex block files of one gex type
+// of a dataset the user is allowed to view
+func (sdb *ScrnaDB) gexFiles(datasetId string, gexType int, isAdmin bool, permissions []string) ([]string, error) {
+	namedArgs := []any{sql.Named("id", datasetId), sql.Named("gex_type", gexType)}
+
+	query := sqlite.MakePermissionsSql(GexFilesSql, isAdmin, permissions, &namedArgs)
+
+	rows, err := sdb.db.Query(query, namedArgs...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]string, 0, 20)
+
+	for rows.Next() {
+		var id int
+		var url string
+
+		err := rows.Scan(&id, &url)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, url)
+	}
+
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("no expression data found for dataset %s", datasetId)
+	}
+
+	return ret, nil
+}
+
+// cellSamples returns the sample name of each cell in the same
+// order as the cell indexes used by the gex files
+func (sdb *ScrnaDB) cellSamples(datasetId string) ([]string, error) {
+	rows, err := sdb.db.Query(CellSamplesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]string, 0, 10000)
+
+	for rows.Next() {
+		var name string
+
+		err := rows.Scan(&name)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, name)
+	}
+
+	return ret, nil
+}
@@ -0,0 +1,160 @@
+package scrna
+
+import (
+	"database/sql"
+)
+
+type (
+	// Standard quality control metrics of a cell. Metrics not
+	// supplied at import are nil.
+	CellQc struct {
+		// total UMIs, e.g. nCount_RNA
+		Counts *int `json:"counts,omitempty"`
+		// number of genes detected, e.g. nFeature_RNA
+		Features     *int     `json:"features,omitempty"`
+		PercentMito  *float64 `json:"percentMito,omitempty"`
+		DoubletScore *float64 `json:"doubletScore,omitempty"`
+	}
+
+	// Thresholds for excluding low quality cells. Unset thresholds
+	// are ignored and cells missing a metric are never excluded by
+	// it. Form tags allow thresholds to be passed as query params.
+	QcThresholds struct {
+		MinCounts       *float64 `json:"minCounts,omitempty" form:"minCounts"`
+		MaxCounts       *float64 `json:"maxCounts,omitempty" form:"maxCounts"`
+		MinFeatures     *float64 `json:"minFeatures,omitempty" form:"minFeatures"`
+		MaxFeatures     *float64 `json:"maxFeatures,omitempty" form:"maxFeatures"`
+		MaxPercentMito  *float64 `json:"maxPercentMito,omitempty" form:"maxPercentMito"`
+		MaxDoubletScore *float64 `json:"maxDoubletScore,omitempty" form:"maxDoubletScore"`
+	}
+)
+
+const (
+	CellQcSql = `SELECT
+		c.n_counts,
+		c.n_features,
+		c.percent_mito,
+		c.doublet_score
+		FROM cells c
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+)
+
+// IsEmpty returns true if no thresholds are set, including when
+// t is nil
+func (t *QcThresholds) IsEmpty() bool {
+	return t == nil || (t.MinCounts == nil &&
+		t.MaxCounts == nil &&
+		t.MinFeatures == nil &&
+		t.MaxFeatures == nil &&
+		t.MaxPercentMito == nil &&
+		t.MaxDoubletScore == nil)
+}
+
+// Passes returns true if a cell is not excluded by any threshold
+func (t *QcThresholds) Passes(qc *CellQc) bool {
+	if t.IsEmpty() || qc == nil {
+		return true
+	}
+
+	if qc.Counts != nil {
+		counts := float64(*qc.Counts)
+
+		if (t.MinCounts != nil && counts < *t.MinCounts) ||
+			(t.MaxCounts != nil && counts > *t.MaxCounts) {
+			return false
+		}
+	}
+
+	if qc.Features != nil {
+		features := float64(*qc.Features)
+
+		if (t.MinFeatures != nil && features < *t.MinFeatures) ||
+			(t.MaxFeatures != nil && features > *t.MaxFeatures) {
+			return false
+		}
+	}
+
+	if qc.PercentMito != nil && t.MaxPercentMito != nil && *qc.PercentMito > *t.MaxPercentMito {
+		return false
+	}
+
+	if qc.DoubletScore != nil && t.MaxDoubletScore != nil && *qc.DoubletScore > *t.MaxDoubletScore {
+		return false
+	}
+
+	return true
+}
+
+// qcCells returns the cells of a dataset passing the thresholds or
+// nil if there are no thresholds so that callers can skip filtering
+func (sdb *ScrnaDB) qcCells(datasetId string, thresholds *QcThresholds) (*CellSet, error) {
+	if thresholds.IsEmpty() {
+		return nil, nil
+	}
+
+	rows, err := sdb.db.Query(CellQcSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	passes := make([]bool, 0, 10000)
+
+	for rows.Next() {
+		var counts sql.NullInt64
+		var features sql.NullInt64
+		var mito sql.NullFloat64
+		var doublet sql.NullFloat64
+
+		err := rows.Scan(&counts, &features, &mito, &doublet)
+
+		if err != nil {
+			return nil, err
+		}
+
+		passes = append(passes, thresholds.Passes(newCellQc(counts, features, mito, doublet)))
+	}
+
+	ret := NewCellSet(len(passes))
+
+	for i, ok := range passes {
+		if ok {
+			ret.Add(i)
+		}
+	}
+
+	return ret, nil
+}
+
+// newCellQc returns the metrics of a cell or nil if it has none
+func newCellQc(counts sql.NullInt64, features sql.NullInt64, mito sql.NullFloat64, doublet sql.NullFloat64) *CellQc {
+	if !counts.Valid && !features.Valid && !mito.Valid && !doublet.Valid {
+		return nil
+	}
+
+	var ret CellQc
+
+	if counts.Valid {
+		v := int(counts.Int64)
+		ret.Counts = &v
+	}
+
+	if features.Valid {
+		v := int(features.Int64)
+		ret.Features = &v
+	}
+
+	if mito.Valid {
+		ret.PercentMito = &mito.Float64
+	}
+
+	if doublet.Valid {
+		ret.DoubletScore = &doublet.Float64
+	}
+
+	return &ret
+}
@@ -2,9 +2,15 @@ package routes
 
 import (
 	"errors"
+	"net/http"
 	"strconv"
+	"strings"
 
+	"github.com/antonybholmes/go-scrna"
+	"github.com/antonybholmes/go-scrna/genesets"
+	"github.com/antonybholmes/go-scrna/plot"
 	scrnadbcache "github.com/antonybholmes/go-scrna/scrnadb"
+	"github.com/antonybholmes/go-scrna/tiles"
 	"github.com/antonybholmes/go-sys/log"
 	"github.com/antonybholmes/go-sys/query"
 	"github.com/antonybholmes/go-web"
@@ -16,6 +22,67 @@ import (
 const DefaultLimit int = 20
 
 type ScrnaParams struct {
+	scrna.GexOptions
+	Genes []string `json:"genes"`
+}
+
+type CoexpressionParams struct {
+	Genes      []string            `json:"genes"`
+	Thresholds []float32           `json:"thresholds"`
+	Clustering string              `json:"clustering"`
+	Filter     string              `json:"filter"`
+	Qc         *scrna.QcThresholds `json:"qc"`
+}
+
+type CorrelationParams struct {
+	Gene       string              `json:"gene"`
+	Method     string              `json:"method"`
+	Limit      int                 `json:"limit"`
+	Clustering string              `json:"clustering"`
+	Clusters   []int               `json:"clusters"`
+	Filter     string              `json:"filter"`
+	Qc         *scrna.QcThresholds `json:"qc"`
+}
+
+type CellFilterParams struct {
+	// clustering the cluster field refers to, the default if empty
+	Clustering string `json:"clustering"`
+	Filter     string `json:"filter"`
+	// return a bitmap rather than a list of indexes
+	Bitmap bool `json:"bitmap"`
+}
+
+type OraParams struct {
+	genesets.EnrichmentOptions
+	Library string   `json:"library"`
+	Genes   []string `json:"genes"`
+}
+
+type GseaParams struct {
+	genesets.EnrichmentOptions
+	Library string                 `json:"library"`
+	Genes   []*genesets.RankedGene `json:"genes"`
+}
+
+type AcceptAnnotationParams struct {
+	// cell type to accept, the best suggestion if empty
+	Name       string `json:"name"`
+	Clustering string `json:"clustering"`
+	Cluster    int    `json:"cluster"`
+}
+
+type TrajectoryCurveParams struct {
+	scrna.TrajectoryCurveOptions
+	Genes []string `json:"genes"`
+}
+
+type ExpandSelectionParams struct {
+	Cells []uint32 `json:"cells"`
+	Hops  int      `json:"hops"`
+}
+
+type HeatmapParams struct {
+	scrna.HeatmapOptions
 	Genes []string `json:"genes"`
 }
 
@@ -169,7 +236,7 @@ func ScrnaGexRoute(c *gin.Context) {
 		log.Debug().Msgf("getting gex for dataset %s genes=%v", datasetId, params.Genes)
 
 		// default to rna-seq
-		ret, err := scrnadbcache.Gex(datasetId, params.Genes, isAdmin, user.Permissions)
+		ret, err := scrnadbcache.Gex(datasetId, params.Genes, &params.GexOptions, isAdmin, user.Permissions)
 
 		if err != nil {
 			c.Error(err)
@@ -180,65 +247,1124 @@ func ScrnaGexRoute(c *gin.Context) {
 	})
 }
 
-// func ScrnaMetadataRoute(c *gin.Context) {
-// 	publicId := c.Param("id")
+// Classifies cells by which of two or more genes they express
+// and counts the classes in each cluster
+func ScrnaCoexpressionRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
 
-// 	if publicId == "" {
-// 		c.Error(fmt.Errorf("missing id"))
-// 		return
-// 	}
+		datasetId := c.Param("dataset")
 
-// 	ret, err := scrnadbcache.Metadata(publicId)
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
 
-// 	if err != nil {
-// 		c.Error(err)
-// 		return
-// 	}
+		var params CoexpressionParams
 
-// 	web.MakeDataResp(c, "", ret)
-// }
+		err := c.Bind(&params)
 
-func ScrnaMetadataRoute(c *gin.Context) {
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Coexpression(datasetId, params.Genes, params.Thresholds, params.Clustering, params.Filter, params.Qc, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Sums or averages every gene over the cells of each sample and
+// cluster, optionally only using the cells selected by a filter.
+// Use format=tsv or format=arrow to download the matrix as a table.
+func ScrnaPseudobulkRoute(c *gin.Context) {
 	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
 
 		datasetId := c.Param("dataset")
 
 		if datasetId == "" {
-			c.Error(errors.New("missing dataset id"))
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		method, err := scrna.ParsePseudobulkMethod(c.Query("method"))
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		minCells := 0
+
+		if c.Query("minCells") != "" {
+			minCells, err = strconv.Atoi(c.Query("minCells"))
+
+			if err != nil {
+				c.Error(err)
+				return
+			}
+		}
+
+		// qc thresholds are query params such as maxPercentMito=10
+		var qc scrna.QcThresholds
+
+		err = c.BindQuery(&qc)
+
+		if err != nil {
+			c.Error(err)
 			return
 		}
 
-		ret, err := scrnadbcache.Metadata(datasetId, isAdmin, user.Permissions)
+		ret, err := scrnadbcache.Pseudobulk(datasetId, method, minCells, c.Query("clustering"), c.Query("filter"), &qc, isAdmin, user.Permissions)
 
 		if err != nil {
 			c.Error(err)
 			return
 		}
 
+		if c.Query("format") == "tsv" {
+			c.Header("Content-Type", "text/tab-separated-values")
+			c.Header("Content-Disposition", "attachment; filename=\"pseudobulk.tsv\"")
+
+			err = ret.WriteTsv(c.Writer)
+
+			if err != nil {
+				c.Error(err)
+			}
+
+			return
+		}
+
+		if c.Query("format") == "arrow" {
+			c.Header("Content-Type", "application/vnd.apache.arrow.file")
+			c.Header("Content-Disposition", "attachment; filename=\"pseudobulk.arrow\"")
+
+			err = ret.WriteArrow(c.Writer)
+
+			if err != nil {
+				c.Error(err)
+			}
+
+			return
+		}
+
 		web.MakeDataResp(c, "", ret)
 	})
 }
 
-// func ScrnaGenesRoute(c *gin.Context) {
-// 	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *auth.AuthUserJwtClaims) {
+// Finds the genes most correlated with a query gene. If the client
+// accepts text/event-stream, progress events are streamed while the
+// dataset is scanned followed by a results event. The scan stops if
+// the client disconnects.
+func ScrnaCorrelatedGenesRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
 
-// 		datasetId := c.Param("dataset")
+		datasetId := c.Param("dataset")
 
-// 		if datasetId == "" {
-// 			c.Error(errors.New("missing dataset id"))
-// 			return
-// 		}
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
 
-// 		ret, err := scrnadbcache.Genes(datasetId, isAdmin, user.Permissions)
+		var params CorrelationParams
 
-// 		if err != nil {
-// 			c.Error(err)
-// 			return
-// 		}
+		err := c.Bind(&params)
 
-// 		web.MakeDataResp(c, "", ret)
-// 	})
-// }
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if params.Gene == "" {
+			c.Error(errors.New("missing gene"))
+			return
+		}
+
+		method, err := scrna.ParseCorrelationMethod(params.Method)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		stream := strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+
+		var progress scrna.ProgressFunc
+
+		if stream {
+			progress = func(done int, total int) {
+				c.SSEvent("progress", gin.H{"done": done, "total": total})
+				c.Writer.Flush()
+			}
+		}
+
+		ret, err := scrnadbcache.CorrelatedGenes(c.Request.Context(),
+			datasetId,
+			params.Gene,
+			method,
+			params.Limit,
+			params.Clustering,
+			params.Clusters,
+			params.Filter,
+			params.Qc,
+			progress,
+			isAdmin,
+			user.Permissions)
+
+		if err != nil {
+			if stream {
+				c.SSEvent("error", err.Error())
+				return
+			}
+
+			c.Error(err)
+			return
+		}
+
+		if stream {
+			c.SSEvent("results", ret)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Gates cells using a boolean filter over expression, cluster and
+// sample, e.g. CD19 > 1 AND cluster IN (3,5), and returns the
+// matching cells
+func ScrnaFilterCellsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params CellFilterParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		if params.Filter == "" {
+			c.Error(errors.New("missing filter"))
+			return
+		}
+
+		ret, err := scrnadbcache.FilterCells(datasetId, params.Clustering, params.Filter, params.Bitmap, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns a genes x clusters or genes x cells matrix for a heatmap
+// with optional z-scoring and row/column clustering
+func ScrnaHeatmapRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params HeatmapParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Heatmap(datasetId, params.Genes, &params.HeatmapOptions, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns the number of cells of each sample in each cluster with an
+// optional test for differences in cluster proportions between samples
+func ScrnaCompositionRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.CompositionOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Composition(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Lists the gene set libraries available for enrichment
+func ScrnaGeneSetLibrariesRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		ret, err := scrnadbcache.GeneSetLibraries()
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Tests a gene list, e.g. cluster markers, for over-representation
+// of the sets in a library
+func ScrnaOverRepresentationRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params OraParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.OverRepresentation(datasetId,
+			params.Library,
+			params.Genes,
+			&params.EnrichmentOptions,
+			isAdmin,
+			user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Runs a preranked GSEA of a library against genes with scores,
+// e.g. log fold changes
+func ScrnaGseaRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params GseaParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Gsea(datasetId,
+			params.Library,
+			params.Genes,
+			&params.EnrichmentOptions,
+			isAdmin,
+			user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns S and G2M scores and the inferred cell-cycle phase of
+// each cell
+func ScrnaCellCycleRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.CellCycleOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.CellCycle(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Suggests cell types for each cluster by correlation with a
+// reference and saves the suggestions if the user is an admin
+func ScrnaAnnotateClustersRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.AnnotationOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.AnnotateClusters(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+func ScrnaClusterAnnotationsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		ret, err := scrnadbcache.ClusterAnnotations(datasetId, c.Query("clustering"), isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Renames a cluster to an accepted cell type, admins only
+func ScrnaAcceptClusterAnnotationRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params AcceptAnnotationParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		params.Name, err = scrnadbcache.AcceptClusterAnnotation(datasetId, params.Clustering, params.Cluster, params.Name, isAdmin)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", params)
+	})
+}
+
+// Returns smoothed expression against pseudotime for each lineage
+// of a trajectory
+func ScrnaTrajectoryCurvesRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		trajectoryId := c.Param("trajectory")
+
+		if trajectoryId == "" {
+			c.Error(errors.New("missing trajectory"))
+			return
+		}
+
+		var params TrajectoryCurveParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.TrajectoryCurves(datasetId,
+			trajectoryId,
+			params.Genes,
+			&params.TrajectoryCurveOptions,
+			isAdmin,
+			user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns rna velocity averaged over a grid on the embedding
+func ScrnaVelocityGridRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.VelocityGridOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.VelocityGrid(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Lists the clusterings of a dataset, the default first
+func ScrnaClusteringsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		ret, err := scrnadbcache.Clusterings(datasetId, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Lists the embeddings of a dataset
+func ScrnaEmbeddingsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		ret, err := scrnadbcache.Embeddings(datasetId, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns the coordinates of every cell in an embedding
+func ScrnaEmbeddingRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		name := c.Param("embedding")
+
+		if name == "" {
+			c.Error(errors.New("missing embedding"))
+			return
+		}
+
+		ret, err := scrnadbcache.Embedding(datasetId, name, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Selects the cells inside a polygon drawn on an embedding and
+// summarizes them
+func ScrnaLassoRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.LassoOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Lasso(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Aggregates the cells of an embedding into hexagonal or square
+// bins for drawing zoomed out views of large datasets
+func ScrnaBinsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.BinOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Bins(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns the cells inside the visible region of an embedding
+func ScrnaRegionRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.RegionOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Region(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns a png tile of an embedding for routes of the form
+// /tiles/:dataset/:embedding/:z/:x/:y.png, cells being colored by
+// cluster or by a gene's expression, e.g. ?gene=CD19&colormap=magma
+func ScrnaTileRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		tile, err := parseTile(c)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		var params scrna.TileOptions
+
+		err = c.BindQuery(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		data, err := scrnadbcache.Tile(datasetId, c.Param("embedding"), tile, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Data(http.StatusOK, "image/png", data)
+	})
+}
+
+// Returns the tissue image of a spatial dataset and the scale factors
+// relating it to the spatial embedding
+func ScrnaSpatialImageRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		ret, err := scrnadbcache.SpatialImage(datasetId, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns a png tile of the tissue image of a spatial dataset for
+// routes of the form /spatial/:dataset/tiles/:z/:x/:y.png
+func ScrnaImageTileRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		tile, err := parseTile(c)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		data, err := scrnadbcache.ImageTile(datasetId, tile, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Data(http.StatusOK, "image/png", data)
+	})
+}
+
+// Renders an svg or pdf figure of a dataset for routes of the form
+// /figures/:dataset/:figure where figure is embedding, dotplot or violin
+func ScrnaFigureRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		kind, err := scrna.ParseFigureKind(c.Param("figure"))
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		var params scrna.FigureOptions
+
+		err = c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		format, err := plot.ParseFormat(params.Format)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		data, err := scrnadbcache.Figure(datasetId, kind, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		c.Data(http.StatusOK, format.ContentType(), data)
+	})
+}
+
+// parseTile reads a tile from the z, x and y route params, y possibly
+// ending in .png
+func parseTile(c *gin.Context) (tiles.Tile, error) {
+	var tile tiles.Tile
+
+	var err error
+
+	tile.Z, err = strconv.Atoi(c.Param("z"))
+
+	if err != nil {
+		return tile, err
+	}
+
+	tile.X, err = strconv.Atoi(c.Param("x"))
+
+	if err != nil {
+		return tile, err
+	}
+
+	tile.Y, err = strconv.Atoi(strings.TrimSuffix(c.Param("y"), ".png"))
+
+	return tile, err
+}
+
+// Returns the neighbours of a cell in the neighbour graph
+func ScrnaNeighboursRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		cell, err := strconv.Atoi(c.Param("cell"))
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Neighbours(datasetId, cell, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Expands a selection of cells by a number of hops in the
+// neighbour graph
+func ScrnaExpandSelectionRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params ExpandSelectionParams
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.ExpandSelection(datasetId, params.Cells, params.Hops, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Lists the metadata columns of the cells of a dataset, e.g.
+// condition or donor
+func ScrnaCellMetadataColumnsRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		ret, err := scrnadbcache.CellMetadataColumns(datasetId, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Returns the values of chosen cell metadata columns in cell order
+func ScrnaCellMetadataRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing id"))
+			return
+		}
+
+		var params scrna.CellMetadataOptions
+
+		err := c.Bind(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.CellMetadata(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// func ScrnaMetadataRoute(c *gin.Context) {
+// 	publicId := c.Param("id")
+
+// 	if publicId == "" {
+// 		c.Error(fmt.Errorf("missing id"))
+// 		return
+// 	}
+
+// 	ret, err := scrnadbcache.Metadata(publicId)
+
+// 	if err != nil {
+// 		c.Error(err)
+// 		return
+// 	}
+
+// 	web.MakeDataResp(c, "", ret)
+// }
+
+func ScrnaMetadataRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing dataset id"))
+			return
+		}
+
+		// cells are positioned in the default umap unless another
+		// embedding is requested, e.g. ?embedding=tsne, and can be
+		// downsampled, e.g. ?cells=50000&stratify=cluster&seed=1
+		var params scrna.MetadataOptions
+
+		err := c.BindQuery(&params)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		ret, err := scrnadbcache.Metadata(datasetId, &params, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
+
+// Lists the genes of a dataset with their expression statistics, e.g.
+// ?sort=hvg&limit=50 for the most highly variable genes
+func ScrnaGenesRoute(c *gin.Context) {
+	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
+
+		datasetId := c.Param("dataset")
+
+		if datasetId == "" {
+			c.Error(errors.New("missing dataset id"))
+			return
+		}
+
+		sort, err := scrna.ParseGeneSort(c.Query("sort"))
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		limit := scrna.DefaultGenesLimit
+
+		if c.Query("limit") != "" {
+			v, err := strconv.Atoi(c.Query("limit"))
+
+			if err == nil {
+				limit = min(max(v, 1), scrna.MaxGenesLimit)
+			}
+		}
+
+		offset := 0
+
+		if c.Query("offset") != "" {
+			v, err := strconv.Atoi(c.Query("offset"))
+
+			if err == nil {
+				offset = max(v, 0)
+			}
+		}
+
+		highlyVariable := c.Query("hvg") == "true"
+
+		ret, err := scrnadbcache.Genes(datasetId, sort, highlyVariable, limit, offset, isAdmin, user.Permissions)
+
+		if err != nil {
+			c.Error(err)
+			return
+		}
+
+		web.MakeDataResp(c, "", ret)
+	})
+}
 
 func ScrnaSearchGenesRoute(c *gin.Context) {
 	middleware.JwtUserWithPermissionsRoute(c, func(c *gin.Context, isAdmin bool, user *token.AuthUserJwtClaims) {
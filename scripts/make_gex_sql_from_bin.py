@@ -1,9 +1,12 @@
 import collections
 import json
 import os
+import shutil
 import sqlite3
 import struct
+from datetime import datetime, timezone
 
+import numpy as np
 import pandas as pd
 import uuid_utils as uuid
 
@@ -12,6 +15,459 @@ DAT_OFFSET = 1 + 4 + DAT_INDEX_SIZE
 
 DIR = "../data/modules/scrna"
 
+# number of genes flagged as highly variable per dataset
+HVG_COUNT = 2000
+# number of mean expression bins used to normalize dispersion
+HVG_BINS = 20
+
+
+def gene_stats(values: np.ndarray, n_cells: int) -> dict:
+    """Summary statistics of a sparse gene vector whose missing
+    entries are zero."""
+    s = float(np.sum(values))
+    ss = float(np.sum(values.astype(np.float64) ** 2))
+    mean = s / n_cells
+    variance = (ss - n_cells * mean * mean) / (n_cells - 1) if n_cells > 1 else 0
+    dispersion = variance / mean if mean > 0 else 0
+
+    return {
+        "mean": mean,
+        "variance": max(variance, 0),
+        "dispersion": dispersion,
+        "fraction": len(values) / n_cells,
+    }
+
+
+# optional qc columns of the cells table and the names they are
+# commonly given by seurat, scanpy and doublet callers
+QC_COLUMNS = {
+    "n_counts": ["nCount_RNA", "total_counts", "n_counts"],
+    "n_features": ["nFeature_RNA", "n_genes_by_counts", "n_genes"],
+    "percent_mito": ["percent.mt", "pct_counts_mt", "percent_mito"],
+    "doublet_score": ["scDblFinder.score", "doublet_score", "scrublet_score"],
+}
+
+
+def qc_value(row, columns: list[str]):
+    """Return the first of columns present in row or None if missing."""
+    for column in columns:
+        if column in row and not pd.isna(row[column]):
+            return float(row[column])
+
+    return None
+
+
+# columns of the cells table that are not per cell metadata
+CELL_COLUMNS = {"Barcode", "Sample", "Cluster", "UMAP-1", "UMAP-2"}
+
+# colors of the categories of categorical cell metadata unless given
+CATEGORY_COLORS = [
+    "#1f77b4",
+    "#ff7f0e",
+    "#2ca02c",
+    "#d62728",
+    "#9467bd",
+    "#8c564b",
+    "#e377c2",
+    "#7f7f7f",
+    "#bcbd22",
+    "#17becf",
+    "#aec7e8",
+    "#ffbb78",
+    "#98df8a",
+    "#ff9896",
+    "#c5b0d5",
+    "#c49c94",
+    "#f7b6d2",
+    "#c7c7c7",
+    "#dbdb8d",
+    "#9edae5",
+]
+
+
+def read_cells(cursor, dataset_index: int) -> pd.DataFrame:
+    """Returns the id, Sample and Barcode of each cell of a dataset in
+    id order, which is the order of the cells in the gex files."""
+    return pd.DataFrame(
+        cursor.execute(
+            """SELECT c.id, s.name, c.barcode FROM cells c
+            JOIN samples s ON c.sample_id = s.id
+            WHERE c.dataset_id = :dataset_id
+            ORDER BY c.id;""",
+            {"dataset_id": dataset_index},
+        ).fetchall(),
+        columns=["id", "Sample", "Barcode"],
+    )
+
+
+def cell_positions(
+    df_cells: pd.DataFrame, df: pd.DataFrame, barcode="Barcode", sample="Sample"
+) -> np.ndarray:
+    """Returns the position in df_cells, as made by read_cells, of the
+    cell of each row of a table or -1 if the cell was not imported.
+    Barcodes can repeat across samples so rows are matched on their
+    sample and barcode if the table has a sample column and otherwise
+    only if the barcodes of the dataset are unique."""
+    if sample in df.columns:
+        cells = pd.MultiIndex.from_arrays(
+            [df_cells["Sample"].astype(str), df_cells["Barcode"].astype(str)]
+        )
+        rows = pd.MultiIndex.from_arrays(
+            [df[sample].astype(str), df[barcode].astype(str)]
+        )
+    else:
+        if df_cells["Barcode"].duplicated().any():
+            raise ValueError(
+                f"barcodes repeat across samples so a {sample} column is needed to match cells"
+            )
+
+        cells = pd.Index(df_cells["Barcode"].astype(str))
+        rows = pd.Index(df[barcode].astype(str))
+
+    return cells.get_indexer(rows)
+
+
+def align_cells(df_cells: pd.DataFrame, df: pd.DataFrame) -> pd.DataFrame:
+    """Returns the rows of a table whose first column is the barcode,
+    optionally with a Sample column, in the order of df_cells without
+    these columns. Cells missing from the table are rows of NaN."""
+    barcode = df.columns[0]
+    positions = cell_positions(df_cells, df, barcode=barcode)
+    keep = positions >= 0
+
+    df = df.loc[keep, [c for c in df.columns if c not in (barcode, "Sample")]]
+    df.index = positions[keep]
+
+    return df.reindex(range(df_cells.shape[0]))
+
+
+def with_cell_ids(df_cells: pd.DataFrame, df: pd.DataFrame) -> pd.DataFrame:
+    """Adds the database id of the cell of each row of a table with a
+    Barcode and optionally a Sample column as the column cell_id and
+    drops the rows of cells that were not imported."""
+    positions = cell_positions(df_cells, df)
+    keep = positions >= 0
+
+    return df[keep].assign(cell_id=df_cells["id"].to_numpy()[positions[keep]])
+
+
+def write_cell_metadata(cursor, dataset: dict, dataset_index: int, df_cells):
+    """Stores the columns of the cells table that are not otherwise
+    used, e.g. condition or donor, and those of an optional table of
+    cell metadata whose first column is the barcode. Numeric columns
+    are numeric metadata unless listed in the dataset's categorical
+    columns and all others are categorical."""
+
+    used = set(CELL_COLUMNS)
+
+    for names in QC_COLUMNS.values():
+        used.update(names)
+
+    # rows are in the order the cells were inserted, i.e. id order
+    df = df_cells[[c for c in df_cells.columns if c not in used]].reset_index(
+        drop=True
+    )
+
+    if "cell_metadata" in dataset:
+        df_extra = pd.read_csv(dataset["cell_metadata"], sep="\t", header=0)
+        df_extra = align_cells(read_cells(cursor, dataset_index), df_extra)
+        df = pd.concat(
+            [df, df_extra[[c for c in df_extra.columns if c not in df.columns]]],
+            axis=1,
+        )
+
+    categorical = set(dataset.get("categorical", []))
+    colors = dataset.get("category_colors", {})
+
+    for name in df.columns:
+        values = df[name]
+        categories = []
+
+        if (
+            name not in categorical
+            and pd.api.types.is_numeric_dtype(values)
+            and not pd.api.types.is_bool_dtype(values)
+        ):
+            metadata_type = "numeric"
+            data = values.to_numpy(dtype="<f4").tobytes()
+        else:
+            metadata_type = "categorical"
+            present = values.notna()
+            categories = sorted(values[present].astype(str).unique())
+            codes = {category: i for i, category in enumerate(categories)}
+            data = np.array(
+                [
+                    codes[str(v)] if ok else -1
+                    for v, ok in zip(values.values, present.values)
+                ],
+                dtype="<i4",
+            ).tobytes()
+
+        metadata_id = cursor.execute(
+            "INSERT INTO cell_metadata (public_id, dataset_id, name, type, data) VALUES (:public_id, :dataset_id, :name, :type, :data);",
+            {
+                "public_id": str(uuid.uuid7()),
+                "dataset_id": dataset_index,
+                "name": name,
+                "type": metadata_type,
+                "data": data,
+            },
+        ).lastrowid
+
+        for code, category in enumerate(categories):
+            cursor.execute(
+                "INSERT INTO cell_metadata_categories (metadata_id, code, name, color) VALUES (:metadata_id, :code, :name, :color);",
+                {
+                    "metadata_id": metadata_id,
+                    "code": code,
+                    "name": category,
+                    "color": colors.get(name, {}).get(
+                        category, CATEGORY_COLORS[code % len(CATEGORY_COLORS)]
+                    ),
+                },
+            )
+
+
+GRAPH_MAGIC = 43
+
+
+def write_neighbour_graph(cursor, dataset: dict, dataset_index: int, file_map: dict):
+    """Write the neighbour graph of a dataset as a little endian csr
+    file with the cells in id order and record it in the database."""
+    df_cells = read_cells(cursor, dataset_index)
+
+    df_graph = pd.read_csv(dataset["graph"]["file"], sep="\t", header=0)
+
+    rows = cell_positions(df_cells, df_graph, barcode="From", sample="From Sample")
+    cols = cell_positions(df_cells, df_graph, barcode="To", sample="To Sample")
+
+    # drop edges to cells that were not imported and self loops
+    keep = (rows != -1) & (cols != -1) & (rows != cols)
+    rows = rows[keep].astype(np.int64)
+    cols = cols[keep].astype(np.int64)
+
+    weighted = "Weight" in df_graph.columns
+    weights = df_graph["Weight"].to_numpy(dtype="<f4")[keep] if weighted else None
+
+    # sort edges by cell then neighbour to build the csr arrays
+    order = np.lexsort((cols, rows))
+    rows = rows[order]
+    cols = cols[order]
+
+    n_cells = df_cells.shape[0]
+    offsets = np.zeros(n_cells + 1, dtype="<u4")
+    offsets[1:] = np.cumsum(np.bincount(rows, minlength=n_cells))
+
+    relative_file = dataset["graph"]["path"]
+    file = os.path.join(dataset["root"], relative_file)
+    os.makedirs(os.path.dirname(file), exist_ok=True)
+
+    with open(file, "wb") as fout:
+        fout.write(
+            struct.pack(
+                "<IIIII", GRAPH_MAGIC, 1, n_cells, len(cols), 1 if weighted else 0
+            )
+        )
+        fout.write(offsets.tobytes())
+        fout.write(cols.astype("<u4").tobytes())
+
+        if weighted:
+            fout.write(weights[order].tobytes())
+
+    file_id = uuid.uuid7()
+    file_map[relative_file] = {"uuid": file_id, "index": len(file_map) + 1}
+
+    cursor.execute(
+        "INSERT INTO files (id, public_id, url) VALUES (:id, :public_id, :url);",
+        {
+            "id": file_map[relative_file]["index"],
+            "public_id": str(file_id),
+            "url": relative_file,
+        },
+    )
+
+    cursor.execute(
+        "INSERT INTO neighbour_graphs (dataset_id, file_id) VALUES (:dataset_id, :file_id);",
+        {"dataset_id": dataset_index, "file_id": file_map[relative_file]["index"]},
+    )
+
+
+def write_clustering(
+    cursor, clustering: dict, dataset_index: int, metadata_type_map: dict
+):
+    """Adds a named clustering of a dataset's cells, which must already
+    be in the cells table."""
+
+    df_clusters = pd.read_csv(clustering["clusters"], sep="\t", header=0, index_col=0)
+    df_cells = pd.read_csv(clustering["cells"], sep="\t", header=0)
+    df_cells = df_cells[df_cells["Cluster"].isin(df_clusters.index)]
+
+    df_cells = with_cell_ids(read_cells(cursor, dataset_index), df_cells)
+
+    clustering_index = cursor.execute(
+        "INSERT INTO clusterings (public_id, dataset_id, name) VALUES (:public_id, :dataset_id, :name);",
+        {
+            "public_id": str(uuid.uuid7()),
+            "dataset_id": dataset_index,
+            "name": clustering["name"],
+        },
+    ).lastrowid
+
+    metadata_types = list(sorted(df_clusters.columns[1:].values))
+
+    for name in metadata_types:
+        if name not in metadata_type_map:
+            metadata_type_map[name] = {
+                "uuid": uuid.uuid7(),
+                "index": len(metadata_type_map) + 1,
+            }
+
+            cursor.execute(
+                "INSERT INTO metadata (id, public_id, name) VALUES (:id, :public_id, :name);",
+                {
+                    "id": metadata_type_map[name]["index"],
+                    "public_id": str(metadata_type_map[name]["uuid"]),
+                    "name": name,
+                },
+            )
+
+    cluster_ids = {}
+
+    for cluster, row in df_clusters.iterrows():
+        cluster_ids[cluster] = cursor.execute(
+            """INSERT INTO clusters (public_id, dataset_id, clustering_id, label, name, cell_count, color)
+            VALUES (:public_id, :dataset_id, :clustering_id, :label, :name, :cell_count, :color);""",
+            {
+                "public_id": str(uuid.uuid7()),
+                "dataset_id": dataset_index,
+                "clustering_id": clustering_index,
+                "label": int(cluster),
+                "name": str(cluster),
+                "cell_count": int((df_cells["Cluster"] == cluster).sum()),
+                "color": row["Color"],
+            },
+        ).lastrowid
+
+        for name in metadata_types:
+            cursor.execute(
+                "INSERT INTO cluster_metadata (cluster_id, metadata_id, value) VALUES (:cluster_id, :metadata_id, :value);",
+                {
+                    "cluster_id": cluster_ids[cluster],
+                    "metadata_id": metadata_type_map[name]["index"],
+                    "value": str(row[name]),
+                },
+            )
+
+    for _, row in df_cells.iterrows():
+        cursor.execute(
+            "INSERT INTO cell_clusters (cell_id, clustering_id, cluster_id) VALUES (:cell_id, :clustering_id, :cluster_id);",
+            {
+                "cell_id": int(row["cell_id"]),
+                "clustering_id": clustering_index,
+                "cluster_id": cluster_ids[row["Cluster"]],
+            },
+        )
+
+
+SPATIAL_EMBEDDING = "spatial"
+
+
+def write_spatial(cursor, dataset: dict, dataset_index: int, file_map: dict):
+    """Store the spot coordinates of a spatial dataset as the spatial
+    embedding and copy its tissue image next to the gex blocks."""
+    spatial = dataset["spatial"]
+
+    df_spatial = align_cells(
+        read_cells(cursor, dataset_index),
+        pd.read_csv(spatial["file"], sep="\t", header=0),
+    )[["Spatial-1", "Spatial-2"]]
+
+    missing = int(df_spatial.isna().any(axis=1).sum())
+
+    if missing > 0:
+        raise ValueError(f"spatial coordinates are missing {missing} cells")
+
+    # coordinates are full resolution image pixels; y is negated so
+    # the tissue is the right way up when drawn like the umap
+    coords = df_spatial.to_numpy(dtype="<f4")
+    coords[:, 1] = -coords[:, 1]
+
+    cursor.execute(
+        "INSERT INTO embeddings (dataset_id, name, dimensions, data) VALUES (:dataset_id, :name, :dimensions, :data);",
+        {
+            "dataset_id": dataset_index,
+            "name": SPATIAL_EMBEDDING,
+            "dimensions": 2,
+            "data": coords.tobytes(),
+        },
+    )
+
+    if "image" not in spatial:
+        return
+
+    # scale factors can come from space ranger's scalefactors json
+    # or be given directly
+    scale = spatial.get("scale", 1.0)
+    spot_diameter = spatial.get("spot_diameter", 0.0)
+
+    if "scalefactors" in spatial:
+        with open(spatial["scalefactors"]) as f:
+            factors = json.load(f)
+
+        scale = factors.get("tissue_hires_scalef", scale)
+        spot_diameter = factors.get("spot_diameter_fullres", spot_diameter)
+
+    relative_file = spatial["image"]["path"]
+    file = os.path.join(dataset["root"], relative_file)
+    os.makedirs(os.path.dirname(file), exist_ok=True)
+    shutil.copyfile(spatial["image"]["file"], file)
+
+    file_id = uuid.uuid7()
+    file_map[relative_file] = {"uuid": file_id, "index": len(file_map) + 1}
+
+    cursor.execute(
+        "INSERT INTO files (id, public_id, url) VALUES (:id, :public_id, :url);",
+        {
+            "id": file_map[relative_file]["index"],
+            "public_id": str(file_id),
+            "url": relative_file,
+        },
+    )
+
+    cursor.execute(
+        "INSERT INTO spatial_images (dataset_id, file_id, scale, spot_diameter) VALUES (:dataset_id, :file_id, :scale, :spot_diameter);",
+        {
+            "dataset_id": dataset_index,
+            "file_id": file_map[relative_file]["index"],
+            "scale": float(scale),
+            "spot_diameter": float(spot_diameter),
+        },
+    )
+
+
+def highly_variable(stats: list[dict]):
+    """Flag highly variable genes in the style of Seurat's mean.var.plot:
+    log dispersions are z-scored within bins of mean expression and the
+    genes with the highest normalized dispersion are flagged."""
+    if len(stats) == 0:
+        return
+
+    df = pd.DataFrame(stats)
+    log_disp = np.log(df["dispersion"].replace(0, np.nan))
+    bins = pd.cut(np.log1p(df["mean"]), bins=HVG_BINS)
+    grouped = log_disp.groupby(bins, observed=False)
+    mean = grouped.transform("mean")
+    sd = grouped.transform("std")
+    # bins with a single gene have no sd so leave them unscaled
+    norm = ((log_disp - mean) / sd.replace(0, np.nan)).fillna(0)
+
+    top = set(norm.sort_values(ascending=False).index[:HVG_COUNT])
+
+    for i, s in enumerate(stats):
+        s["dispersion_norm"] = float(norm.iloc[i])
+        s["highly_variable"] = 1 if i in top else 0
+
+
 # parser = argparse.ArgumentParser()
 # parser.add_argument("-n", "--name", help="name")
 # parser.add_argument("-i", "--institution", help="institution")
@@ -256,6 +712,7 @@ cursor.execute(
 	cells INTEGER NOT NULL,
     description TEXT NOT NULL DEFAULT '',
     tags TEXT NOT NULL DEFAULT '',
+	imported_at TEXT NOT NULL,
 	FOREIGN KEY(assembly_id) REFERENCES assemblies(id)
 );
 """
@@ -315,16 +772,36 @@ cursor.execute(
 """
 )
 
+# a dataset can be clustered several times, e.g. at different
+# resolutions. The clusters of the cells table are those of the
+# default clustering.
+cursor.execute(
+    f""" CREATE TABLE clusterings (
+	id INTEGER PRIMARY KEY,
+    public_id TEXT NOT NULL UNIQUE,
+    dataset_id INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	is_default INTEGER NOT NULL DEFAULT 0,
+	UNIQUE(dataset_id, name),
+    FOREIGN KEY(dataset_id) REFERENCES datasets(id)
+);
+"""
+)
+
 cursor.execute(
     f""" CREATE TABLE clusters (
 	id INTEGER PRIMARY KEY,
     public_id TEXT NOT NULL UNIQUE,
     dataset_id INTEGER NOT NULL,
-    label INTEGER NOT NULL UNIQUE,
-	name TEXT NOT NULL UNIQUE,
+	clustering_id INTEGER NOT NULL,
+    label INTEGER NOT NULL,
+	name TEXT NOT NULL,
 	cell_count INTEGER NOT NULL,
 	color TEXT NOT NULL DEFAULT '',
-    FOREIGN KEY(dataset_id) REFERENCES datasets(id)
+	UNIQUE(clustering_id, label),
+	UNIQUE(clustering_id, name),
+    FOREIGN KEY(dataset_id) REFERENCES datasets(id),
+	FOREIGN KEY(clustering_id) REFERENCES clusterings(id)
 );
 """
 )
@@ -341,6 +818,35 @@ cursor.execute(
 """
 )
 
+# suggested cell types for clusters written by the api's annotation
+# job for an admin to review
+cursor.execute(
+    f""" CREATE TABLE cluster_annotations (
+	id INTEGER PRIMARY KEY,
+	cluster_id INTEGER NOT NULL,
+	reference TEXT NOT NULL,
+	rank INTEGER NOT NULL,
+	label TEXT NOT NULL,
+	score REAL NOT NULL,
+	created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE(cluster_id, rank),
+	FOREIGN KEY(cluster_id) REFERENCES clusters(id)
+);
+"""
+)
+
+cursor.execute(
+    f""" CREATE TABLE sample_metadata (
+	sample_id INTEGER NOT NULL,
+	metadata_id INTEGER NOT NULL,
+    value TEXT NOT NULL,
+	PRIMARY KEY(sample_id, metadata_id),
+	FOREIGN KEY(sample_id) REFERENCES samples(id),
+	FOREIGN KEY(metadata_id) REFERENCES metadata(id)  
+);
+"""
+)
+
 cursor.execute(
     f""" CREATE TABLE cells (
     id INTEGER PRIMARY KEY,
@@ -351,6 +857,10 @@ cursor.execute(
 	barcode	TEXT NOT NULL, 
 	umap_x REAL NOT NULL, 
 	umap_y REAL NOT NULL,
+    n_counts INTEGER,
+    n_features INTEGER,
+    percent_mito REAL,
+    doublet_score REAL,
     UNIQUE(dataset_id, sample_id, cluster_id, barcode),
     FOREIGN KEY (dataset_id) REFERENCES datasets(id),
 	FOREIGN KEY (cluster_id) REFERENCES clusters(id),
@@ -359,6 +869,130 @@ cursor.execute(
 """
 )
 
+# the cluster of each cell in every clustering. Cells a clustering
+# does not assign, e.g. because they were excluded, have no row.
+cursor.execute(
+    f""" CREATE TABLE cell_clusters (
+	cell_id INTEGER NOT NULL,
+	clustering_id INTEGER NOT NULL,
+	cluster_id INTEGER NOT NULL,
+	PRIMARY KEY(cell_id, clustering_id),
+	FOREIGN KEY(cell_id) REFERENCES cells(id),
+	FOREIGN KEY(clustering_id) REFERENCES clusterings(id),
+	FOREIGN KEY(cluster_id) REFERENCES clusters(id)
+);
+"""
+)
+
+# per cell metadata such as condition, donor or batch, one row per
+# column. data holds little endian values with the cells in id order,
+# float32 with NaN for missing values for numeric columns and int32
+# category codes with -1 for missing values for categorical ones.
+cursor.execute(
+    f""" CREATE TABLE cell_metadata (
+    id INTEGER PRIMARY KEY,
+    public_id TEXT NOT NULL UNIQUE,
+    dataset_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL,
+    data BLOB NOT NULL,
+    UNIQUE(dataset_id, name),
+    FOREIGN KEY (dataset_id) REFERENCES datasets(id)
+);
+"""
+)
+
+cursor.execute(
+    f""" CREATE TABLE cell_metadata_categories (
+    metadata_id INTEGER NOT NULL,
+    code INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    color TEXT NOT NULL DEFAULT '',
+    PRIMARY KEY (metadata_id, code),
+    FOREIGN KEY (metadata_id) REFERENCES cell_metadata(id)
+);
+"""
+)
+
+# embeddings other than the umap stored with the cells, e.g. tsne,
+# pca or a 3d umap. data holds little endian float32 coordinates
+# with the cells in id order and the dimensions of each cell together.
+cursor.execute(
+    f""" CREATE TABLE embeddings (
+    id INTEGER PRIMARY KEY,
+    dataset_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    dimensions INTEGER NOT NULL,
+    data BLOB NOT NULL,
+    UNIQUE(dataset_id, name),
+    FOREIGN KEY (dataset_id) REFERENCES datasets(id)
+);
+"""
+)
+
+# trajectories, e.g. from slingshot or monocle, each with one or
+# more lineages giving the pseudotime and weight of the cells in them
+cursor.execute(
+    f""" CREATE TABLE trajectories (
+    id INTEGER PRIMARY KEY,
+    public_id TEXT NOT NULL UNIQUE,
+    dataset_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    UNIQUE(dataset_id, name),
+    FOREIGN KEY (dataset_id) REFERENCES datasets(id)
+);
+"""
+)
+
+cursor.execute(
+    f""" CREATE TABLE trajectory_lineages (
+    id INTEGER PRIMARY KEY,
+    trajectory_id INTEGER NOT NULL,
+    name TEXT NOT NULL,
+    UNIQUE(trajectory_id, name),
+    FOREIGN KEY (trajectory_id) REFERENCES trajectories(id)
+);
+"""
+)
+
+cursor.execute(
+    f""" CREATE TABLE trajectory_values (
+    lineage_id INTEGER NOT NULL,
+    cell_id INTEGER NOT NULL,
+    pseudotime REAL NOT NULL,
+    weight REAL NOT NULL DEFAULT 1,
+    PRIMARY KEY (lineage_id, cell_id),
+    FOREIGN KEY (lineage_id) REFERENCES trajectory_lineages(id),
+    FOREIGN KEY (cell_id) REFERENCES cells(id)
+);
+"""
+)
+
+# optional rna velocity of each cell projected onto the umap, e.g.
+# scvelo's velocity_umap
+cursor.execute(
+    f""" CREATE TABLE cell_velocities (
+    cell_id INTEGER PRIMARY KEY,
+    dx REAL NOT NULL,
+    dy REAL NOT NULL,
+    FOREIGN KEY (cell_id) REFERENCES cells(id)
+);
+"""
+)
+
+# optional cell-cycle scores computed with e.g. Seurat's
+# CellCycleScoring so the api does not need to recompute them
+cursor.execute(
+    f""" CREATE TABLE cell_cycle (
+    cell_id INTEGER PRIMARY KEY,
+    s_score REAL NOT NULL,
+    g2m_score REAL NOT NULL,
+    phase TEXT NOT NULL,
+    FOREIGN KEY (cell_id) REFERENCES cells(id)
+);
+"""
+)
+
 cursor.execute(
     f"""
     CREATE TABLE gex_types (
@@ -395,6 +1029,34 @@ cursor.execute(
     """,
 )
 
+# the neighbour graph of each dataset, e.g. seurat's snn graph, is
+# stored in compressed sparse row form in a file next to the gex blocks
+cursor.execute(
+    f""" CREATE TABLE neighbour_graphs (
+    dataset_id INTEGER PRIMARY KEY,
+    file_id INTEGER NOT NULL,
+    FOREIGN KEY (dataset_id) REFERENCES datasets(id),
+    FOREIGN KEY (file_id) REFERENCES files(id)
+);
+"""
+)
+
+# the tissue image of a spatial dataset, a png or jpeg stored next to
+# the gex blocks. scale converts the full resolution coordinates of the
+# spatial embedding to image pixels, e.g. space ranger's
+# tissue_hires_scalef, and spot_diameter is in full resolution pixels.
+cursor.execute(
+    f""" CREATE TABLE spatial_images (
+    dataset_id INTEGER PRIMARY KEY,
+    file_id INTEGER NOT NULL,
+    scale REAL NOT NULL,
+    spot_diameter REAL NOT NULL DEFAULT 0,
+    FOREIGN KEY (dataset_id) REFERENCES datasets(id),
+    FOREIGN KEY (file_id) REFERENCES files(id)
+);
+"""
+)
+
 cursor.execute(
     f""" CREATE TABLE gex (
 	id INTEGER PRIMARY KEY,
@@ -414,12 +1076,32 @@ cursor.execute(
 """
 )
 
+# per dataset gene statistics computed from the gex blocks so that
+# genes can be ranked without reading the expression data
+cursor.execute(
+    f""" CREATE TABLE gene_stats (
+	gex_id INTEGER PRIMARY KEY,
+    mean REAL NOT NULL,
+    variance REAL NOT NULL,
+    dispersion REAL NOT NULL,
+    dispersion_norm REAL NOT NULL,
+    fraction REAL NOT NULL,
+    highly_variable INTEGER NOT NULL DEFAULT 0,
+    FOREIGN KEY(gex_id) REFERENCES gex(id)
+);
+"""
+)
+
 
 cursor.execute("COMMIT;")
 
 metadata_type_map = {}
 file_map = {}
 
+# changes on every import so that caches of derived data, such as
+# rendered tiles, are not reused
+imported_at = datetime.now(timezone.utc).strftime("%Y%m%dT%H%M%S%fZ")
+
 expression_id = 1
 
 used_gene_ids = {}
@@ -443,24 +1125,23 @@ for di, dataset in enumerate(datasets):
         count = len(df_cells[df_cells["Cluster"] == c])
         counts.append(count)
 
-    # map cluster id to uuid e.g. 1 -> 'c4f8e2a0-1d5b-11ee-be56-0242ac120002'
-    cluster_id_map = {
-        c: {"uuid": uuid.uuid7(), "index": i + 1}
-        for i, c in enumerate(df_clusters.index)
-    }
+    # map cluster id to uuid e.g. 1 -> 'c4f8e2a0-1d5b-11ee-be56-0242ac120002',
+    # the index being set when the cluster is inserted
+    cluster_id_map = {c: {"uuid": uuid.uuid7(), "index": -1} for c in df_clusters.index}
 
     # df_clusters["Cells"] = counts
 
     cursor.execute("BEGIN TRANSACTION;")
 
     cursor.execute(
-        f"""INSERT INTO datasets (id, public_id,  assembly_id, name, institution, cells) VALUES (
+        f"""INSERT INTO datasets (id, public_id,  assembly_id, name, institution, cells, imported_at) VALUES (
             {dataset_index}, 
             '{dataset_id}', 
             {assemblies_map[dataset["assembly"]]},
             '{dataset["name"]}', 
             '{dataset["institution"]}',
-            {df_cells.shape[0]});
+            {df_cells.shape[0]},
+            '{imported_at}');
         """,
     )
 
@@ -488,22 +1169,32 @@ for di, dataset in enumerate(datasets):
 
     cursor.execute("BEGIN TRANSACTION;")
 
+    # the clusters of the cells table form the default clustering
+    default_clustering_index = cursor.execute(
+        "INSERT INTO clusterings (public_id, dataset_id, name, is_default) VALUES (:public_id, :dataset_id, :name, 1);",
+        {
+            "public_id": str(uuid.uuid7()),
+            "dataset_id": dataset_index,
+            "name": dataset.get("clustering", "Default"),
+        },
+    ).lastrowid
+
     for idx, (cluster, row) in enumerate(df_clusters.iterrows()):
         cluster_id = cluster_id_map[row.name]["uuid"]
 
         # row name is the cluster label, a number
         label = int(row.name)
-        cursor.execute(
-            f"""INSERT INTO clusters (id, public_id, dataset_id, label, name, cell_count, color) VALUES (
-                {idx + 1}, 
+        cluster_id_map[row.name]["index"] = cursor.execute(
+            f"""INSERT INTO clusters (public_id, dataset_id, clustering_id, label, name, cell_count, color) VALUES (
                 '{cluster_id}', 
                 {dataset_index},
+                {default_clustering_index},
                 {label}, 
                 '{cluster}',  
                 {counts[idx]}, 
                 '{row["Color"]}'
             );""",
-        )
+        ).lastrowid
 
     cursor.execute("COMMIT;")
 
@@ -555,6 +1246,48 @@ for di, dataset in enumerate(datasets):
 
     cursor.execute("COMMIT;")
 
+    # samples can optionally have metadata, e.g. condition, in a table
+    # whose first column is the sample name so that cluster proportions
+    # can be compared between groups of samples
+    if "samples" in dataset:
+        df_samples = pd.read_csv(
+            dataset["samples"], sep="\t", header=0, index_col=0, keep_default_na=False
+        )
+
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for name in sorted(df_samples.columns.values):
+            if name not in metadata_type_map:
+                metadata_type_map[name] = {
+                    "uuid": uuid.uuid7(),
+                    "index": len(metadata_type_map) + 1,
+                }
+
+                cursor.execute(
+                    f"INSERT INTO metadata (id, public_id, name) VALUES (:id, :public_id, :name);",
+                    {
+                        "id": metadata_type_map[name]["index"],
+                        "public_id": str(metadata_type_map[name]["uuid"]),
+                        "name": name,
+                    },
+                )
+
+        for sample, row in df_samples.iterrows():
+            if sample not in sample_map:
+                continue
+
+            for name in df_samples.columns.values:
+                cursor.execute(
+                    f"INSERT INTO sample_metadata (sample_id, metadata_id, value) VALUES (:sample_id, :metadata_id, :value);",
+                    {
+                        "sample_id": sample_map[sample]["index"],
+                        "metadata_id": metadata_type_map[name]["index"],
+                        "value": str(row[name]),
+                    },
+                )
+
+        cursor.execute("COMMIT;")
+
     cursor.execute("BEGIN TRANSACTION;")
 
     for i, row in df_cells.iterrows():
@@ -565,16 +1298,217 @@ for di, dataset in enumerate(datasets):
 
         # print(dataset_index, sample_id, cluster_id)
 
+        # qc metrics are optional columns of the cells table
+        qc = {column: qc_value(row, names) for column, names in QC_COLUMNS.items()}
+
+        for column in ["n_counts", "n_features"]:
+            if qc[column] is not None:
+                qc[column] = int(qc[column])
+
         cursor.execute(
-            f"INSERT INTO cells (public_id, dataset_id, sample_id, cluster_id, barcode, umap_x, umap_y) VALUES ('{cell_id}', {dataset_index}, {sample_id}, {cluster_id}, '{row["Barcode"]}', {row["UMAP-1"]}, {row["UMAP-2"]});",
+            """INSERT INTO cells (public_id, dataset_id, sample_id, cluster_id, barcode, umap_x, umap_y, n_counts, n_features, percent_mito, doublet_score)
+            VALUES (:public_id, :dataset_id, :sample_id, :cluster_id, :barcode, :umap_x, :umap_y, :n_counts, :n_features, :percent_mito, :doublet_score);""",
+            {
+                "public_id": str(cell_id),
+                "dataset_id": dataset_index,
+                "sample_id": sample_id,
+                "cluster_id": cluster_id,
+                "barcode": row["Barcode"],
+                "umap_x": float(row["UMAP-1"]),
+                "umap_y": float(row["UMAP-2"]),
+                **qc,
+            },
         )
 
+    cursor.execute(
+        """INSERT INTO cell_clusters (cell_id, clustering_id, cluster_id)
+        SELECT id, :clustering_id, cluster_id FROM cells WHERE dataset_id = :dataset_id;""",
+        {"clustering_id": default_clustering_index, "dataset_id": dataset_index},
+    )
+
     cursor.execute("COMMIT;")
 
+    # further clusterings, e.g. at other resolutions, each have a
+    # clusters table like the default one and a table of the Barcode
+    # and Cluster of each cell
+    if "clusterings" in dataset:
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for clustering in dataset["clusterings"]:
+            write_clustering(cursor, clustering, dataset_index, metadata_type_map)
+
+        cursor.execute("COMMIT;")
+
+    cursor.execute("BEGIN TRANSACTION;")
+
+    write_cell_metadata(cursor, dataset, dataset_index, df_cells)
+
+    cursor.execute("COMMIT;")
+
+    # embeddings are tables with a Barcode column followed by one
+    # column per dimension, e.g. tSNE-1 and tSNE-2, and must have
+    # coordinates for every cell
+    if "embeddings" in dataset:
+        df_dataset_cells = read_cells(cursor, dataset_index)
+
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for embedding in dataset["embeddings"]:
+            if embedding["name"].lower() == "umap":
+                raise ValueError("umap is reserved for the umap of the cells table")
+
+            if embedding["name"].lower() == SPATIAL_EMBEDDING:
+                raise ValueError(
+                    "spatial is reserved for the coordinates of spatial datasets"
+                )
+
+            df_embedding = align_cells(
+                df_dataset_cells,
+                pd.read_csv(embedding["file"], sep="\t", header=0),
+            )
+
+            missing = int(df_embedding.isna().any(axis=1).sum())
+
+            if missing > 0:
+                raise ValueError(
+                    f"embedding {embedding['name']} is missing {missing} cells"
+                )
+
+            coords = df_embedding.to_numpy(dtype="<f4")
+
+            cursor.execute(
+                "INSERT INTO embeddings (dataset_id, name, dimensions, data) VALUES (:dataset_id, :name, :dimensions, :data);",
+                {
+                    "dataset_id": dataset_index,
+                    "name": embedding["name"],
+                    "dimensions": coords.shape[1],
+                    "data": coords.tobytes(),
+                },
+            )
+
+        cursor.execute("COMMIT;")
+
+    # trajectories are tables with the columns Barcode, Lineage,
+    # Pseudotime and optionally Weight; cells missing from a lineage
+    # or with no pseudotime are not in it
+    if "trajectories" in dataset:
+        df_dataset_cells = read_cells(cursor, dataset_index)
+
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for trajectory in dataset["trajectories"]:
+            df_trajectory = pd.read_csv(trajectory["file"], sep="\t", header=0)
+            df_trajectory = with_cell_ids(df_dataset_cells, df_trajectory)
+            df_trajectory = df_trajectory[df_trajectory["Pseudotime"].notna()]
+
+            trajectory_id = cursor.execute(
+                "INSERT INTO trajectories (public_id, dataset_id, name) VALUES (:public_id, :dataset_id, :name);",
+                {
+                    "public_id": str(uuid.uuid7()),
+                    "dataset_id": dataset_index,
+                    "name": trajectory["name"],
+                },
+            ).lastrowid
+
+            for lineage in sorted(df_trajectory["Lineage"].astype(str).unique()):
+                lineage_id = cursor.execute(
+                    "INSERT INTO trajectory_lineages (trajectory_id, name) VALUES (:trajectory_id, :name);",
+                    {"trajectory_id": trajectory_id, "name": lineage},
+                ).lastrowid
+
+                df_lineage = df_trajectory[
+                    df_trajectory["Lineage"].astype(str) == lineage
+                ]
+
+                for i, row in df_lineage.iterrows():
+                    cursor.execute(
+                        "INSERT INTO trajectory_values (lineage_id, cell_id, pseudotime, weight) VALUES (:lineage_id, :cell_id, :pseudotime, :weight);",
+                        {
+                            "lineage_id": lineage_id,
+                            "cell_id": int(row["cell_id"]),
+                            "pseudotime": float(row["Pseudotime"]),
+                            "weight": (
+                                float(row["Weight"]) if "Weight" in row else 1.0
+                            ),
+                        },
+                    )
+
+        cursor.execute("COMMIT;")
+
+    # velocities are tables with the columns Barcode, Velocity-1
+    # and Velocity-2 in the same space as the umap
+    if "velocity" in dataset:
+        df_velocity = with_cell_ids(
+            read_cells(cursor, dataset_index),
+            pd.read_csv(dataset["velocity"], sep="\t", header=0),
+        )
+
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for i, row in df_velocity.iterrows():
+            cursor.execute(
+                "INSERT INTO cell_velocities (cell_id, dx, dy) VALUES (:cell_id, :dx, :dy);",
+                {
+                    "cell_id": int(row["cell_id"]),
+                    "dx": float(row["Velocity-1"]),
+                    "dy": float(row["Velocity-2"]),
+                },
+            )
+
+        cursor.execute("COMMIT;")
+
+    # cell-cycle scores are matched to cells by barcode and are
+    # expected in the columns Seurat writes to its metadata
+    if "cell_cycle" in dataset:
+        df_cell_cycle = with_cell_ids(
+            read_cells(cursor, dataset_index),
+            pd.read_csv(dataset["cell_cycle"], sep="\t", header=0),
+        )
+
+        cursor.execute("BEGIN TRANSACTION;")
+
+        for i, row in df_cell_cycle.iterrows():
+            cursor.execute(
+                "INSERT INTO cell_cycle (cell_id, s_score, g2m_score, phase) VALUES (:cell_id, :s_score, :g2m_score, :phase);",
+                {
+                    "cell_id": int(row["cell_id"]),
+                    "s_score": float(row["S.Score"]),
+                    "g2m_score": float(row["G2M.Score"]),
+                    "phase": row["Phase"],
+                },
+            )
+
+        cursor.execute("COMMIT;")
+
+    # graphs are tables of edges with the columns From, To and
+    # optionally Weight, where From and To are barcodes, and are
+    # written to the path given relative to the dataset root. If
+    # barcodes repeat across samples the table also needs the
+    # columns From Sample and To Sample
+    if "graph" in dataset:
+        cursor.execute("BEGIN TRANSACTION;")
+        write_neighbour_graph(cursor, dataset, dataset_index, file_map)
+        cursor.execute("COMMIT;")
+
+    # spatial datasets have a table with the columns Barcode, Spatial-1
+    # and Spatial-2 giving the position of each spot in the full
+    # resolution image and optionally a tissue image with its scale
+    # factors, which is copied to the path given relative to the root
+    if "spatial" in dataset:
+        cursor.execute("BEGIN TRANSACTION;")
+        write_spatial(cursor, dataset, dataset_index, file_map)
+        cursor.execute("COMMIT;")
+
     cursor.execute("BEGIN TRANSACTION;")
 
     root_dir = dataset["root"]
 
+    n_cells = df_cells.shape[0]
+
+    # stats of each gex type are kept apart since counts and normalized
+    # values are on different scales
+    stats = {}
+
     for file in dataset["data"]:
         type = file["type"]
         type_id = expression_type_map[type]
@@ -708,6 +1642,16 @@ for di, dataset in enumerate(datasets):
                                         {file_id});""",
                             )
 
+                            # number of index, value pairs
+                            n = struct.unpack("<I", fin.read(4))[0]
+                            # skip indexes and read values
+                            fin.seek(n * 4, 1)
+                            values = np.frombuffer(fin.read(n * 4), dtype="<f4")
+
+                            s = gene_stats(values, n_cells)
+                            s["gex_id"] = expression_id
+                            stats.setdefault(type_id, []).append(s)
+
                             expression_id += 1
 
                         # size does not include the 4 bytes of size itself
@@ -719,6 +1663,16 @@ for di, dataset in enumerate(datasets):
 
                         used_gene_ids[gene_index] = ensembl_id
 
+    for type_stats in stats.values():
+        highly_variable(type_stats)
+
+        for s in type_stats:
+            cursor.execute(
+                f"""INSERT INTO gene_stats (gex_id, mean, variance, dispersion, dispersion_norm, fraction, highly_variable) VALUES (
+                    :gex_id, :mean, :variance, :dispersion, :dispersion_norm, :fraction, :highly_variable);""",
+                s,
+            )
+
     cursor.execute("COMMIT;")
 
 cursor.execute("BEGIN TRANSACTION;")
@@ -743,6 +1697,11 @@ cursor.execute(
 """
 )
 
+cursor.execute(
+    f""" CREATE INDEX gex_dataset_id_idx ON gex (dataset_id);
+"""
+)
+
 cursor.execute(
     f""" CREATE INDEX cells_sample_id_idx ON cells (sample_id);
 """
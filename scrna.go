@@ -3,10 +3,14 @@ package scrna
 import (
 	"database/sql"
 	"fmt"
+	"image"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/genesets"
+	"github.com/antonybholmes/go-scrna/spatial"
 	"github.com/antonybholmes/go-sys"
 	"github.com/antonybholmes/go-sys/db"
 	"github.com/antonybholmes/go-sys/log"
@@ -55,12 +59,13 @@ type (
 	}
 
 	Gene struct {
-		Id         string `json:"id"`
-		Ensembl    string `json:"geneId"`
-		GeneSymbol string `json:"geneSymbol"`
-		Url        string `json:"-"`
-		Offset     int64  `json:"-"`
-		Size       int64  `json:"-"`
+		Stats      *GeneStats `json:"stats,omitempty"`
+		Id         string     `json:"id"`
+		Ensembl    string     `json:"geneId"`
+		GeneSymbol string     `json:"geneSymbol"`
+		Url        string     `json:"-"`
+		Offset     int64      `json:"-"`
+		Size       int64      `json:"-"`
 	}
 
 	ClusterMetadata struct {
@@ -88,14 +93,45 @@ type (
 	SingleCell struct {
 		Sample  string `json:"sample"`
 		Barcode string `json:"barcode,omitempty"`
+		// pseudotime and weight of the cell in each lineage of each
+		// trajectory in the order of DatasetMetadata.Trajectories.
+		// Pseudotime is null if the cell is not in a lineage.
+		Pseudotime [][]*float64 `json:"pseudotime,omitempty"`
+		Weights    [][]float64  `json:"weights,omitempty"`
+		// velocity in embedding coordinates if known
+		Velocity *Pos    `json:"velocity,omitempty"`
+		Qc       *CellQc `json:"qc,omitempty"`
+		// all coordinates of the cell if an embedding other than
+		// the default was requested, Pos being the first two
+		Coords []float32 `json:"coords,omitempty"`
+		// values of the requested cell metadata columns
+		Metadata []NameValueType `json:"metadata,omitempty"`
 		Pos
 		Cluster int `json:"cluster"`
 	}
 
 	DatasetMetadata struct {
-		Dataset  string        `json:"dataset"`
-		Clusters []*Cluster    `json:"clusters"`
-		Cells    []*SingleCell `json:"cells"`
+		Dataset string `json:"dataset"`
+		// the embedding the cell positions are in
+		Embedding  string       `json:"embedding"`
+		Embeddings []*Embedding `json:"embeddings"`
+		// the clustering the clusters and cell clusters are from
+		Clustering   string        `json:"clustering"`
+		Clusterings  []*Clustering `json:"clusterings"`
+		Clusters     []*Cluster    `json:"clusters"`
+		Trajectories []*Trajectory `json:"trajectories,omitempty"`
+		Cells        []*SingleCell `json:"cells"`
+		// if the cells were downsampled, the index of each cell
+		// returned as used by Gex and the other cell queries
+		Indexes []uint32 `json:"indexes,omitempty"`
+	}
+
+	MetadataOptions struct {
+		Embedding  string `json:"embedding" form:"embedding"`
+		Clustering string `json:"clustering" form:"clustering"`
+		// cell metadata columns to add to each cell
+		CellMetadata []string          `json:"cellMetadata" form:"cellMetadata"`
+		Downsample   DownsampleOptions `json:"downsample"`
 	}
 
 	//  RNASeqGex struct {
@@ -124,9 +160,36 @@ type (
 		Value float32 `json:"value"`
 	}
 
+	// Options for how expression values are returned
+	GexOptions struct {
+		// transforms applied in order to the values of each gene
+		Transforms []*dat.GexTransform `json:"transforms"`
+		// average each cell's values with those of its neighbours
+		// before any transforms, using the stored neighbour graph
+		// unless a number of nearest neighbours in the embedding
+		// is given
+		Smooth     bool `json:"smooth"`
+		Neighbours int  `json:"neighbours"`
+		// cells failing these have their values removed
+		Qc *QcThresholds `json:"qc"`
+		// only return values for the cells Metadata returns with
+		// the same options
+		Downsample *DownsampleOptions `json:"downsample"`
+	}
+
 	ScrnaDB struct {
-		db  *sql.DB
-		dir string
+		db *sql.DB
+		// writable connection opened on demand for admin changes
+		wdb      *sql.DB
+		genesets *genesets.Libraries
+		// cached neighbour graphs for smoothing
+		graphs *lruCache[*dat.NeighbourGraph]
+		// cached spatial indexes of embeddings for selections
+		trees *lruCache[*spatial.KDTree]
+		// cached decoded tissue images of spatial datasets
+		images *lruCache[*image.RGBA]
+		dir    string
+		wdbMu  sync.Mutex
 	}
 )
 
@@ -136,6 +199,12 @@ const (
 
 	CellCountSql = `SELECT COUNT(cells.id) FROM cells`
 
+	DatasetCellCountSql = `SELECT
+		COUNT(c.id)
+		FROM cells c
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id`
+
 	GenomesSQL = `SELECT DISTINCT
 		g.id,
 		g.public_id,
@@ -214,8 +283,8 @@ const (
 		d.cells,
 		d.description
 		FROM datasets d
-		JOIN genomes g ON d.genome_id = g.id
 		JOIN assemblies a ON d.assembly_id = a.id
+		JOIN genomes g ON a.genome_id = g.id
 		JOIN dataset_permissions dp ON d.id = dp.dataset_id
 		JOIN permissions p ON dp.permission_id = p.id
 		WHERE 
@@ -268,34 +337,55 @@ const (
 		JOIN datasets d ON c.dataset_id = d.id
 		JOIN dataset_permissions dp ON d.id = dp.dataset_id
 		JOIN permissions p ON dp.permission_id = p.id
-		JOIN cluster_metadata cm ON c.id = cm.cluster_id
-		JOIN metadata m ON cm.metadata_id = m.id
+		LEFT JOIN cluster_metadata cm ON c.id = cm.cluster_id
+		LEFT JOIN metadata m ON cm.metadata_id = m.id
 		WHERE
 			<<PERMISSIONS>>
 			AND d.public_id = :id
+			AND c.clustering_id = :clustering
 		ORDER BY c.id, m.name`
 
 	CellsSql = `SELECT
 		c.umap_x,
 		c.umap_y,
 		s.name,
-		cl.label
+		cv.dx,
+		cv.dy,
+		c.n_counts,
+		c.n_features,
+		c.percent_mito,
+		c.doublet_score
 		FROM cells c
 		JOIN samples s ON c.sample_id = s.id
-		JOIN clusters cl ON c.cluster_id = cl.id
 		JOIN datasets d ON s.dataset_id = d.id
+		LEFT JOIN cell_velocities cv ON c.id = cv.cell_id
 		WHERE d.public_id = :id
 		ORDER BY c.id`
 
 	GenesSql = `SELECT 
 		g.id, 
-		g.ensembl_id,
-		g.gene_symbol 
+		g.ensembl,
+		g.gene_symbol,
+		gs.mean,
+		gs.variance,
+		gs.dispersion,
+		gs.dispersion_norm,
+		gs.fraction,
+		gs.highly_variable
 		FROM gex gx
 		JOIN genes g ON gx.gene_id = g.id
+		JOIN gene_stats gs ON gx.id = gs.gex_id
 		JOIN datasets d ON gx.dataset_id = d.id
-		WHERE d.public_id = :id
-		ORDER BY g.gene_symbol`
+		JOIN dataset_permissions dp ON d.id = dp.dataset_id
+		JOIN permissions p ON dp.permission_id = p.id
+		WHERE 
+			<<PERMISSIONS>>
+			AND d.public_id = :id
+			AND gx.gex_type_id = :gex_type
+			AND gs.highly_variable >= :hvg
+		ORDER BY <<ORDER>>
+		LIMIT :limit
+		OFFSET :offset`
 )
 
 // const DATASETS_SQL = `SELECT
@@ -315,7 +405,12 @@ func NewScrnaDB(dir string) *ScrnaDB {
 
 	// defer db.Close()
 
-	return &ScrnaDB{dir: dir, db: sys.Must(sql.Open(db.Sqlite3DB, filepath.Join(dir, "scrna.db"+db.SqliteReadOnlySuffix)))}
+	return &ScrnaDB{dir: dir,
+		db:       sys.Must(sql.Open(db.Sqlite3DB, filepath.Join(dir, "scrna.db"+db.SqliteReadOnlySuffix))),
+		genesets: genesets.NewLibraries(filepath.Join(dir, GeneSetsDir)),
+		graphs:   newLruCache[*dat.NeighbourGraph](MaxCachedGraphs, nil),
+		trees:    newLruCache[*spatial.KDTree](MaxCachedTrees, nil),
+		images:   newLruCache(MaxCachedImageBytes, imageBytes)}
 }
 
 func (sdb *ScrnaDB) Dir() string {
@@ -323,6 +418,13 @@ func (sdb *ScrnaDB) Dir() string {
 }
 
 func (sdb *ScrnaDB) Close() error {
+	sdb.wdbMu.Lock()
+	defer sdb.wdbMu.Unlock()
+
+	if sdb.wdb != nil {
+		sdb.wdb.Close()
+	}
+
 	return sdb.db.Close()
 }
 
@@ -615,6 +717,7 @@ func (sdb *ScrnaDB) GetGenes(datasetId string, geneIds []string, isAdmin bool, p
 
 func (sdb *ScrnaDB) Gex(datasetId string,
 	geneIds []string,
+	options *GexOptions,
 	isAdmin bool,
 	permissions []string) (*dat.GexResults, error) {
 
@@ -638,11 +741,65 @@ func (sdb *ScrnaDB) Gex(datasetId string,
 		Genes:   make([]*dat.GexGene, 0, len(genes)),
 	}
 
+	var cells *CellSet
+
+	if options != nil {
+		cells, err = sdb.qcCells(datasetId, options.Qc)
+
+		if err != nil {
+			return nil, err
+		}
+
+		// downsampling ignores qc so that it picks the same cells
+		// as Metadata
+		subset, err := sdb.downsample(datasetId, options.Downsample)
+
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case subset == nil:
+		case cells == nil:
+			cells = subset
+		default:
+			cells = cells.And(subset)
+		}
+	}
+
+	if cells != nil {
+		ret.Cells = cells.Bitmap()
+	}
+
+	// transforms need the number of cells to account for the
+	// cells with no expression
+	var cellCount int
+
+	if options != nil && len(options.Transforms) > 0 {
+		if cells != nil {
+			cellCount = cells.Count()
+		} else {
+			cellCount, err = sdb.cellCount(datasetId)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var graph *dat.NeighbourGraph
+
+	if options != nil && options.Smooth {
+		graph, err = sdb.neighbourGraph(datasetId, options.Neighbours)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	//var gexCache = make(map[string]*dat.GexGene)
 
 	for _, gene := range genes {
-		gexFile := filepath.Join(sdb.dir, gene.Url)
-
 		//gexData, ok := gexCache[gexFile]
 
 		//if !ok {
@@ -653,7 +810,7 @@ func (sdb *ScrnaDB) Gex(datasetId string,
 		// }
 		// defer f.Close()
 
-		data, err := dat.SeekGexGeneFromDat(gexFile, gene.Offset)
+		data, err := sdb.readGex(gene)
 
 		if err != nil {
 			//log.Debug().Msgf("not able to read gex data for gene %s in dataset %s", gene.GeneSymbol, datasetId)
@@ -709,6 +866,27 @@ func (sdb *ScrnaDB) Gex(datasetId string,
 		//log.Debug().Msgf("hmm %s %f %f", gexType, sample.Value, tpm)
 
 		//datasetResults.Samples = append(datasetResults.Samples, &sample)
+
+		if graph != nil {
+			err = graph.Smooth(data)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if cells != nil {
+			data.Keep(cells.Has)
+		}
+
+		if options != nil {
+			err = data.ApplyTransforms(options.Transforms, cellCount)
+
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		ret.Genes = append(ret.Genes, data)
 
 	}
@@ -716,6 +894,19 @@ func (sdb *ScrnaDB) Gex(datasetId string,
 	return &ret, nil
 }
 
+// cellCount returns the number of cells in a dataset
+func (sdb *ScrnaDB) cellCount(datasetId string) (int, error) {
+	var ret int
+
+	err := sdb.db.QueryRow(DatasetCellCountSql, sql.Named("id", datasetId)).Scan(&ret)
+
+	if err != nil {
+		return -1, err
+	}
+
+	return ret, nil
+}
+
 // func (sdb *Datasetssdb) Metadata(publicId string) (*DatasetClusters, error) {
 
 // 	dataset, err := sdb.dataset(publicId)
@@ -735,65 +926,187 @@ func (sdb *ScrnaDB) Gex(datasetId string,
 // 	return ret, nil
 // }
 
-func (sdb *ScrnaDB) Metadata(datasetId string, isAdmin bool, permissions []string) (*DatasetMetadata, error) {
+// Returns the clusters and cells of a dataset with the cells positioned
+// in the named embedding, or the default umap if embedding is empty, and
+// grouped by the named clustering, or the default one if clustering is
+// empty, optionally only returning a downsampled subset of the cells
+func (sdb *ScrnaDB) Metadata(datasetId string, options *MetadataOptions, isAdmin bool, permissions []string) (*DatasetMetadata, error) {
+	embedding := options.Embedding
 
-	namedArgs := []any{sql.Named("id", datasetId)}
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
 
-	query := sqlite.MakePermissionsSql(ClustersSql, isAdmin, permissions, &namedArgs)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := sdb.db.Query(query, namedArgs...)
+	clusterings, err := sdb.Clusterings(datasetId, isAdmin, permissions)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer rows.Close()
+	cellClusters, err := sdb.cellClusters(datasetId, options.Clustering)
 
-	clusters := make([]*Cluster, 0, 50)
-	//clusterMap := make(map[string]*Cluster)
+	if err != nil {
+		return nil, err
+	}
 
-	var currentCluster *Cluster
+	var cellCount int
+
+	err = sdb.db.QueryRow(CellCountSql).Scan(&cellCount)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells := make([]*SingleCell, 0, cellCount)
+
+	// in this query we do not check for permissions again as we have already
+	// done so above
+	rows, err := sdb.db.Query(CellsSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
 
 	for rows.Next() {
-		var cluster Cluster
-		var metadata ClusterMetadata
+		var cell SingleCell
+		var dx sql.NullFloat64
+		var dy sql.NullFloat64
+		var counts sql.NullInt64
+		var features sql.NullInt64
+		var mito sql.NullFloat64
+		var doublet sql.NullFloat64
 
 		err := rows.Scan(
-			&cluster.Id,
-			&cluster.Label,
-			&cluster.Name,
-			&cluster.CellCount,
-			&cluster.Color,
-			&metadata.Name,
-			&metadata.Value)
+
+			&cell.Pos.X,
+			&cell.Pos.Y,
+			&cell.Sample,
+			&dx,
+			&dy,
+			&counts,
+			&features,
+			&mito,
+			&doublet)
 
 		if err != nil {
 			return nil, err
 		}
 
-		if currentCluster == nil || currentCluster.Id != cluster.Id {
-			// same cluster, add metadata
-			currentCluster = &cluster
-			currentCluster.Metadata = make(map[string]string, 5) // make([]*ClusterMetadata, 0, 5)
-			clusters = append(clusters, currentCluster)
+		if dx.Valid && dy.Valid {
+			cell.Velocity = &Pos{X: dx.Float64, Y: dy.Float64}
 		}
 
-		currentCluster.Metadata[metadata.Name] = metadata.Value
+		cell.Qc = newCellQc(counts, features, mito, doublet)
+
+		if len(cells) < len(cellClusters) {
+			cell.Cluster = cellClusters[len(cells)]
+		}
+
+		cells = append(cells, &cell)
+	}
+
+	ret := DatasetMetadata{
+		Dataset:     datasetId,
+		Embedding:   DefaultEmbedding,
+		Clusterings: clusterings,
+		Clusters:    clusters,
+		Cells:       cells,
 	}
 
-	var cellCount int
+	if _, ok := cellMetadataGroup(options.Clustering); ok {
+		ret.Clustering = options.Clustering
+	}
 
-	err = sdb.db.QueryRow(CellCountSql).Scan(&cellCount)
+	for _, clustering := range clusterings {
+		if matchesClustering(clustering, options.Clustering) {
+			ret.Clustering = clustering.Id
+			break
+		}
+	}
+
+	err = sdb.addCellMetadata(datasetId, options.CellMetadata, cells)
 
 	if err != nil {
 		return nil, err
 	}
 
-	cells := make([]*SingleCell, 0, cellCount)
+	ret.Embeddings, err = sdb.embeddings(datasetId)
 
-	// in this query we do not check for permissions again as we have already
-	// done so above
-	rows, err = sdb.db.Query(CellsSql, sql.Named("id", datasetId))
+	if err != nil {
+		return nil, err
+	}
+
+	if !isDefaultEmbedding(embedding) {
+		coords, err := sdb.embeddingCoords(datasetId, embedding)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if coords.Dimensions < 2 || len(coords.Coords) != len(cells) {
+			return nil, fmt.Errorf("embedding %s cannot be used to position cells", coords.Name)
+		}
+
+		ret.Embedding = coords.Name
+
+		for i, cell := range cells {
+			cell.Coords = coords.Coords[i]
+			cell.Pos = Pos{X: float64(cell.Coords[0]), Y: float64(cell.Coords[1])}
+		}
+	}
+
+	err = sdb.addTrajectories(datasetId, &ret)
+
+	if err != nil {
+		return nil, err
+	}
+
+	subset, err := sdb.downsample(datasetId, &options.Downsample)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if subset != nil {
+		ret.Indexes = subset.Indexes()
+		ret.Cells = make([]*SingleCell, len(ret.Indexes))
+
+		for i, index := range ret.Indexes {
+			ret.Cells[i] = cells[index]
+		}
+	}
+
+	return &ret, nil
+}
+
+// clusters returns the clusters of one of a dataset's clusterings with
+// their metadata if the user is allowed to view the dataset
+func (sdb *ScrnaDB) clusters(datasetId string, clustering string, isAdmin bool, permissions []string) ([]*Cluster, error) {
+	if column, ok := cellMetadataGroup(clustering); ok {
+		_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return sdb.metadataClusters(datasetId, column)
+	}
+
+	clusteringId, err := sdb.clusteringId(datasetId, clustering)
+
+	if err != nil {
+		return nil, err
+	}
+
+	namedArgs := []any{sql.Named("id", datasetId), sql.Named("clustering", clusteringId)}
+
+	query := sqlite.MakePermissionsSql(ClustersSql, isAdmin, permissions, &namedArgs)
+
+	rows, err := sdb.db.Query(query, namedArgs...)
 
 	if err != nil {
 		return nil, err
@@ -801,41 +1114,82 @@ func (sdb *ScrnaDB) Metadata(datasetId string, isAdmin bool, permissions []strin
 
 	defer rows.Close()
 
+	clusters := make([]*Cluster, 0, 50)
+	//clusterMap := make(map[string]*Cluster)
+
+	var currentCluster *Cluster
+
 	for rows.Next() {
-		var cell SingleCell
+		var cluster Cluster
+		var metadataName sql.NullString
+		var metadataValue sql.NullString
 
 		err := rows.Scan(
-
-			&cell.Pos.X,
-			&cell.Pos.Y,
-			&cell.Sample,
-			&cell.Cluster)
+			&cluster.Id,
+			&cluster.Label,
+			&cluster.Name,
+			&cluster.CellCount,
+			&cluster.Color,
+			&metadataName,
+			&metadataValue)
 
 		if err != nil {
 			return nil, err
 		}
 
-		cells = append(cells, &cell)
+		if currentCluster == nil || currentCluster.Id != cluster.Id {
+			// same cluster, add metadata
+			currentCluster = &cluster
+			currentCluster.Metadata = make(map[string]string, 5) // make([]*ClusterMetadata, 0, 5)
+			clusters = append(clusters, currentCluster)
+		}
+
+		// clusters need not have metadata
+		if metadataName.Valid {
+			currentCluster.Metadata[metadataName.String] = metadataValue.String
+		}
 	}
 
-	return &DatasetMetadata{
-		Dataset:  datasetId,
-		Clusters: clusters,
-		Cells:    cells,
-	}, nil
+	return clusters, nil
 }
 
-func (sdb *ScrnaDB) Genes(datasetId string, isAdmin bool, permissions []string) ([]*Gene, error) {
+// Returns the genes of a dataset with the expression statistics of
+// their normalized values sorted by one of the statistics. If
+// highlyVariable is true only the highly variable genes are returned.
+func (sdb *ScrnaDB) Genes(datasetId string,
+	sort GeneSort,
+	highlyVariable bool,
+	limit int,
+	offset int,
+	isAdmin bool,
+	permissions []string) ([]*Gene, error) {
 
 	//log.Debug().Msgf("cripes %v", filepath.Join(cache.dir, cache.dataset.Path))
 
-	// 50k for the num of genes we expect
-	ret := make([]*Gene, 0, 50000)
+	hvg := 0
 
-	namedArgs := []any{sql.Named("id", datasetId)}
+	if highlyVariable {
+		hvg = 1
+	}
+
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]*Gene, 0, limit)
+
+	namedArgs := []any{sql.Named("id", datasetId),
+		sql.Named("gex_type", gexType),
+		sql.Named("hvg", hvg),
+		sql.Named("limit", limit),
+		sql.Named("offset", offset)}
 
 	query := sqlite.MakePermissionsSql(GenesSql, isAdmin, permissions, &namedArgs)
 
+	query = strings.Replace(query, "<<ORDER>>", sort.orderBy(), 1)
+
 	rows, err := sdb.db.Query(query, namedArgs...)
 
 	if err != nil {
@@ -846,22 +1200,37 @@ func (sdb *ScrnaDB) Genes(datasetId string, isAdmin bool, permissions []string)
 
 	for rows.Next() {
 		var gene Gene
+		var stats GeneStats
 
 		err := rows.Scan(
 			&gene.Id,
 			&gene.Ensembl,
-			&gene.GeneSymbol)
+			&gene.GeneSymbol,
+			&stats.Mean,
+			&stats.Variance,
+			&stats.Dispersion,
+			&stats.DispersionNorm,
+			&stats.Fraction,
+			&stats.HighlyVariable)
 
 		if err != nil {
 			return nil, err
 		}
 
+		gene.Stats = &stats
+
 		ret = append(ret, &gene)
 	}
 
 	return ret, nil
 }
 
+// readGex reads the sparse expression vector of a gene from
+// the gex block file it is stored in
+func (sdb *ScrnaDB) readGex(gene *Gene) (*dat.GexGene, error) {
+	return dat.SeekGexGeneFromDat(filepath.Join(sdb.dir, gene.Url), gene.Offset)
+}
+
 func makeInGenesClause(geneIds []string, namedArgs *[]any) string {
 	inPlaceholders := make([]string, len(geneIds))
 
@@ -1,10 +1,13 @@
 package scrnadb
 
 import (
+	"context"
 	"sync"
 
 	"github.com/antonybholmes/go-scrna"
 	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/genesets"
+	"github.com/antonybholmes/go-scrna/tiles"
 	"github.com/antonybholmes/go-sys/db"
 )
 
@@ -41,21 +44,137 @@ func Datasets(assembly string, isAdmin bool, permissions []string) ([]*scrna.Dat
 	return instance.Datasets(assembly, isAdmin, permissions)
 }
 
-func Gex(datasetId string, geneIds []string, isAdmin bool, permissions []string) (*dat.GexResults, error) {
-	return instance.Gex(datasetId, geneIds, isAdmin, permissions)
+func Gex(datasetId string, geneIds []string, options *scrna.GexOptions, isAdmin bool, permissions []string) (*dat.GexResults, error) {
+	return instance.Gex(datasetId, geneIds, options, isAdmin, permissions)
+}
+
+func Coexpression(datasetId string, geneIds []string, thresholds []float32, clustering string, filter string, qc *scrna.QcThresholds, isAdmin bool, permissions []string) (*scrna.CoexpressionResults, error) {
+	return instance.Coexpression(datasetId, geneIds, thresholds, clustering, filter, qc, isAdmin, permissions)
+}
+
+func Pseudobulk(datasetId string, method scrna.PseudobulkMethod, minCells int, clustering string, filter string, qc *scrna.QcThresholds, isAdmin bool, permissions []string) (*scrna.Pseudobulk, error) {
+	return instance.Pseudobulk(datasetId, method, minCells, clustering, filter, qc, isAdmin, permissions)
+}
+
+func CorrelatedGenes(ctx context.Context, datasetId string, geneId string, method scrna.CorrelationMethod, limit int, clustering string, clusters []int, filter string, qc *scrna.QcThresholds, progress scrna.ProgressFunc, isAdmin bool, permissions []string) (*scrna.CorrelationResults, error) {
+	return instance.CorrelatedGenes(ctx, datasetId, geneId, method, limit, clustering, clusters, filter, qc, progress, isAdmin, permissions)
+}
+
+func FilterCells(datasetId string, clustering string, filter string, bitmap bool, isAdmin bool, permissions []string) (*scrna.CellFilterResults, error) {
+	return instance.FilterCellsResults(datasetId, clustering, filter, bitmap, isAdmin, permissions)
+}
+
+func Heatmap(datasetId string, geneIds []string, options *scrna.HeatmapOptions, isAdmin bool, permissions []string) (*scrna.Heatmap, error) {
+	return instance.Heatmap(datasetId, geneIds, options, isAdmin, permissions)
+}
+
+func Composition(datasetId string, options *scrna.CompositionOptions, isAdmin bool, permissions []string) (*scrna.Composition, error) {
+	return instance.Composition(datasetId, options, isAdmin, permissions)
+}
+
+func GeneSetLibraries() ([]*genesets.LibraryInfo, error) {
+	return instance.GeneSetLibraries()
+}
+
+func OverRepresentation(datasetId string, library string, genes []string, options *genesets.EnrichmentOptions, isAdmin bool, permissions []string) (*scrna.OraResults, error) {
+	return instance.OverRepresentation(datasetId, library, genes, options, isAdmin, permissions)
+}
+
+func Gsea(datasetId string, library string, ranked []*genesets.RankedGene, options *genesets.EnrichmentOptions, isAdmin bool, permissions []string) (*scrna.GseaResults, error) {
+	return instance.Gsea(datasetId, library, ranked, options, isAdmin, permissions)
+}
+
+func CellCycle(datasetId string, options *scrna.CellCycleOptions, isAdmin bool, permissions []string) (*scrna.CellCycleResults, error) {
+	return instance.CellCycle(datasetId, options, isAdmin, permissions)
+}
+
+func AnnotateClusters(datasetId string, options *scrna.AnnotationOptions, isAdmin bool, permissions []string) (*scrna.ClusterAnnotations, error) {
+	return instance.AnnotateClusters(datasetId, options, isAdmin, permissions)
+}
+
+func ClusterAnnotations(datasetId string, clustering string, isAdmin bool, permissions []string) (*scrna.ClusterAnnotations, error) {
+	return instance.ClusterAnnotations(datasetId, clustering, isAdmin, permissions)
+}
+
+func AcceptClusterAnnotation(datasetId string, clustering string, label int, name string, isAdmin bool) (string, error) {
+	return instance.AcceptClusterAnnotation(datasetId, clustering, label, name, isAdmin)
+}
+
+func TrajectoryCurves(datasetId string, trajectoryId string, geneIds []string, options *scrna.TrajectoryCurveOptions, isAdmin bool, permissions []string) (*scrna.TrajectoryCurves, error) {
+	return instance.TrajectoryCurves(datasetId, trajectoryId, geneIds, options, isAdmin, permissions)
+}
+
+func VelocityGrid(datasetId string, options *scrna.VelocityGridOptions, isAdmin bool, permissions []string) (*scrna.VelocityGrid, error) {
+	return instance.VelocityGrid(datasetId, options, isAdmin, permissions)
+}
+
+func Embeddings(datasetId string, isAdmin bool, permissions []string) ([]*scrna.Embedding, error) {
+	return instance.Embeddings(datasetId, isAdmin, permissions)
+}
+
+func Embedding(datasetId string, name string, isAdmin bool, permissions []string) (*scrna.EmbeddingCoords, error) {
+	return instance.Embedding(datasetId, name, isAdmin, permissions)
+}
+
+func Lasso(datasetId string, options *scrna.LassoOptions, isAdmin bool, permissions []string) (*scrna.LassoSelection, error) {
+	return instance.Lasso(datasetId, options, isAdmin, permissions)
+}
+
+func Bins(datasetId string, options *scrna.BinOptions, isAdmin bool, permissions []string) (*scrna.EmbeddingBins, error) {
+	return instance.Bins(datasetId, options, isAdmin, permissions)
+}
+
+func Region(datasetId string, options *scrna.RegionOptions, isAdmin bool, permissions []string) (*scrna.RegionCells, error) {
+	return instance.Region(datasetId, options, isAdmin, permissions)
+}
+
+func Tile(datasetId string, embedding string, tile tiles.Tile, options *scrna.TileOptions, isAdmin bool, permissions []string) ([]byte, error) {
+	return instance.Tile(datasetId, embedding, tile, options, isAdmin, permissions)
+}
+
+func SpatialImage(datasetId string, isAdmin bool, permissions []string) (*scrna.SpatialImage, error) {
+	return instance.SpatialImage(datasetId, isAdmin, permissions)
+}
+
+func ImageTile(datasetId string, tile tiles.Tile, isAdmin bool, permissions []string) ([]byte, error) {
+	return instance.ImageTile(datasetId, tile, isAdmin, permissions)
+}
+
+func Figure(datasetId string, kind scrna.FigureKind, options *scrna.FigureOptions, isAdmin bool, permissions []string) ([]byte, error) {
+	return instance.Figure(datasetId, kind, options, isAdmin, permissions)
+}
+
+func Clusterings(datasetId string, isAdmin bool, permissions []string) ([]*scrna.Clustering, error) {
+	return instance.Clusterings(datasetId, isAdmin, permissions)
+}
+
+func CellMetadataColumns(datasetId string, isAdmin bool, permissions []string) ([]*scrna.CellMetadataColumn, error) {
+	return instance.CellMetadataColumns(datasetId, isAdmin, permissions)
+}
+
+func CellMetadata(datasetId string, options *scrna.CellMetadataOptions, isAdmin bool, permissions []string) (*scrna.CellMetadata, error) {
+	return instance.CellMetadata(datasetId, options, isAdmin, permissions)
+}
+
+func Neighbours(datasetId string, cell int, isAdmin bool, permissions []string) (*scrna.CellNeighbours, error) {
+	return instance.Neighbours(datasetId, cell, isAdmin, permissions)
+}
+
+func ExpandSelection(datasetId string, cells []uint32, hops int, isAdmin bool, permissions []string) (*scrna.ExpandedSelection, error) {
+	return instance.ExpandSelection(datasetId, cells, hops, isAdmin, permissions)
 }
 
 // func Clusters(id string) (*scrna.DatasetClusters, error) {
 // 	return instance.Clusters(id)
 // }
 
-func Metadata(datasetId string, isAdmin bool, permissions []string) (*scrna.DatasetMetadata, error) {
-	return instance.Metadata(datasetId, isAdmin, permissions)
+func Metadata(datasetId string, options *scrna.MetadataOptions, isAdmin bool, permissions []string) (*scrna.DatasetMetadata, error) {
+	return instance.Metadata(datasetId, options, isAdmin, permissions)
 }
 
-// func Genes(datasetId string, isAdmin bool, permissions []string) ([]*scrna.Gene, error) {
-// 	return instance.Genes(datasetId, isAdmin, permissions)
-// }
+func Genes(datasetId string, sort scrna.GeneSort, highlyVariable bool, limit int, offset int, isAdmin bool, permissions []string) ([]*scrna.Gene, error) {
+	return instance.Genes(datasetId, sort, highlyVariable, limit, offset, isAdmin, permissions)
+}
 
 func SearchGenes(id string, query string, limit int, isAdmin bool, permissions []string) ([]*scrna.Gene, error) {
 	return instance.SearchGenes(id, query, limit, isAdmin, permissions)
@@ -0,0 +1,157 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/antonybholmes/go-scrna/dat"
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+const (
+	// number of neighbours each cell is averaged with when
+	// smoothing expression
+	DefaultNeighbours = 15
+	MaxNeighbours     = 50
+
+	// number of neighbour graphs kept in memory
+	MaxCachedGraphs = 8
+
+	NeighbourGraphFileSql = `SELECT
+		f.url
+		FROM neighbour_graphs ng
+		JOIN files f ON ng.file_id = f.id
+		JOIN datasets d ON ng.dataset_id = d.id
+		WHERE d.public_id = :id`
+
+	CellPositionsSql = `SELECT
+		c.umap_x,
+		c.umap_y
+		FROM cells c
+		JOIN datasets d ON c.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+)
+
+// neighbourGraph returns the neighbour graph of the cells of a dataset.
+// If k is not given the graph stored at import is used if there is
+// one, otherwise the k nearest neighbour graph is computed from the
+// embedding coordinates. Graphs are cached since smoothing is
+// typically requested for many genes.
+func (sdb *ScrnaDB) neighbourGraph(datasetId string, k int) (*dat.NeighbourGraph, error) {
+	if k <= 0 {
+		graph, err := sdb.graphs.get(datasetId+":stored", func() (*dat.NeighbourGraph, error) {
+			return sdb.storedGraph(datasetId)
+		})
+
+		if err != nil || graph != nil {
+			return graph, err
+		}
+
+		k = DefaultNeighbours
+	}
+
+	k = min(k, MaxNeighbours)
+
+	return sdb.graphs.get(fmt.Sprintf("%s:%d", datasetId, k), func() (*dat.NeighbourGraph, error) {
+		points, err := sdb.cellPositions(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(points) == 0 {
+			return nil, errors.New("dataset has no cells")
+		}
+
+		return knnGraph(points, k), nil
+	})
+}
+
+// storedGraph reads the graph stored at import or returns nil if the
+// dataset does not have one
+func (sdb *ScrnaDB) storedGraph(datasetId string) (*dat.NeighbourGraph, error) {
+	var url string
+
+	err := sdb.db.QueryRow(NeighbourGraphFileSql, sql.Named("id", datasetId)).Scan(&url)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	graph, err := dat.ReadNeighbourGraph(filepath.Join(sdb.dir, url))
+
+	if err != nil {
+		return nil, err
+	}
+
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if graph.Cells() != cellCount {
+		return nil, errors.New("neighbour graph does not match the cells")
+	}
+
+	return graph, nil
+}
+
+// knnGraph links each point to its k nearest other points
+func knnGraph(points []spatial.Point, k int) *dat.NeighbourGraph {
+	tree := spatial.NewKDTree(points)
+
+	ret := dat.NeighbourGraph{
+		Offsets:    make([]uint32, len(points)+1),
+		Neighbours: make([]uint32, 0, len(points)*k),
+	}
+
+	for i, p := range points {
+		// the point itself is usually its own nearest neighbour so
+		// ask for one more and skip it
+		for _, j := range tree.KNearest(p, k+1) {
+			if j != i && len(ret.Neighbours)-int(ret.Offsets[i]) < k {
+				ret.Neighbours = append(ret.Neighbours, uint32(j))
+			}
+		}
+
+		ret.Offsets[i+1] = uint32(len(ret.Neighbours))
+	}
+
+	return &ret
+}
+
+// cellPositions returns the embedding coordinates of each cell in
+// the same order as the cell indexes used by the gex files
+func (sdb *ScrnaDB) cellPositions(datasetId string) ([]spatial.Point, error) {
+	rows, err := sdb.db.Query(CellPositionsSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]spatial.Point, 0, 10000)
+
+	for rows.Next() {
+		var p spatial.Point
+
+		err := rows.Scan(&p.X, &p.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ret = append(ret, p)
+	}
+
+	return ret, nil
+}
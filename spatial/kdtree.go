@@ -0,0 +1,196 @@
+package spatial
+
+import "slices"
+
+type (
+	Point struct {
+		X float64 `json:"x"`
+		Y float64 `json:"y"`
+	}
+
+	// A static 2D kd-tree over a set of points. The tree is implicit:
+	// the median of each sub range of order splits it, alternating
+	// between x and y, so no nodes need to be allocated.
+	KDTree struct {
+		points []Point
+		// indexes of points in tree order
+		order []int
+	}
+
+	neighbour struct {
+		index int
+		dist  float64
+	}
+)
+
+func (p Point) dist2(q Point) float64 {
+	dx := p.X - q.X
+	dy := p.Y - q.Y
+
+	return dx*dx + dy*dy
+}
+
+func (p Point) coord(axis int) float64 {
+	if axis == 0 {
+		return p.X
+	}
+
+	return p.Y
+}
+
+func NewKDTree(points []Point) *KDTree {
+	tree := KDTree{points: points, order: make([]int, len(points))}
+
+	for i := range tree.order {
+		tree.order[i] = i
+	}
+
+	tree.build(0, len(points), 0)
+
+	return &tree
+}
+
+func (tree *KDTree) build(lo int, hi int, axis int) {
+	if hi-lo <= 1 {
+		return
+	}
+
+	sub := tree.order[lo:hi]
+
+	slices.SortFunc(sub, func(a, b int) int {
+		ca := tree.points[a].coord(axis)
+		cb := tree.points[b].coord(axis)
+
+		switch {
+		case ca < cb:
+			return -1
+		case ca > cb:
+			return 1
+		default:
+			return a - b
+		}
+	})
+
+	mid := (lo + hi) / 2
+
+	tree.build(lo, mid, 1-axis)
+	tree.build(mid+1, hi, 1-axis)
+}
+
+func (tree *KDTree) Len() int {
+	return len(tree.points)
+}
+
+func (tree *KDTree) Point(i int) Point {
+	return tree.points[i]
+}
+
+// KNearest returns the indexes of the k points closest to p, nearest
+// first. If p is itself one of the points it is included.
+func (tree *KDTree) KNearest(p Point, k int) []int {
+	k = min(k, len(tree.points))
+
+	if k <= 0 {
+		return []int{}
+	}
+
+	// the best candidates so far sorted by distance
+	best := make([]neighbour, 0, k+1)
+
+	tree.nearest(p, k, 0, len(tree.order), 0, &best)
+
+	ret := make([]int, len(best))
+
+	for i, n := range best {
+		ret[i] = n.index
+	}
+
+	return ret
+}
+
+func (tree *KDTree) nearest(p Point, k int, lo int, hi int, axis int, best *[]neighbour) {
+	if lo >= hi {
+		return
+	}
+
+	mid := (lo + hi) / 2
+	index := tree.order[mid]
+	q := tree.points[index]
+
+	d := p.dist2(q)
+
+	if len(*best) < k || d < (*best)[len(*best)-1].dist ||
+		(d == (*best)[len(*best)-1].dist && index < (*best)[len(*best)-1].index) {
+		// insert keeping the candidates sorted, ties broken by index
+		// so results are deterministic
+		i, _ := slices.BinarySearchFunc(*best, neighbour{index, d}, func(a, b neighbour) int {
+			switch {
+			case a.dist < b.dist:
+				return -1
+			case a.dist > b.dist:
+				return 1
+			default:
+				return a.index - b.index
+			}
+		})
+
+		*best = slices.Insert(*best, i, neighbour{index, d})
+
+		if len(*best) > k {
+			*best = (*best)[:k]
+		}
+	}
+
+	diff := p.coord(axis) - q.coord(axis)
+
+	// search the side p is on first as it is most likely
+	// to contain the nearest points
+	nearLo, nearHi, farLo, farHi := lo, mid, mid+1, hi
+
+	if diff > 0 {
+		nearLo, nearHi, farLo, farHi = mid+1, hi, lo, mid
+	}
+
+	tree.nearest(p, k, nearLo, nearHi, 1-axis, best)
+
+	if len(*best) < k || diff*diff <= (*best)[len(*best)-1].dist {
+		tree.nearest(p, k, farLo, farHi, 1-axis, best)
+	}
+}
+
+// InRect returns the indexes of the points inside r, including those
+// on its edges, in ascending order
+func (tree *KDTree) InRect(r Rect) []int {
+	ret := make([]int, 0, 100)
+
+	tree.inRect(r, 0, len(tree.order), 0, &ret)
+
+	slices.Sort(ret)
+
+	return ret
+}
+
+func (tree *KDTree) inRect(r Rect, lo int, hi int, axis int, ret *[]int) {
+	if lo >= hi {
+		return
+	}
+
+	mid := (lo + hi) / 2
+	index := tree.order[mid]
+	q := tree.points[index]
+
+	if r.Contains(q) {
+		*ret = append(*ret, index)
+	}
+
+	c := q.coord(axis)
+
+	// points equal to the split can be on either side
+	if r.Min.coord(axis) <= c {
+		tree.inRect(r, lo, mid, 1-axis, ret)
+	}
+
+	if r.Max.coord(axis) >= c {
+		tree.inRect(r, mid+1, hi, 1-axis, ret)
+	}
+}
@@ -0,0 +1,47 @@
+package spatial
+
+// A closed polygon given by its vertices in order; the last vertex
+// is joined to the first
+type Polygon []Point
+
+func (poly Polygon) Bounds() Rect {
+	return Bounds(poly)
+}
+
+// Contains uses the even-odd rule so self intersecting lassos
+// behave as users expect
+func (poly Polygon) Contains(p Point) bool {
+	inside := false
+
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a := poly[i]
+		b := poly[j]
+
+		if (a.Y > p.Y) != (b.Y > p.Y) &&
+			p.X < (b.X-a.X)*(p.Y-a.Y)/(b.Y-a.Y)+a.X {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// Within returns the indexes of the points of a tree inside the
+// polygon in ascending order
+func (poly Polygon) Within(tree *KDTree) []int {
+	if len(poly) < 3 {
+		return []int{}
+	}
+
+	candidates := tree.InRect(poly.Bounds())
+
+	ret := candidates[:0]
+
+	for _, i := range candidates {
+		if poly.Contains(tree.Point(i)) {
+			ret = append(ret, i)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,37 @@
+package spatial
+
+import "math"
+
+type Rect struct {
+	Min Point `json:"min"`
+	Max Point `json:"max"`
+}
+
+func (r *Rect) Width() float64 {
+	return r.Max.X - r.Min.X
+}
+
+func (r *Rect) Height() float64 {
+	return r.Max.Y - r.Min.Y
+}
+
+func (r *Rect) Contains(p Point) bool {
+	return p.X >= r.Min.X && p.X <= r.Max.X && p.Y >= r.Min.Y && p.Y <= r.Max.Y
+}
+
+// Bounds returns the smallest rectangle containing all of the points
+func Bounds(points []Point) Rect {
+	ret := Rect{
+		Min: Point{X: math.Inf(1), Y: math.Inf(1)},
+		Max: Point{X: math.Inf(-1), Y: math.Inf(-1)},
+	}
+
+	for _, p := range points {
+		ret.Min.X = min(ret.Min.X, p.X)
+		ret.Min.Y = min(ret.Min.Y, p.Y)
+		ret.Max.X = max(ret.Max.X, p.X)
+		ret.Max.Y = max(ret.Max.Y, p.Y)
+	}
+
+	return ret
+}
@@ -0,0 +1,221 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+	"github.com/antonybholmes/go-scrna/tiles"
+	"github.com/antonybholmes/go-sys/log"
+)
+
+type (
+	// The tissue image of a spatial dataset. The spatial embedding has
+	// the position of each spot in full resolution image pixels with y
+	// negated so that the tissue is the right way up; Scale converts
+	// these to pixels of the stored image.
+	SpatialImage struct {
+		Dataset   string  `json:"dataset"`
+		Embedding string  `json:"embedding"`
+		Width     int     `json:"width"`
+		Height    int     `json:"height"`
+		Scale     float64 `json:"scale"`
+		// in full resolution pixels, 0 if not known
+		SpotDiameter float64 `json:"spotDiameter"`
+		// region of the spatial embedding covered by the tiles of
+		// both the image and the spots
+		World spatial.Rect `json:"world"`
+		file  string
+	}
+)
+
+const (
+	// name of the embedding holding the coordinates of spatial datasets
+	SpatialEmbedding = "spatial"
+
+	// style directory of cached image tiles
+	imageTileStyle = "image"
+
+	// memory decoded tissue images may use before the least recently
+	// used are dropped
+	MaxCachedImageBytes = 1 << 30
+
+	SpatialImageSql = `SELECT
+		f.url,
+		si.scale,
+		si.spot_diameter
+		FROM spatial_images si
+		JOIN datasets d ON si.dataset_id = d.id
+		JOIN files f ON si.file_id = f.id
+		WHERE d.public_id = :id`
+)
+
+// Returns the tissue image of a spatial dataset
+func (sdb *ScrnaDB) SpatialImage(datasetId string, isAdmin bool, permissions []string) (*SpatialImage, error) {
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret, err := sdb.spatialImage(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ret == nil {
+		return nil, fmt.Errorf("dataset %s has no tissue image", datasetId)
+	}
+
+	return ret, nil
+}
+
+// Returns a png tile of the tissue image of a spatial dataset. Tiles
+// line up with those of the spatial embedding so spots can be drawn
+// over the tissue.
+func (sdb *ScrnaDB) ImageTile(datasetId string, tile tiles.Tile, isAdmin bool, permissions []string) ([]byte, error) {
+	if !tile.IsValid() {
+		return nil, fmt.Errorf("invalid tile %d/%d/%d", tile.Z, tile.X, tile.Y)
+	}
+
+	info, err := sdb.SpatialImage(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := sdb.tileDir(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(dir,
+		SpatialEmbedding,
+		imageTileStyle,
+		strconv.Itoa(tile.Z),
+		strconv.Itoa(tile.X),
+		strconv.Itoa(tile.Y)+".png")
+
+	data, err := os.ReadFile(file)
+
+	if err == nil {
+		return data, nil
+	}
+
+	src, err := sdb.tissueImage(datasetId, info.file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = tiles.EncodePng(tiles.RenderImage(src, info.Scale, info.World, tile))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = writeTile(file, data)
+
+	if err != nil {
+		log.Error().Msgf("caching tile %s: %s", file, err)
+	}
+
+	return data, nil
+}
+
+// spatialImage returns the tissue image of a dataset or nil if it does
+// not have one
+func (sdb *ScrnaDB) spatialImage(datasetId string) (*SpatialImage, error) {
+	ret := SpatialImage{Dataset: datasetId, Embedding: SpatialEmbedding}
+
+	var url string
+
+	err := sdb.db.QueryRow(SpatialImageSql, sql.Named("id", datasetId)).
+		Scan(&url, &ret.Scale, &ret.SpotDiameter)
+
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if ret.Scale <= 0 {
+		return nil, errors.New("tissue image scale must be positive")
+	}
+
+	ret.file = filepath.Join(sdb.dir, url)
+
+	// only the header is read to get the size
+	f, err := os.Open(ret.file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	config, _, err := image.DecodeConfig(f)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Width = config.Width
+	ret.Height = config.Height
+	ret.World = tiles.ImageWorld(ret.Width, ret.Height, ret.Scale)
+
+	return &ret, nil
+}
+
+// tissueImage decodes a tissue image, caching it so that rendering the
+// tiles of a view only decodes it once. Decoded images can be large
+// so the cache is bounded by their size.
+func (sdb *ScrnaDB) tissueImage(datasetId string, file string) (*image.RGBA, error) {
+	return sdb.images.get(datasetId, func() (*image.RGBA, error) {
+		f, err := os.Open(file)
+
+		if err != nil {
+			return nil, err
+		}
+
+		defer f.Close()
+
+		src, _, err := image.Decode(f)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return tiles.ToRGBA(src), nil
+	})
+}
+
+// imageBytes is the memory used by the pixels of an image
+func imageBytes(img *image.RGBA) int {
+	return len(img.Pix)
+}
+
+func isSpatialEmbedding(name string) bool {
+	return strings.EqualFold(name, SpatialEmbedding)
+}
+
+// spotRadius returns the radius in pixels of spots drawn on a tile at
+// zoom z so that they match the tissue image
+func spotRadius(info *SpatialImage, z int) int {
+	pixels := float64(tiles.TileSize*(int(1)<<z)) / info.World.Width()
+
+	return max(int(math.Round(info.SpotDiameter/2*pixels)), 1)
+}
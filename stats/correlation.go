@@ -0,0 +1,92 @@
+package stats
+
+import (
+	"math"
+	"slices"
+)
+
+// Ranks returns the ranks (1 based) of values with ties given the
+// average of their ranks
+func Ranks(values []float64) []float64 {
+	order := make([]int, len(values))
+
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		switch {
+		case values[a] < values[b]:
+			return -1
+		case values[a] > values[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	ret := make([]float64, len(values))
+
+	for start := 0; start < len(order); {
+		end := start + 1
+
+		for end < len(order) && values[order[end]] == values[order[start]] {
+			end++
+		}
+
+		r := float64(start+end+1) / 2
+
+		for p := start; p < end; p++ {
+			ret[order[p]] = r
+		}
+
+		start = end
+	}
+
+	return ret
+}
+
+// Pearson returns the Pearson correlation of two equal length
+// vectors or 0 if either has no variance
+func Pearson(x []float64, y []float64) float64 {
+	n := float64(len(x))
+
+	if n == 0 {
+		return 0
+	}
+
+	var meanX float64
+	var meanY float64
+
+	for i := range x {
+		meanX += x[i]
+		meanY += y[i]
+	}
+
+	meanX /= n
+	meanY /= n
+
+	var sxy float64
+	var sxx float64
+	var syy float64
+
+	for i := range x {
+		dx := x[i] - meanX
+		dy := y[i] - meanY
+		sxy += dx * dy
+		sxx += dx * dx
+		syy += dy * dy
+	}
+
+	if sxx == 0 || syy == 0 {
+		return 0
+	}
+
+	return sxy / math.Sqrt(sxx*syy)
+}
+
+// Spearman returns the Spearman rank correlation of two equal
+// length vectors
+func Spearman(x []float64, y []float64) float64 {
+	return Pearson(Ranks(x), Ranks(y))
+}
@@ -0,0 +1,224 @@
+package stats
+
+import (
+	"math"
+	"slices"
+)
+
+const (
+	maxIterations = 300
+	epsilon       = 1e-14
+	tiny          = 1e-300
+)
+
+// RegularizedGammaQ returns the upper regularized incomplete gamma
+// function Q(a, x) = 1 - P(a, x)
+func RegularizedGammaQ(a float64, x float64) float64 {
+	if x <= 0 || a <= 0 {
+		return 1
+	}
+
+	if x < a+1 {
+		return 1 - gammaSeries(a, x)
+	}
+
+	return gammaContinuedFraction(a, x)
+}
+
+// series expansion of P(a, x), converges quickly for x < a + 1
+func gammaSeries(a float64, x float64) float64 {
+	lg, _ := math.Lgamma(a)
+
+	ap := a
+	sum := 1 / a
+	del := sum
+
+	for range maxIterations {
+		ap++
+		del *= x / ap
+		sum += del
+
+		if math.Abs(del) < math.Abs(sum)*epsilon {
+			break
+		}
+	}
+
+	return sum * math.Exp(-x+a*math.Log(x)-lg)
+}
+
+// continued fraction for Q(a, x), converges quickly for x >= a + 1
+func gammaContinuedFraction(a float64, x float64) float64 {
+	lg, _ := math.Lgamma(a)
+
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+
+	for i := 1; i <= maxIterations; i++ {
+		an := -float64(i) * (float64(i) - a)
+		b += 2
+
+		d = an*d + b
+
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+
+		c = b + an/c
+
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+
+		d = 1 / d
+		del := d * c
+		h *= del
+
+		if math.Abs(del-1) < epsilon {
+			break
+		}
+	}
+
+	return math.Exp(-x+a*math.Log(x)-lg) * h
+}
+
+// RegularizedBeta returns the regularized incomplete beta function
+// I_x(a, b)
+func RegularizedBeta(x float64, a float64, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+
+	if x >= 1 {
+		return 1
+	}
+
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+
+	front := math.Exp(lab - la - lb + a*math.Log(x) + b*math.Log1p(-x))
+
+	// use the symmetry relation where the continued fraction
+	// converges faster
+	if x < (a+1)/(a+b+2) {
+		return front * betaContinuedFraction(x, a, b) / a
+	}
+
+	return 1 - front*betaContinuedFraction(1-x, b, a)/b
+}
+
+func betaContinuedFraction(x float64, a float64, b float64) float64 {
+	qab := a + b
+	qap := a + 1
+	qam := a - 1
+
+	c := 1.0
+	d := 1 - qab*x/qap
+
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+
+	d = 1 / d
+	h := d
+
+	for m := 1; m <= maxIterations; m++ {
+		fm := float64(m)
+		m2 := 2 * fm
+
+		// even step
+		aa := fm * (b - fm) * x / ((qam + m2) * (a + m2))
+		d = 1 + aa*d
+
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+
+		c = 1 + aa/c
+
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+
+		d = 1 / d
+		h *= d * c
+
+		// odd step
+		aa = -(a + fm) * (qab + fm) * x / ((a + m2) * (qap + m2))
+		d = 1 + aa*d
+
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+
+		c = 1 + aa/c
+
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+
+		d = 1 / d
+		del := d * c
+		h *= del
+
+		if math.Abs(del-1) < epsilon {
+			break
+		}
+	}
+
+	return h
+}
+
+// ChiSquareSf returns the probability that a chi-square variable with
+// df degrees of freedom is at least x
+func ChiSquareSf(x float64, df float64) float64 {
+	return RegularizedGammaQ(df/2, x/2)
+}
+
+// StudentTTwoSided returns the two-sided p-value of a t statistic
+// with df degrees of freedom
+func StudentTTwoSided(t float64, df float64) float64 {
+	if math.IsNaN(t) {
+		return 1
+	}
+
+	return RegularizedBeta(df/(df+t*t), df/2, 0.5)
+}
+
+// BenjaminiHochberg returns false discovery rate adjusted p-values
+// in the same order as p
+func BenjaminiHochberg(p []float64) []float64 {
+	n := len(p)
+
+	order := make([]int, n)
+
+	for i := range order {
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		switch {
+		case p[a] < p[b]:
+			return -1
+		case p[a] > p[b]:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	ret := make([]float64, n)
+
+	q := 1.0
+
+	// walk from the largest p so the adjusted values are monotone
+	for rank := n; rank > 0; rank-- {
+		i := order[rank-1]
+		q = min(q, p[i]*float64(n)/float64(rank))
+		ret[i] = q
+	}
+
+	return ret
+}
@@ -0,0 +1,239 @@
+package stats
+
+import (
+	"math"
+)
+
+type (
+	// One merge of a hierarchical clustering. Left and Right are
+	// either leaf indexes (< n) or n+i for the cluster formed by
+	// the i-th merge, as in scipy's linkage matrix.
+	Merge struct {
+		Left   int     `json:"left"`
+		Right  int     `json:"right"`
+		Height float64 `json:"height"`
+		Size   int     `json:"size"`
+	}
+
+	Dendrogram struct {
+		Merges []*Merge `json:"merges"`
+		// leaves in the order they appear in the dendrogram
+		Order []int `json:"order"`
+	}
+)
+
+// Euclidean distance between two equal length vectors
+func Euclidean(a []float64, b []float64) float64 {
+	var d float64
+
+	for i := range a {
+		x := a[i] - b[i]
+		d += x * x
+	}
+
+	return math.Sqrt(d)
+}
+
+// Average linkage (UPGMA) hierarchical clustering of the rows of
+// data using the nearest neighbour chain algorithm which needs
+// O(n^2) time and memory
+func AverageLinkage(data [][]float64) *Dendrogram {
+	n := len(data)
+
+	ret := Dendrogram{Merges: make([]*Merge, 0, max(n-1, 0))}
+
+	if n == 0 {
+		return &ret
+	}
+
+	// condensed upper triangle distance matrix
+	dist := make([]float64, n*(n-1)/2)
+
+	index := func(i int, j int) int {
+		if i > j {
+			i, j = j, i
+		}
+
+		return n*i - i*(i+1)/2 + j - i - 1
+	}
+
+	for i := range n {
+		for j := i + 1; j < n; j++ {
+			dist[index(i, j)] = Euclidean(data[i], data[j])
+		}
+	}
+
+	// the active clusters are identified by the index of one of
+	// their leaves, id maps that to the node id used in the merges
+	size := make([]int, n)
+	id := make([]int, n)
+	active := make([]bool, n)
+
+	for i := range n {
+		size[i] = 1
+		id[i] = i
+		active[i] = true
+	}
+
+	chain := make([]int, 0, n)
+
+	for len(ret.Merges) < n-1 {
+		if len(chain) == 0 {
+			for i := range n {
+				if active[i] {
+					chain = append(chain, i)
+					break
+				}
+			}
+		}
+
+		for {
+			a := chain[len(chain)-1]
+
+			// prefer the previous element of the chain on ties so
+			// that the chain always terminates
+			b := -1
+			best := math.Inf(1)
+
+			if len(chain) > 1 {
+				b = chain[len(chain)-2]
+				best = dist[index(a, b)]
+			}
+
+			for i := range n {
+				if i != a && active[i] && dist[index(a, i)] < best {
+					best = dist[index(a, i)]
+					b = i
+				}
+			}
+
+			if len(chain) > 1 && b == chain[len(chain)-2] {
+				chain = chain[:len(chain)-2]
+
+				// keep the lower index as the representative of
+				// the merged cluster
+				if b < a {
+					a, b = b, a
+				}
+
+				ret.Merges = append(ret.Merges, &Merge{
+					Left:   min(id[a], id[b]),
+					Right:  max(id[a], id[b]),
+					Height: best,
+					Size:   size[a] + size[b],
+				})
+
+				// Lance-Williams update for average linkage
+				for i := range n {
+					if i != a && i != b && active[i] {
+						dist[index(a, i)] = (float64(size[a])*dist[index(a, i)] +
+							float64(size[b])*dist[index(b, i)]) / float64(size[a]+size[b])
+					}
+				}
+
+				active[b] = false
+				size[a] += size[b]
+				id[a] = n + len(ret.Merges) - 1
+
+				break
+			}
+
+			chain = append(chain, b)
+		}
+	}
+
+	// nn-chain finds merges out of height order so sort them as
+	// a dendrogram would be drawn, renumbering the internal nodes
+	ret.Merges = sortMerges(ret.Merges, n)
+
+	ret.Order = leafOrder(ret.Merges, n)
+
+	return &ret
+}
+
+// leafOrder lists the leaves from left to right
+func leafOrder(merges []*Merge, n int) []int {
+	if n == 0 {
+		return []int{}
+	}
+
+	if len(merges) == 0 {
+		return []int{0}
+	}
+
+	order := make([]int, 0, n)
+
+	stack := []int{n + len(merges) - 1}
+
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		if node < n {
+			order = append(order, node)
+			continue
+		}
+
+		m := merges[node-n]
+
+		// push right first so left is visited first
+		stack = append(stack, m.Right, m.Left)
+	}
+
+	return order
+}
+
+// sortMerges orders merges by height, keeping children before
+// their parents, and renumbers the internal nodes to match
+func sortMerges(merges []*Merge, n int) []*Merge {
+	ret := make([]*Merge, 0, len(merges))
+
+	// new id of each internal node once placed
+	placed := make([]int, len(merges))
+
+	for i := range placed {
+		placed[i] = -1
+	}
+
+	ready := func(node int) bool {
+		return node < n || placed[node-n] != -1
+	}
+
+	for len(ret) < len(merges) {
+		next := -1
+
+		for i, m := range merges {
+			if placed[i] != -1 || !ready(m.Left) || !ready(m.Right) {
+				continue
+			}
+
+			if next == -1 || m.Height < merges[next].Height {
+				next = i
+			}
+		}
+
+		m := merges[next]
+
+		renumber := func(node int) int {
+			if node < n {
+				return node
+			}
+
+			return n + placed[node-n]
+		}
+
+		left := renumber(m.Left)
+		right := renumber(m.Right)
+
+		ret = append(ret, &Merge{
+			Left:   min(left, right),
+			Right:  max(left, right),
+			Height: m.Height,
+			Size:   m.Size,
+		})
+
+		placed[next] = len(ret) - 1
+	}
+
+	return ret
+}
@@ -0,0 +1,67 @@
+package stats
+
+import "math"
+
+// logChoose returns log(n choose k)
+func logChoose(n int, k int) float64 {
+	a, _ := math.Lgamma(float64(n + 1))
+	b, _ := math.Lgamma(float64(k + 1))
+	c, _ := math.Lgamma(float64(n - k + 1))
+
+	return a - b - c
+}
+
+// HypergeometricLogPmf returns the log probability of drawing k
+// successes in n draws from a population of size N containing
+// K successes
+func HypergeometricLogPmf(k int, N int, K int, n int) float64 {
+	if k < max(0, n+K-N) || k > min(n, K) {
+		return math.Inf(-1)
+	}
+
+	return logChoose(K, k) + logChoose(N-K, n-k) - logChoose(N, n)
+}
+
+// HypergeometricSf returns the probability of drawing at least k
+// successes in n draws from a population of size N containing
+// K successes, i.e. the over-representation p-value
+func HypergeometricSf(k int, N int, K int, n int) float64 {
+	var p float64
+
+	for i := max(k, 0); i <= min(n, K); i++ {
+		p += math.Exp(HypergeometricLogPmf(i, N, K, n))
+	}
+
+	return min(p, 1)
+}
+
+// FisherExact returns the two-sided p-value of Fisher's exact test
+// for the 2x2 table
+//
+//	a b
+//	c d
+//
+// summing the probabilities of all tables with the same margins that
+// are no more likely than the observed one
+func FisherExact(a int, b int, c int, d int) float64 {
+	N := a + b + c + d
+	K := a + c
+	n := a + b
+
+	observed := HypergeometricLogPmf(a, N, K, n)
+
+	// allow for rounding when comparing equally likely tables
+	threshold := observed + 1e-7
+
+	var p float64
+
+	for k := max(0, n+K-N); k <= min(n, K); k++ {
+		lp := HypergeometricLogPmf(k, N, K, n)
+
+		if lp <= threshold {
+			p += math.Exp(lp)
+		}
+	}
+
+	return min(p, 1)
+}
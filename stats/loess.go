@@ -0,0 +1,83 @@
+package stats
+
+import "math"
+
+// Loess fits a locally weighted linear regression of y on x at each of
+// the points at. x must be sorted in ascending order and w gives the
+// prior weight of each observation. span is the fraction of the
+// observations used for each local fit, which are weighted by the
+// tricube of their distance from the point. NaN is returned where
+// there is no data to fit.
+func Loess(x []float64, y []float64, w []float64, at []float64, span float64) []float64 {
+	n := len(x)
+
+	ret := make([]float64, len(at))
+
+	q := max(int(math.Ceil(span*float64(n))), 2)
+	q = min(q, n)
+
+	lo := 0
+
+	for i, t := range at {
+		if n == 0 {
+			ret[i] = math.NaN()
+			continue
+		}
+
+		// slide a window of q points so it is as close to t as
+		// possible; at are usually sorted so the window only
+		// moves forwards but restart if not
+		if lo+q > n || (lo > 0 && t < x[lo]) {
+			lo = 0
+		}
+
+		for lo+q < n && t-x[lo] > x[lo+q]-t {
+			lo++
+		}
+
+		hi := lo + q
+
+		h := max(math.Abs(t-x[lo]), math.Abs(x[hi-1]-t))
+
+		var sw, swx, swy, swxx, swxy float64
+
+		for j := lo; j < hi; j++ {
+			k := 1.0
+
+			if h > 0 {
+				u := math.Abs(x[j]-t) / (h * 1.0001)
+				k = 1 - u*u*u
+				k = k * k * k
+			}
+
+			k *= w[j]
+
+			sw += k
+			swx += k * x[j]
+			swy += k * y[j]
+			swxx += k * x[j] * x[j]
+			swxy += k * x[j] * y[j]
+		}
+
+		if sw == 0 {
+			ret[i] = math.NaN()
+			continue
+		}
+
+		mx := swx / sw
+		my := swy / sw
+		sxx := swxx/sw - mx*mx
+
+		// fall back to the local mean if x does not vary
+		if sxx <= 1e-12 {
+			ret[i] = my
+			continue
+		}
+
+		slope := (swxy/sw - mx*my) / sxx
+
+		ret[i] = my + slope*(t-mx)
+	}
+
+	return ret
+}
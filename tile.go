@@ -0,0 +1,410 @@
+package scrna
+
+import (
+	"database/sql"
+	"fmt"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+	"github.com/antonybholmes/go-scrna/tiles"
+	"github.com/antonybholmes/go-sys/log"
+)
+
+type (
+	// Cells are colored by cluster unless a gene or numeric cell
+	// metadata column is given in which case they are colored by its
+	// value
+	TileOptions struct {
+		// clustering whose colors are used, the default if empty
+		Clustering string `json:"clustering" form:"clustering"`
+		Gene       string `json:"gene" form:"gene"`
+		Metadata   string `json:"metadata" form:"metadata"`
+		Colormap   string `json:"colormap" form:"colormap"`
+		// value mapped to the top of the colormap, the gene's or
+		// column's maximum if 0
+		Max    float64 `json:"max" form:"max"`
+		Radius int     `json:"radius" form:"radius"`
+	}
+)
+
+const (
+	// rendered tiles are cached in this directory of the data dir
+	TilesDir = "tiles"
+
+	DefaultTileRadius = 2
+	MaxTileRadius     = 16
+
+	DatasetImportedSql = `SELECT
+		d.imported_at
+		FROM datasets d
+		WHERE d.public_id = :id`
+)
+
+var (
+	// cells without expression are drawn in light grey
+	tileZeroColor = color.RGBA{R: 220, G: 220, B: 220, A: 255}
+
+	unsafeTileName = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+)
+
+// Returns a png tile of the cells of an embedding. Tiles are cached on
+// disk so each is only rendered once for a given style. Styles are
+// keyed by the gene or names they resolve to so that the cache only
+// grows with the data, and tiles with a custom max are never cached
+// since it can be any number.
+func (sdb *ScrnaDB) Tile(datasetId string,
+	embedding string,
+	tile tiles.Tile,
+	options *TileOptions,
+	isAdmin bool,
+	permissions []string) ([]byte, error) {
+
+	if !tile.IsValid() {
+		return nil, fmt.Errorf("invalid tile %d/%d/%d", tile.Z, tile.X, tile.Y)
+	}
+
+	// also checks the user can view the dataset
+	clusters, err := sdb.clusters(datasetId, options.Clustering, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// spots of spatial datasets are drawn in the world of the tissue
+	// image so the tiles of both line up
+	var tissue *SpatialImage
+
+	if isSpatialEmbedding(embedding) {
+		tissue, err = sdb.spatialImage(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// only a requested radius is limited since spots must match the
+	// tissue however far in the view zooms
+	radius := min(options.Radius, MaxTileRadius)
+
+	if radius <= 0 {
+		radius = DefaultTileRadius
+
+		if tissue != nil && tissue.SpotDiameter > 0 {
+			radius = spotRadius(tissue, tile.Z)
+		}
+	}
+
+	var cmap tiles.Colormap
+	var cmapName string
+	var gene *Gene
+
+	style := fmt.Sprintf("clusters-%s-r%d", tileStyleName(options.Clustering), radius)
+
+	if options.Gene != "" || options.Metadata != "" {
+		cmapName, err = tiles.ColormapName(options.Colormap)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cmap, err = tiles.ParseColormap(cmapName)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if options.Gene != "" {
+		gene, err = sdb.tileGene(datasetId, options.Gene, isAdmin, permissions)
+
+		if err != nil {
+			return nil, err
+		}
+
+		style = fmt.Sprintf("gene-%s-%s-r%d", gene.Id, cmapName, radius)
+	} else if options.Metadata != "" {
+		style = fmt.Sprintf("metadata-%s-%s-r%d", tileStyleName(options.Metadata), cmapName, radius)
+	}
+
+	cache := options.Max <= 0
+
+	var file string
+
+	if cache {
+		dir, err := sdb.tileDir(datasetId)
+
+		if err != nil {
+			return nil, err
+		}
+
+		file = filepath.Join(dir,
+			safeTileName(embeddingName(embedding)),
+			safeTileName(style),
+			strconv.Itoa(tile.Z),
+			strconv.Itoa(tile.X),
+			strconv.Itoa(tile.Y)+".png")
+
+		data, err := os.ReadFile(file)
+
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	tree, err := sdb.spatialIndex(datasetId, embedding)
+
+	if err != nil {
+		return nil, err
+	}
+
+	colors := make([]color.RGBA, tree.Len())
+
+	var order []float64
+
+	if gene != nil {
+		order, err = sdb.tileExpression(gene, tree.Len())
+
+		if err != nil {
+			return nil, err
+		}
+
+		m := options.Max
+
+		if m <= 0 {
+			for _, v := range order {
+				m = max(m, v)
+			}
+		}
+
+		for i, v := range order {
+			if v > 0 && m > 0 {
+				colors[i] = cmap.At(v / m)
+			} else {
+				colors[i] = tileZeroColor
+			}
+		}
+	} else if options.Metadata != "" {
+		_, order, err = sdb.cellMetadataNumbers(datasetId, options.Metadata)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(order) != len(colors) {
+			return nil, fmt.Errorf("embedding does not match the cells")
+		}
+
+		lo, hi := numberRange(order)
+
+		if options.Max > 0 {
+			hi = options.Max
+		}
+
+		for i, v := range order {
+			if math.IsNaN(v) {
+				// missing values are drawn first
+				colors[i] = tileZeroColor
+				order[i] = math.Inf(-1)
+			} else if hi > lo {
+				colors[i] = cmap.At((v - lo) / (hi - lo))
+			} else {
+				colors[i] = cmap.At(1)
+			}
+		}
+	} else {
+		err = sdb.tileClusterColors(datasetId, options.Clustering, clusters, colors)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var world spatial.Rect
+
+	if tissue != nil {
+		world = tissue.World
+	} else {
+		points := make([]spatial.Point, tree.Len())
+
+		for i := range points {
+			points[i] = tree.Point(i)
+		}
+
+		world = tiles.World(spatial.Bounds(points))
+	}
+
+	img := tiles.Render(tree, colors, order, world, tile, radius)
+
+	data, err := tiles.EncodePng(img)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cache {
+		// a failure to cache is not a failure to render
+		err = writeTile(file, data)
+
+		if err != nil {
+			log.Error().Msgf("caching tile %s: %s", file, err)
+		}
+	}
+
+	return data, nil
+}
+
+// tileGene finds the normalized expression a tile is colored by. The
+// gene can be given by its symbol, Ensembl id or public id and its
+// expression id identifies it in the tile cache.
+func (sdb *ScrnaDB) tileGene(datasetId string, geneId string, isAdmin bool, permissions []string) (*Gene, error) {
+	gexType, err := sdb.normalizedGexType(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := sdb.gexFiles(datasetId, gexType, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	genes, err := sdb.GetGenes(datasetId, []string{geneId}, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var ret *Gene
+
+	// a symbol matching more than one gene always picks the same one
+	for _, gene := range genes {
+		if slices.Contains(files, gene.Url) && (ret == nil || gene.Id < ret.Id) {
+			ret = gene
+		}
+	}
+
+	if ret == nil {
+		return nil, fmt.Errorf("gene %s not found", geneId)
+	}
+
+	return ret, nil
+}
+
+// tileExpression returns the expression of a gene in every cell
+func (sdb *ScrnaDB) tileExpression(gene *Gene, cells int) ([]float64, error) {
+	gex, err := sdb.readGex(gene)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]float64, cells)
+
+	for i, index := range gex.Indexes {
+		if int(index) < cells {
+			ret[index] = float64(gex.Gex[i])
+		}
+	}
+
+	return ret, nil
+}
+
+// tileStyleName is the case insensitive name of a clustering or cell
+// metadata column used in a style
+func tileStyleName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// tileClusterColors sets the color of each cell to that of its cluster
+// in a clustering
+func (sdb *ScrnaDB) tileClusterColors(datasetId string, clustering string, clusters []*Cluster, colors []color.RGBA) error {
+	cellClusters, err := sdb.cellClusters(datasetId, clustering)
+
+	if err != nil {
+		return err
+	}
+
+	if len(cellClusters) != len(colors) {
+		return fmt.Errorf("embedding does not match the cells")
+	}
+
+	clusterColors := make(map[int]color.RGBA)
+
+	for _, cluster := range clusters {
+		c, err := tiles.ParseHexColor(cluster.Color)
+
+		if err != nil {
+			c = tileZeroColor
+		}
+
+		clusterColors[cluster.Label] = c
+	}
+
+	for i, label := range cellClusters {
+		c, ok := clusterColors[label]
+
+		if !ok {
+			c = tileZeroColor
+		}
+
+		colors[i] = c
+	}
+
+	return nil
+}
+
+// tileDir returns the directory tiles of a dataset are cached in. It
+// includes when the dataset was imported so that tiles rendered from
+// a previous import are never served.
+func (sdb *ScrnaDB) tileDir(datasetId string) (string, error) {
+	var imported string
+
+	err := sdb.db.QueryRow(DatasetImportedSql, sql.Named("id", datasetId)).Scan(&imported)
+
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(sdb.dir, TilesDir, safeTileName(datasetId), safeTileName(imported)), nil
+}
+
+// writeTile writes to a temporary file first so that concurrent
+// requests never read a partial tile
+func writeTile(file string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(file), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tile-*")
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), file)
+}
+
+func safeTileName(name string) string {
+	return unsafeTileName.ReplaceAllString(name, "_")
+}
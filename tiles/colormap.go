@@ -0,0 +1,133 @@
+package tiles
+
+import (
+	"fmt"
+	"image/color"
+	"math"
+	"strings"
+)
+
+// A colormap linearly interpolates between evenly spaced colors
+type Colormap []color.RGBA
+
+const DefaultColormap = "viridis"
+
+var colormaps = map[string]Colormap{
+	"viridis": {
+		{68, 1, 84, 255},
+		{72, 40, 120, 255},
+		{62, 73, 137, 255},
+		{49, 104, 142, 255},
+		{38, 130, 142, 255},
+		{31, 158, 137, 255},
+		{53, 183, 121, 255},
+		{109, 205, 89, 255},
+		{180, 222, 44, 255},
+		{253, 231, 37, 255},
+	},
+	"magma": {
+		{0, 0, 4, 255},
+		{28, 16, 68, 255},
+		{79, 18, 123, 255},
+		{129, 37, 129, 255},
+		{181, 54, 122, 255},
+		{229, 80, 100, 255},
+		{251, 135, 97, 255},
+		{254, 194, 135, 255},
+		{252, 253, 191, 255},
+	},
+	"reds": {
+		{255, 245, 240, 255},
+		{252, 187, 161, 255},
+		{251, 106, 74, 255},
+		{203, 24, 29, 255},
+		{103, 0, 13, 255},
+	},
+	"blues": {
+		{247, 251, 255, 255},
+		{198, 219, 239, 255},
+		{107, 174, 214, 255},
+		{33, 113, 181, 255},
+		{8, 48, 107, 255},
+	},
+	"greys": {
+		{255, 255, 255, 255},
+		{0, 0, 0, 255},
+	},
+}
+
+func ParseColormap(name string) (Colormap, error) {
+	name, err := ColormapName(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return colormaps[name], nil
+}
+
+// ColormapName returns the name a colormap is known by, which is the
+// default colormap if name is empty
+func ColormapName(name string) (string, error) {
+	if name == "" {
+		return DefaultColormap, nil
+	}
+
+	ret := strings.ToLower(name)
+
+	if _, ok := colormaps[ret]; !ok {
+		return "", fmt.Errorf("unknown colormap %s", name)
+	}
+
+	return ret, nil
+}
+
+// At returns the color at t, which is clamped to [0, 1]
+func (cmap Colormap) At(t float64) color.RGBA {
+	if math.IsNaN(t) || t <= 0 {
+		return cmap[0]
+	}
+
+	if t >= 1 {
+		return cmap[len(cmap)-1]
+	}
+
+	f := t * float64(len(cmap)-1)
+	i := int(f)
+	f -= float64(i)
+
+	a := cmap[i]
+	b := cmap[i+1]
+
+	return color.RGBA{
+		R: lerp(a.R, b.R, f),
+		G: lerp(a.G, b.G, f),
+		B: lerp(a.B, b.B, f),
+		A: lerp(a.A, b.A, f),
+	}
+}
+
+// ParseHexColor parses colors of the form #rrggbb or #rgb
+func ParseHexColor(s string) (color.RGBA, error) {
+	ret := color.RGBA{A: 255}
+
+	var err error
+
+	switch len(s) {
+	case 7:
+		_, err = fmt.Sscanf(s, "#%02x%02x%02x", &ret.R, &ret.G, &ret.B)
+	case 4:
+		_, err = fmt.Sscanf(s, "#%1x%1x%1x", &ret.R, &ret.G, &ret.B)
+		ret.R *= 17
+		ret.G *= 17
+		ret.B *= 17
+	default:
+		err = fmt.Errorf("invalid color %s", s)
+	}
+
+	return ret, err
+}
+
+func lerp(a uint8, b uint8, f float64) uint8 {
+	return uint8(math.Round(float64(a) + (float64(b)-float64(a))*f))
+}
@@ -0,0 +1,102 @@
+package tiles
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// ImageWorld returns the square region tiles cover for an image whose
+// pixel (px, py) is at (px/scale, -py/scale). The image is at the top
+// left of the world so that tile (0, 0) starts at its corner.
+func ImageWorld(width int, height int, scale float64) spatial.Rect {
+	side := float64(max(width, height, 1)) / scale
+
+	return spatial.Rect{
+		Min: spatial.Point{X: 0, Y: -side},
+		Max: spatial.Point{X: side, Y: 0},
+	}
+}
+
+// ToRGBA converts an image to RGBA so its pixels can be read directly
+func ToRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+
+	b := img.Bounds()
+
+	ret := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	draw.Draw(ret, ret.Rect, img, b.Min, draw.Src)
+
+	return ret
+}
+
+// RenderImage draws the part of an image in a tile. Pixel (px, py) of
+// the image is at (px/scale, -py/scale) in the world, y being negated
+// so the image lines up with coordinates that were flipped to turn
+// them the right way up. Tile pixels covering several image pixels
+// are their average so zoomed out tiles are not aliased.
+func RenderImage(src *image.RGBA, scale float64, world spatial.Rect, tile Tile) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+
+	rect := tile.Rect(world)
+
+	// image pixels per tile pixel
+	step := rect.Width() / TileSize * scale
+
+	width := src.Rect.Dx()
+	height := src.Rect.Dy()
+
+	for ty := range TileSize {
+		y0 := int(math.Floor(-rect.Max.Y*scale + float64(ty)*step))
+		y1 := max(int(math.Floor(-rect.Max.Y*scale+float64(ty+1)*step)), y0+1)
+
+		y0 = max(y0, 0)
+		y1 = min(y1, height)
+
+		if y0 >= y1 {
+			continue
+		}
+
+		for tx := range TileSize {
+			x0 := int(math.Floor(rect.Min.X*scale + float64(tx)*step))
+			x1 := max(int(math.Floor(rect.Min.X*scale+float64(tx+1)*step)), x0+1)
+
+			x0 = max(x0, 0)
+			x1 = min(x1, width)
+
+			if x0 >= x1 {
+				continue
+			}
+
+			var r, g, b, a int
+
+			for y := y0; y < y1; y++ {
+				offset := src.PixOffset(x0, y)
+
+				for range x1 - x0 {
+					r += int(src.Pix[offset])
+					g += int(src.Pix[offset+1])
+					b += int(src.Pix[offset+2])
+					a += int(src.Pix[offset+3])
+					offset += 4
+				}
+			}
+
+			n := (x1 - x0) * (y1 - y0)
+
+			offset := img.PixOffset(tx, ty)
+
+			img.Pix[offset] = uint8(r / n)
+			img.Pix[offset+1] = uint8(g / n)
+			img.Pix[offset+2] = uint8(b / n)
+			img.Pix[offset+3] = uint8(a / n)
+		}
+	}
+
+	return img
+}
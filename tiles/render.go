@@ -0,0 +1,162 @@
+package tiles
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// Tiles use the same scheme as web maps: at zoom z the world is split
+// into 2^z by 2^z tiles of TileSize pixels with tile (0, 0) at the top
+// left. The world is a square around the embedding so that cells are
+// not stretched.
+type Tile struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+const (
+	TileSize = 256
+	MaxZoom  = 16
+
+	// fraction of the embedding added around it so cells at the
+	// edge are not cut off
+	worldPadding = 0.05
+)
+
+// World returns the square region tiles cover for an embedding with
+// the given bounds
+func World(bounds spatial.Rect) spatial.Rect {
+	side := max(bounds.Width(), bounds.Height())
+
+	if side <= 0 {
+		side = 1
+	}
+
+	side *= 1 + 2*worldPadding
+
+	cx := (bounds.Min.X + bounds.Max.X) / 2
+	cy := (bounds.Min.Y + bounds.Max.Y) / 2
+
+	return spatial.Rect{
+		Min: spatial.Point{X: cx - side/2, Y: cy - side/2},
+		Max: spatial.Point{X: cx + side/2, Y: cy + side/2},
+	}
+}
+
+func (t Tile) IsValid() bool {
+	// check the zoom first as shifting by a negative amount panics
+	if t.Z < 0 || t.Z > MaxZoom {
+		return false
+	}
+
+	n := 1 << t.Z
+
+	return t.X >= 0 && t.X < n && t.Y >= 0 && t.Y < n
+}
+
+// Rect returns the region of the world a tile covers
+func (t Tile) Rect(world spatial.Rect) spatial.Rect {
+	side := world.Width() / float64(int(1)<<t.Z)
+
+	return spatial.Rect{
+		Min: spatial.Point{X: world.Min.X + float64(t.X)*side, Y: world.Max.Y - float64(t.Y+1)*side},
+		Max: spatial.Point{X: world.Min.X + float64(t.X+1)*side, Y: world.Max.Y - float64(t.Y)*side},
+	}
+}
+
+// Render draws the points of a tree that fall in a tile as filled
+// circles of the given pixel radius. Points with a transparent color
+// are not drawn. Points are drawn in index order or, if order is not
+// nil, in ascending order of their order value so that, for example,
+// high expressing cells are drawn on top.
+func Render(tree *spatial.KDTree,
+	colors []color.RGBA,
+	order []float64,
+	world spatial.Rect,
+	tile Tile,
+	radius int) *image.RGBA {
+
+	img := image.NewRGBA(image.Rect(0, 0, TileSize, TileSize))
+
+	rect := tile.Rect(world)
+
+	scale := TileSize / rect.Width()
+
+	// include points just outside the tile whose circles overlap it
+	pad := float64(radius) / scale
+
+	search := spatial.Rect{
+		Min: spatial.Point{X: rect.Min.X - pad, Y: rect.Min.Y - pad},
+		Max: spatial.Point{X: rect.Max.X + pad, Y: rect.Max.Y + pad},
+	}
+
+	indexes := tree.InRect(search)
+
+	if order != nil {
+		slices.SortStableFunc(indexes, func(a, b int) int {
+			switch {
+			case order[a] < order[b]:
+				return -1
+			case order[a] > order[b]:
+				return 1
+			default:
+				return 0
+			}
+		})
+	}
+
+	r2 := radius * radius
+
+	for _, i := range indexes {
+		c := colors[i]
+
+		if c.A == 0 {
+			continue
+		}
+
+		p := tree.Point(i)
+
+		px := int(math.Floor((p.X - rect.Min.X) * scale))
+		py := int(math.Floor((rect.Max.Y - p.Y) * scale))
+
+		// only visit the part of the circle in the tile as spots can
+		// be much larger than a tile when zoomed in
+		for dy := max(-radius, -py); dy <= min(radius, TileSize-1-py); dy++ {
+			for dx := max(-radius, -px); dx <= min(radius, TileSize-1-px); dx++ {
+				if dx*dx+dy*dy <= r2 {
+					setPixel(img, px+dx, py+dy, c)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+// EncodePng encodes a tile as a png
+func EncodePng(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := png.Encode(&buf, img)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func setPixel(img *image.RGBA, x int, y int, c color.RGBA) {
+	if x < 0 || y < 0 || x >= TileSize || y >= TileSize {
+		return
+	}
+
+	img.SetRGBA(x, y, c)
+}
@@ -0,0 +1,235 @@
+package tiles
+
+import (
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+// run go test -update to regenerate the golden images after an
+// intended change to rendering
+var update = flag.Bool("update", false, "update the golden images in testdata")
+
+// checkGolden compares a rendered image pixel by pixel with the golden
+// image of the same name in testdata
+func checkGolden(t *testing.T, name string, img *image.RGBA) {
+	t.Helper()
+
+	file := filepath.Join("testdata", name+".png")
+
+	if *update {
+		data, err := EncodePng(img)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(file, data, 0644)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return
+	}
+
+	f, err := os.Open(file)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	golden, err := png.Decode(f)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := ToRGBA(golden)
+
+	if want.Rect != img.Rect {
+		t.Fatalf("%s: got size %v, want %v", name, img.Rect, want.Rect)
+	}
+
+	diff := 0
+
+	for y := range img.Rect.Dy() {
+		for x := range img.Rect.Dx() {
+			got := img.RGBAAt(x, y)
+			exp := want.RGBAAt(x, y)
+
+			if got != exp {
+				if diff == 0 {
+					t.Errorf("%s: pixel (%d, %d) is %v, want %v", name, x, y, got, exp)
+				}
+
+				diff++
+			}
+		}
+	}
+
+	if diff > 0 {
+		t.Errorf("%s: %d pixels differ from the golden image", name, diff)
+	}
+}
+
+// gridPoints returns n by n points on a unit grid
+func gridPoints(n int) []spatial.Point {
+	ret := make([]spatial.Point, 0, n*n)
+
+	for y := range n {
+		for x := range n {
+			ret = append(ret, spatial.Point{X: float64(x), Y: float64(y)})
+		}
+	}
+
+	return ret
+}
+
+func TestTileIsValid(t *testing.T) {
+	tests := []struct {
+		tile Tile
+		want bool
+	}{
+		{Tile{Z: 0, X: 0, Y: 0}, true},
+		{Tile{Z: 2, X: 3, Y: 3}, true},
+		{Tile{Z: 2, X: 4, Y: 0}, false},
+		{Tile{Z: 2, X: 0, Y: -1}, false},
+		{Tile{Z: -1, X: 0, Y: 0}, false},
+		{Tile{Z: MaxZoom + 1, X: 0, Y: 0}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.tile.IsValid(); got != test.want {
+			t.Errorf("%v.IsValid() = %v, want %v", test.tile, got, test.want)
+		}
+	}
+}
+
+func TestColormapAt(t *testing.T) {
+	names := make([]string, 0, len(colormaps))
+
+	for name := range colormaps {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		cmap, err := ParseColormap(name)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the ends are exactly the first and last colors and values
+		// outside [0, 1] are clamped
+		if cmap.At(0) != cmap[0] || cmap.At(-1) != cmap[0] || cmap.At(math.NaN()) != cmap[0] {
+			t.Errorf("%s: At(0) is not the first color", name)
+		}
+
+		if cmap.At(1) != cmap[len(cmap)-1] || cmap.At(2) != cmap[len(cmap)-1] {
+			t.Errorf("%s: At(1) is not the last color", name)
+		}
+
+		// a strip from 0 on the left to 1 on the right
+		img := image.NewRGBA(image.Rect(0, 0, TileSize, 16))
+
+		for x := range TileSize {
+			c := cmap.At(float64(x) / float64(TileSize-1))
+
+			for y := range 16 {
+				img.SetRGBA(x, y, c)
+			}
+		}
+
+		checkGolden(t, "colormap_"+name, img)
+	}
+}
+
+func TestRenderClusters(t *testing.T) {
+	points := gridPoints(10)
+
+	palette := []color.RGBA{
+		{R: 228, G: 26, B: 28, A: 255},
+		{R: 55, G: 126, B: 184, A: 255},
+		{R: 77, G: 175, B: 74, A: 255},
+		// cells not in a cluster are not drawn
+		{},
+	}
+
+	colors := make([]color.RGBA, len(points))
+
+	for i, p := range points {
+		colors[i] = palette[(int(p.X)+int(p.Y))%len(palette)]
+	}
+
+	tree := spatial.NewKDTree(points)
+
+	world := World(spatial.Bounds(points))
+
+	img := Render(tree, colors, nil, world, Tile{Z: 0, X: 0, Y: 0}, 6)
+
+	checkGolden(t, "render_clusters", img)
+}
+
+func TestRenderExpression(t *testing.T) {
+	points := gridPoints(10)
+
+	cmap, err := ParseColormap("viridis")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := make([]float64, len(points))
+	colors := make([]color.RGBA, len(points))
+
+	for i, p := range points {
+		values[i] = p.X * p.Y / 81
+
+		if values[i] > 0 {
+			colors[i] = cmap.At(values[i])
+		} else {
+			colors[i] = color.RGBA{R: 220, G: 220, B: 220, A: 255}
+		}
+	}
+
+	tree := spatial.NewKDTree(points)
+
+	world := World(spatial.Bounds(points))
+
+	// the top right quarter at zoom 1 with circles large enough to
+	// overlap so that high values must be drawn on top
+	img := Render(tree, colors, values, world, Tile{Z: 1, X: 1, Y: 0}, 30)
+
+	checkGolden(t, "render_expression", img)
+}
+
+func TestRenderImage(t *testing.T) {
+	// a gradient so that any misplaced pixel changes color
+	src := image.NewRGBA(image.Rect(0, 0, 300, 200))
+
+	for y := range 200 {
+		for x := range 300 {
+			src.SetRGBA(x, y, color.RGBA{R: uint8(x * 255 / 299), G: uint8(y * 255 / 199), B: uint8((x + y) % 256), A: 255})
+		}
+	}
+
+	world := ImageWorld(300, 200, 1)
+
+	// zoomed out tiles average image pixels and zoomed in tiles
+	// repeat them
+	checkGolden(t, "render_image_z0", RenderImage(src, 1, world, Tile{Z: 0, X: 0, Y: 0}))
+	checkGolden(t, "render_image_z2", RenderImage(src, 1, world, Tile{Z: 2, X: 1, Y: 0}))
+}
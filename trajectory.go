@@ -0,0 +1,461 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/antonybholmes/go-scrna/stats"
+)
+
+type (
+	CurveMethod string
+
+	Trajectory struct {
+		Id       string   `json:"id"`
+		Name     string   `json:"name"`
+		Lineages []string `json:"lineages"`
+	}
+
+	TrajectoryCurveOptions struct {
+		Method CurveMethod `json:"method"`
+		// number of bins or loess evaluation points
+		Points int `json:"points"`
+		// fraction of cells used in each local loess fit
+		Span float64 `json:"span"`
+		// cells with a lower lineage weight are ignored, the default
+		// if not given and all cells if 0
+		MinWeight *float64 `json:"minWeight"`
+		// cells failing these are ignored
+		Qc *QcThresholds `json:"qc"`
+	}
+
+	// Expression of a gene along one lineage. Pseudotime and Values
+	// are the same length; Cells is the number of cells in each bin
+	// and is only set for binned curves.
+	TrajectoryCurve struct {
+		GeneId     string    `json:"geneId"`
+		GeneSymbol string    `json:"geneSymbol"`
+		Lineage    string    `json:"lineage"`
+		Pseudotime []float64 `json:"pseudotime"`
+		Values     []float64 `json:"values"`
+		Cells      []int     `json:"cells,omitempty"`
+	}
+
+	TrajectoryCurves struct {
+		Dataset    string             `json:"dataset"`
+		Trajectory *Trajectory        `json:"trajectory"`
+		Method     CurveMethod        `json:"method"`
+		Curves     []*TrajectoryCurve `json:"curves"`
+	}
+
+	// the pseudotime and weight of the cells in one lineage
+	lineageValues struct {
+		cells      []int
+		pseudotime []float64
+		weights    []float64
+	}
+
+	trajectoryLineage struct {
+		trajectory int
+		lineage    int
+	}
+)
+
+const (
+	CurveBinned CurveMethod = "binned"
+	CurveLoess  CurveMethod = "loess"
+
+	DefaultCurvePoints = 50
+	MaxCurvePoints     = 500
+	DefaultLoessSpan   = 0.3
+	DefaultMinWeight   = 0.5
+
+	TrajectoriesSql = `SELECT
+		t.public_id,
+		t.name,
+		l.id,
+		l.name
+		FROM trajectories t
+		JOIN trajectory_lineages l ON t.id = l.trajectory_id
+		JOIN datasets d ON t.dataset_id = d.id
+		WHERE d.public_id = :id
+		ORDER BY t.id, l.id`
+
+	// cell indexes are the position of each cell in the dataset
+	// ordered by id, the order used by Metadata and the gex files
+	TrajectoryValuesSql = `SELECT
+		tv.lineage_id,
+		ci.idx,
+		tv.pseudotime,
+		tv.weight
+		FROM trajectory_values tv
+		JOIN (SELECT
+			c.id,
+			ROW_NUMBER() OVER (ORDER BY c.id) - 1 AS idx
+			FROM cells c
+			JOIN datasets d ON c.dataset_id = d.id
+			WHERE d.public_id = :id) ci ON tv.cell_id = ci.id
+		ORDER BY tv.lineage_id, tv.pseudotime`
+)
+
+func ParseCurveMethod(method string) (CurveMethod, error) {
+	switch strings.ToLower(method) {
+	case "", "binned":
+		return CurveBinned, nil
+	case "loess":
+		return CurveLoess, nil
+	default:
+		return "", fmt.Errorf("unknown curve method %s", method)
+	}
+}
+
+// Returns curves of the expression of genes against pseudotime for each
+// lineage of a trajectory, either as weighted means of equal width
+// pseudotime bins or as loess fits
+func (sdb *ScrnaDB) TrajectoryCurves(datasetId string,
+	trajectoryId string,
+	geneIds []string,
+	options *TrajectoryCurveOptions,
+	isAdmin bool,
+	permissions []string) (*TrajectoryCurves, error) {
+
+	method, err := ParseCurveMethod(string(options.Method))
+
+	if err != nil {
+		return nil, err
+	}
+
+	points := options.Points
+
+	if points <= 0 {
+		points = DefaultCurvePoints
+	}
+
+	points = min(points, MaxCurvePoints)
+
+	span := options.Span
+
+	if span <= 0 || span > 1 {
+		span = DefaultLoessSpan
+	}
+
+	minWeight := DefaultMinWeight
+
+	if options.MinWeight != nil {
+		minWeight = max(*options.MinWeight, 0)
+	}
+
+	genes, err := sdb.GetGenes(datasetId, geneIds, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gex, err := sdb.orderedGex(genes, geneIds)
+
+	if err != nil {
+		return nil, err
+	}
+
+	trajectories, lineageIds, err := sdb.trajectories(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := slices.IndexFunc(trajectories, func(t *Trajectory) bool {
+		return t.Id == trajectoryId || strings.EqualFold(t.Name, trajectoryId)
+	})
+
+	if t == -1 {
+		return nil, fmt.Errorf("trajectory %s not found", trajectoryId)
+	}
+
+	values, err := sdb.lineageValues(datasetId, lineageIds, t)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ret := TrajectoryCurves{
+		Dataset:    datasetId,
+		Trajectory: trajectories[t],
+		Method:     method,
+		Curves:     make([]*TrajectoryCurve, 0, len(gex)*len(trajectories[t].Lineages)),
+	}
+
+	cellCount, err := sdb.cellCount(datasetId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cells, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	expression := make([]float64, cellCount)
+
+	for _, g := range gex {
+		clear(expression)
+
+		for i, index := range g.Indexes {
+			if int(index) < cellCount {
+				expression[index] = float64(g.Gex[i])
+			}
+		}
+
+		for l, lineage := range trajectories[t].Lineages {
+			v := values[l].filter(minWeight, cells)
+
+			curve := TrajectoryCurve{
+				GeneId:     g.GeneId,
+				GeneSymbol: g.GeneSymbol,
+				Lineage:    lineage,
+			}
+
+			if len(v.cells) > 0 {
+				y := make([]float64, len(v.cells))
+
+				for i, cell := range v.cells {
+					y[i] = expression[cell]
+				}
+
+				if method == CurveLoess {
+					loessCurve(&curve, v, y, points, span)
+				} else {
+					binnedCurve(&curve, v, y, points)
+				}
+			}
+
+			ret.Curves = append(ret.Curves, &curve)
+		}
+	}
+
+	return &ret, nil
+}
+
+// binnedCurve splits the pseudotime range into equal width bins and
+// returns the weighted mean expression of each non-empty bin
+func binnedCurve(curve *TrajectoryCurve, v *lineageValues, y []float64, bins int) {
+	start := v.pseudotime[0]
+	width := (v.pseudotime[len(v.pseudotime)-1] - start) / float64(bins)
+
+	sums := make([]float64, bins)
+	weights := make([]float64, bins)
+	counts := make([]int, bins)
+
+	for i, p := range v.pseudotime {
+		bin := bins - 1
+
+		if width > 0 {
+			bin = min(int((p-start)/width), bins-1)
+		}
+
+		sums[bin] += v.weights[i] * y[i]
+		weights[bin] += v.weights[i]
+		counts[bin]++
+	}
+
+	for bin := range bins {
+		if counts[bin] == 0 || weights[bin] == 0 {
+			continue
+		}
+
+		curve.Pseudotime = append(curve.Pseudotime, start+(float64(bin)+0.5)*width)
+		curve.Values = append(curve.Values, sums[bin]/weights[bin])
+		curve.Cells = append(curve.Cells, counts[bin])
+	}
+}
+
+// loessCurve evaluates a loess fit at equally spaced pseudotimes
+func loessCurve(curve *TrajectoryCurve, v *lineageValues, y []float64, points int, span float64) {
+	start := v.pseudotime[0]
+	end := v.pseudotime[len(v.pseudotime)-1]
+
+	at := make([]float64, points)
+
+	for i := range at {
+		if points > 1 {
+			at[i] = start + (end-start)*float64(i)/float64(points-1)
+		} else {
+			at[i] = start
+		}
+	}
+
+	for i, value := range stats.Loess(v.pseudotime, y, v.weights, at, span) {
+		if !math.IsNaN(value) {
+			curve.Pseudotime = append(curve.Pseudotime, at[i])
+			curve.Values = append(curve.Values, value)
+		}
+	}
+}
+
+// filter returns the cells with at least the minimum weight, which
+// remain sorted by pseudotime
+func (v *lineageValues) filter(minWeight float64, cells *CellSet) *lineageValues {
+	ret := lineageValues{
+		cells:      make([]int, 0, len(v.cells)),
+		pseudotime: make([]float64, 0, len(v.cells)),
+		weights:    make([]float64, 0, len(v.cells)),
+	}
+
+	for i, w := range v.weights {
+		if w >= minWeight && (cells == nil || cells.Has(v.cells[i])) {
+			ret.cells = append(ret.cells, v.cells[i])
+			ret.pseudotime = append(ret.pseudotime, v.pseudotime[i])
+			ret.weights = append(ret.weights, w)
+		}
+	}
+
+	return &ret
+}
+
+// trajectories returns the trajectories of a dataset and a map from
+// lineage row ids to their trajectory and lineage index
+func (sdb *ScrnaDB) trajectories(datasetId string) ([]*Trajectory, map[int]trajectoryLineage, error) {
+	rows, err := sdb.db.Query(TrajectoriesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	defer rows.Close()
+
+	ret := make([]*Trajectory, 0, 5)
+	lineageIds := make(map[int]trajectoryLineage)
+
+	var current *Trajectory
+
+	for rows.Next() {
+		var id string
+		var name string
+		var lineageId int
+		var lineage string
+
+		err := rows.Scan(&id, &name, &lineageId, &lineage)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if current == nil || current.Id != id {
+			current = &Trajectory{Id: id, Name: name}
+			ret = append(ret, current)
+		}
+
+		lineageIds[lineageId] = trajectoryLineage{trajectory: len(ret) - 1, lineage: len(current.Lineages)}
+
+		current.Lineages = append(current.Lineages, lineage)
+	}
+
+	return ret, lineageIds, nil
+}
+
+// lineageValues returns the pseudotime and weight of the cells in
+// each lineage of a trajectory, sorted by pseudotime
+func (sdb *ScrnaDB) lineageValues(datasetId string, lineageIds map[int]trajectoryLineage, trajectory int) ([]*lineageValues, error) {
+	ret := make([]*lineageValues, 0, 5)
+
+	for _, tl := range lineageIds {
+		if tl.trajectory == trajectory {
+			for len(ret) <= tl.lineage {
+				ret = append(ret, &lineageValues{})
+			}
+		}
+	}
+
+	if len(ret) == 0 {
+		return nil, errors.New("trajectory has no lineages")
+	}
+
+	err := sdb.scanTrajectoryValues(datasetId, func(lineageId int, cell int, pseudotime float64, weight float64) {
+		tl, ok := lineageIds[lineageId]
+
+		if !ok || tl.trajectory != trajectory {
+			return
+		}
+
+		v := ret[tl.lineage]
+		v.cells = append(v.cells, cell)
+		v.pseudotime = append(v.pseudotime, pseudotime)
+		v.weights = append(v.weights, weight)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+func (sdb *ScrnaDB) scanTrajectoryValues(datasetId string, fn func(lineageId int, cell int, pseudotime float64, weight float64)) error {
+	rows, err := sdb.db.Query(TrajectoryValuesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var lineageId int
+		var cell int
+		var pseudotime float64
+		var weight float64
+
+		err := rows.Scan(&lineageId, &cell, &pseudotime, &weight)
+
+		if err != nil {
+			return err
+		}
+
+		fn(lineageId, cell, pseudotime, weight)
+	}
+
+	return nil
+}
+
+// addTrajectories adds the pseudotime and weight of each cell in each
+// lineage of each trajectory of a dataset to its metadata
+func (sdb *ScrnaDB) addTrajectories(datasetId string, metadata *DatasetMetadata) error {
+	trajectories, lineageIds, err := sdb.trajectories(datasetId)
+
+	if err != nil {
+		return err
+	}
+
+	if len(trajectories) == 0 {
+		return nil
+	}
+
+	metadata.Trajectories = trajectories
+
+	for _, cell := range metadata.Cells {
+		cell.Pseudotime = make([][]*float64, len(trajectories))
+		cell.Weights = make([][]float64, len(trajectories))
+
+		for t, trajectory := range trajectories {
+			cell.Pseudotime[t] = make([]*float64, len(trajectory.Lineages))
+			cell.Weights[t] = make([]float64, len(trajectory.Lineages))
+		}
+	}
+
+	return sdb.scanTrajectoryValues(datasetId, func(lineageId int, cell int, pseudotime float64, weight float64) {
+		tl, ok := lineageIds[lineageId]
+
+		if !ok || cell >= len(metadata.Cells) {
+			return
+		}
+
+		c := metadata.Cells[cell]
+		c.Pseudotime[tl.trajectory][tl.lineage] = &pseudotime
+		c.Weights[tl.trajectory][tl.lineage] = weight
+	})
+}
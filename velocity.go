@@ -0,0 +1,212 @@
+package scrna
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"slices"
+
+	"github.com/antonybholmes/go-scrna/spatial"
+)
+
+type (
+	VelocityGridOptions struct {
+		// number of grid squares along the longer side of the
+		// embedding
+		Size int `json:"size"`
+		// grid squares with fewer cells are not returned
+		MinCells int `json:"minCells"`
+		// clustering the clusters are from, the default if empty
+		Clustering string `json:"clustering"`
+		// only use cells in these clusters if not empty
+		Clusters []int `json:"clusters"`
+		// cells failing these are not averaged
+		Qc *QcThresholds `json:"qc"`
+	}
+
+	// The mean velocity of the cells in a grid square, drawn from
+	// the centre of the square
+	VelocityArrow struct {
+		X     float64 `json:"x"`
+		Y     float64 `json:"y"`
+		Dx    float64 `json:"dx"`
+		Dy    float64 `json:"dy"`
+		Cells int     `json:"cells"`
+	}
+
+	VelocityGrid struct {
+		Dataset string `json:"dataset"`
+		// bounds of all cells so that grids of different clusters
+		// line up
+		Bounds     spatial.Rect     `json:"bounds"`
+		Step       float64          `json:"step"`
+		Columns    int              `json:"columns"`
+		Rows       int              `json:"rows"`
+		Clustering string           `json:"clustering,omitempty"`
+		Clusters   []int            `json:"clusters,omitempty"`
+		Arrows     []*VelocityArrow `json:"arrows"`
+	}
+)
+
+const (
+	DefaultVelocityGridSize = 40
+	MaxVelocityGridSize     = 200
+	DefaultVelocityMinCells = 3
+
+	CellVelocitiesSql = `SELECT
+		c.umap_x,
+		c.umap_y,
+		cv.dx,
+		cv.dy
+		FROM cells c
+		JOIN datasets d ON c.dataset_id = d.id
+		LEFT JOIN cell_velocities cv ON c.id = cv.cell_id
+		WHERE d.public_id = :id
+		ORDER BY c.id`
+)
+
+// Average the velocity embedding vectors of cells over a grid covering
+// the embedding so that they can be drawn as arrows or streamlines
+func (sdb *ScrnaDB) VelocityGrid(datasetId string,
+	options *VelocityGridOptions,
+	isAdmin bool,
+	permissions []string) (*VelocityGrid, error) {
+
+	// check the user can view the dataset
+	_, err := sdb.dataset(datasetId, isAdmin, permissions)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := options.Size
+
+	if size <= 0 {
+		size = DefaultVelocityGridSize
+	}
+
+	size = min(size, MaxVelocityGridSize)
+
+	minCells := options.MinCells
+
+	if minCells <= 0 {
+		minCells = DefaultVelocityMinCells
+	}
+
+	cells, err := sdb.qcCells(datasetId, options.Qc)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// cluster of each cell, only needed to filter by cluster
+	var labels []int
+
+	if len(options.Clusters) > 0 {
+		labels, err = sdb.cellClusters(datasetId, options.Clustering)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := sdb.db.Query(CellVelocitiesSql, sql.Named("id", datasetId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	points := make([]spatial.Point, 0, 10000)
+	velocities := make([]spatial.Point, 0, 10000)
+	include := make([]bool, 0, 10000)
+
+	hasVelocity := false
+
+	for rows.Next() {
+		var p spatial.Point
+		var dx sql.NullFloat64
+		var dy sql.NullFloat64
+
+		err := rows.Scan(&p.X, &p.Y, &dx, &dy)
+
+		if err != nil {
+			return nil, err
+		}
+
+		ok := dx.Valid && dy.Valid
+
+		hasVelocity = hasVelocity || ok
+
+		points = append(points, p)
+		velocities = append(velocities, spatial.Point{X: dx.Float64, Y: dy.Float64})
+		include = append(include, ok)
+	}
+
+	if labels != nil {
+		if len(labels) != len(points) {
+			return nil, errors.New("cell clusters do not match the cells")
+		}
+
+		for i, label := range labels {
+			include[i] = include[i] && slices.Contains(options.Clusters, label)
+		}
+	}
+
+	if !hasVelocity {
+		return nil, errors.New("dataset has no velocities")
+	}
+
+	ret := VelocityGrid{
+		Dataset:    datasetId,
+		Bounds:     spatial.Bounds(points),
+		Clustering: options.Clustering,
+		Clusters:   options.Clusters,
+		Arrows:     make([]*VelocityArrow, 0, size*size),
+	}
+
+	ret.Step = max(ret.Bounds.Width(), ret.Bounds.Height()) / float64(size)
+
+	if ret.Step == 0 {
+		ret.Step = 1
+	}
+
+	ret.Columns = max(int(math.Ceil(ret.Bounds.Width()/ret.Step)), 1)
+	ret.Rows = max(int(math.Ceil(ret.Bounds.Height()/ret.Step)), 1)
+
+	sums := make([]VelocityArrow, ret.Columns*ret.Rows)
+
+	for i, p := range points {
+		if !include[i] || (cells != nil && !cells.Has(i)) {
+			continue
+		}
+
+		col := min(int((p.X-ret.Bounds.Min.X)/ret.Step), ret.Columns-1)
+		row := min(int((p.Y-ret.Bounds.Min.Y)/ret.Step), ret.Rows-1)
+
+		square := &sums[row*ret.Columns+col]
+		square.Dx += velocities[i].X
+		square.Dy += velocities[i].Y
+		square.Cells++
+	}
+
+	for i, square := range sums {
+		if square.Cells < minCells {
+			continue
+		}
+
+		col := i % ret.Columns
+		row := i / ret.Columns
+
+		ret.Arrows = append(ret.Arrows, &VelocityArrow{
+			X:     ret.Bounds.Min.X + (float64(col)+0.5)*ret.Step,
+			Y:     ret.Bounds.Min.Y + (float64(row)+0.5)*ret.Step,
+			Dx:    square.Dx / float64(square.Cells),
+			Dy:    square.Dy / float64(square.Cells),
+			Cells: square.Cells,
+		})
+	}
+
+	return &ret, nil
+}